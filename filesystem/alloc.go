@@ -0,0 +1,120 @@
+package filesystem
+
+// this function sets bit i of the bitmap that starts at block offset in place, the caller holds the allocator lock
+func (fsys *FileSystem) writeBit(offset int, i int, value bool) {
+	bitsPerBlock := fsys.superblock.Blocksize * 8
+	block := offset + i/bitsPerBlock
+	mask := byte(0x80 >> uint(i%8))
+	if value {
+		fsys.VirtualDisk[block][i%bitsPerBlock/8] |= mask
+	} else {
+		fsys.VirtualDisk[block][i%bitsPerBlock/8] &^= mask
+	}
+	fsys.markDirty(block)
+}
+
+// this function hands out the first free block with a reference count of 1 and returns its
+// disk block, the caller holds the allocator lock
+func (fsys *FileSystem) allocateBlock() (int, error) {
+	if err := fsys.allocatorCorrupt(); err != nil {
+		return 0, err
+	}
+	for i := range fsys.Refcounts {
+		if fsys.Refcounts[i] == 0 {
+			fsys.Refcounts[i] = 1
+			fsys.writeRefcount(i)
+			block := i + fsys.superblock.Datablocksoffset
+			//hand out the block zeroed so old pointers or data can't leak into it
+			fsys.clearBlock(block)
+			fsys.markDataDirty(block)
+			return block, nil
+		}
+	}
+	return 0, ErrNoSpace
+}
+
+// this function drops one reference to a block, the caller holds the allocator lock. The block
+// is freed and zeroed once nothing points at it anymore, levels is how many levels of indirect
+// blocks are below it so the blocks a freed indirect block points at lose that reference too.
+// The zeros aren't committed to the disk image, the last committed metadata may still point at
+// the block until this transaction commits and allocateBlock zeroes it again when it's reused.
+// Nothing is freed while the reference counts are corrupt, Fsck counts them again
+func (fsys *FileSystem) freeBlock(block int, levels int) {
+	if !fsys.inRange(block) || fsys.allocatorCorrupt() != nil {
+		return
+	}
+	i := block - fsys.superblock.Datablocksoffset
+	fsys.Refcounts[i]--
+	fsys.writeRefcount(i)
+	if fsys.Refcounts[i] > 0 {
+		return
+	}
+	if levels > 0 {
+		for _, pointer := range fsys.readPointers(block) {
+			if pointer != 0 {
+				fsys.freeBlock(pointer, levels-1)
+			}
+		}
+	}
+	fsys.clearBlock(block)
+}
+
+// this function adds one reference to a block that is already in use, the caller holds the
+// allocator lock
+func (fsys *FileSystem) shareBlock(block int) {
+	if !fsys.inRange(block) || fsys.allocatorCorrupt() != nil {
+		return
+	}
+	i := block - fsys.superblock.Datablocksoffset
+	fsys.Refcounts[i]++
+	fsys.writeRefcount(i)
+}
+
+// this function returns the reference count of a block, the caller holds the allocator lock
+func (fsys *FileSystem) refcount(block int) int {
+	return fsys.Refcounts[block-fsys.superblock.Datablocksoffset]
+}
+
+// this function counts the free blocks, the caller holds the allocator lock
+func (fsys *FileSystem) freeBlocks() int {
+	free := 0
+	for _, refcount := range fsys.Refcounts {
+		if refcount == 0 {
+			free++
+		}
+	}
+	return free
+}
+
+// this function marks the first free inode as used and returns its number, inodes in a corrupt
+// block of the inode table are left alone
+func (fsys *FileSystem) allocateInode() (int, error) {
+	fsys.allocator.Lock()
+	defer fsys.allocator.Unlock()
+	if err := fsys.allocatorCorrupt(); err != nil {
+		return 0, err
+	}
+	for i := range fsys.InodeBitmap {
+		if !fsys.InodeBitmap[i] && fsys.verifyRecord(i) == nil {
+			fsys.InodeBitmap[i] = true
+			fsys.writeBit(fsys.superblock.Inodebitmapoffset, i, true)
+			return i, nil
+		}
+	}
+	return 0, ErrNoInodes
+}
+
+// this function frees the datablocks and the xattr block of the inode at number, marks it as
+// not valid and gives it back to the inode bitmap. The caller holds the lock of the inode
+func (fsys *FileSystem) releaseInode(number int) {
+	inode := fsys.freeXattrs(fsys.freeInodeBlocks(fsys.ReadInode(number)))
+	inode.IsValid = false
+	inode.IsDirectory = false
+	inode.Size = 0
+	inode.Generation++
+	fsys.WriteInode(inode)
+	fsys.allocator.Lock()
+	defer fsys.allocator.Unlock()
+	fsys.InodeBitmap[number] = false
+	fsys.writeBit(fsys.superblock.Inodebitmapoffset, number, false)
+}
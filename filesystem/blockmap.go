@@ -0,0 +1,612 @@
+package filesystem
+
+import "encoding/binary"
+
+// an indirect block is a list of little endian uint32 block numbers, 0 means no block
+func pointersPerBlock(superblock SuperBlock) int {
+	return superblock.Blocksize / 4
+}
+
+// this is the most datablocks one inode can address through its direct, indirect and double indirect blocks
+func maxInodeBlocks(superblock SuperBlock) int {
+	perBlock := pointersPerBlock(superblock)
+	return 4 + perBlock + perBlock*perBlock
+}
+
+// this function says if block is one of the datablocks, a pointer to anything else is corrupt
+func (fsys *FileSystem) inRange(block int) bool {
+	return block >= fsys.superblock.Datablocksoffset && block < len(fsys.VirtualDisk)
+}
+
+// this function reads the block numbers stored in an indirect block, a corrupt one reads as
+// empty so nothing follows the pointers in it, and so does one that isn't a datablock
+func (fsys *FileSystem) readPointers(block int) []int {
+	pointers := make([]int, pointersPerBlock(fsys.superblock))
+	if !fsys.inRange(block) || fsys.isCorrupt(block) {
+		return pointers
+	}
+	for i := range pointers {
+		pointers[i] = int(binary.LittleEndian.Uint32(fsys.VirtualDisk[block][i*4:]))
+	}
+	return pointers
+}
+
+// this function writes block numbers into an indirect block
+func (fsys *FileSystem) writePointers(block int, pointers []int) {
+	for i := range pointers {
+		binary.LittleEndian.PutUint32(fsys.VirtualDisk[block][i*4:], uint32(pointers[i]))
+	}
+	fsys.markDirty(block)
+}
+
+// this function returns every datablock of an inode in file order, following the
+// indirect and double indirect blocks
+func (fsys *FileSystem) inodeBlocks(inode Inode) []int {
+	var blocks []int
+	for _, block := range inode.Datablocks {
+		if !fsys.inRange(block) {
+			return blocks
+		}
+		blocks = append(blocks, block)
+	}
+	if !fsys.inRange(inode.Indirect) {
+		return blocks
+	}
+	for _, block := range fsys.readPointers(inode.Indirect) {
+		if !fsys.inRange(block) {
+			return blocks
+		}
+		blocks = append(blocks, block)
+	}
+	if !fsys.inRange(inode.DoubleIndirect) {
+		return blocks
+	}
+	for _, indirect := range fsys.readPointers(inode.DoubleIndirect) {
+		if !fsys.inRange(indirect) {
+			return blocks
+		}
+		for _, block := range fsys.readPointers(indirect) {
+			if !fsys.inRange(block) {
+				return blocks
+			}
+			blocks = append(blocks, block)
+		}
+	}
+	return blocks
+}
+
+// this function returns how many datablocks hold size bytes of content
+func (fsys *FileSystem) blocksFor(size int64) int {
+	blocksize := int64(fsys.ReadSuperblock().Blocksize)
+	return int((size + blocksize - 1) / blocksize)
+}
+
+// this function counts how many blocks have to be allocated, including indirect blocks,
+// to grow an inode from have to want datablocks
+func blocksToGrow(have, want int, pointersPerBlock int) int {
+	count := want - have
+	if want > 4 && have <= 4 {
+		count++
+	}
+	for i := have; i < want; i++ {
+		//a new indirect block under the double indirect block starts every pointersPerBlock blocks
+		if i >= 4+pointersPerBlock && (i-4-pointersPerBlock)%pointersPerBlock == 0 {
+			count++
+		}
+	}
+	if want > 4+pointersPerBlock && have <= 4+pointersPerBlock {
+		count++
+	}
+	return count
+}
+
+// this function grows an inode to numBlocks datablocks, allocating the indirect and double
+// indirect blocks on the way. Nothing is allocated if there isn't room for all of it
+func (fsys *FileSystem) growInodeBlocks(inode Inode, numBlocks int) (Inode, error) {
+	return fsys.prepareBlocks(inode, numBlocks, numBlocks)
+}
+
+// this function gets the datablocks from up to to of an inode ready to be written. The inode
+// grows to to datablocks if it has fewer, and every block on the way that is shared with a
+// snapshot is copied first so writing it leaves the snapshot as it was. Nothing changes if
+// there isn't room for all of it
+func (fsys *FileSystem) prepareBlocks(inode Inode, from int, to int) (Inode, error) {
+	superblock := fsys.ReadSuperblock()
+	have := len(fsys.inodeBlocks(inode))
+	if to > have && to > maxInodeBlocks(superblock) {
+		return inode, ErrFileTooLarge
+	}
+	//growing writes new pointers into the indirect blocks that hold the last datablock, so they
+	//have to be copied as well
+	if from > have {
+		from = have
+	}
+	last := to
+	if last > have {
+		last = have + 1
+	}
+	fsys.allocator.Lock()
+	defer fsys.allocator.Unlock()
+	pointersPerBlock := pointersPerBlock(superblock)
+	need := fsys.copiesNeeded(inode, from, last)
+	if to > have {
+		need += blocksToGrow(have, to, pointersPerBlock)
+	}
+	if fsys.freeBlocks() < need {
+		return inode, ErrNoSpace
+	}
+	var err error
+	for i := from; i < last; i++ {
+		if inode, err = fsys.ownDatablock(inode, i); err != nil {
+			return inode, err
+		}
+	}
+
+	for i := have; i < to; i++ {
+		block, err := fsys.allocateBlock()
+		if err != nil {
+			return inode, err
+		}
+		if inode, err = fsys.placeBlock(inode, i, block); err != nil {
+			return inode, err
+		}
+	}
+	return inode, nil
+}
+
+// this function makes block datablock index of an inode, the inode has index datablocks. The
+// indirect and double indirect blocks on the way are allocated if they aren't there yet, the
+// caller holds the allocator lock and owns the ones that are
+func (fsys *FileSystem) placeBlock(inode Inode, index int, block int) (Inode, error) {
+	pointersPerBlock := pointersPerBlock(fsys.ReadSuperblock())
+	var err error
+	switch {
+	case index < 4:
+		inode.Datablocks[index] = block
+	case index < 4+pointersPerBlock:
+		if inode.Indirect == 0 {
+			if inode.Indirect, err = fsys.allocateBlock(); err != nil {
+				return inode, err
+			}
+		}
+		pointers := fsys.readPointers(inode.Indirect)
+		pointers[index-4] = block
+		fsys.writePointers(inode.Indirect, pointers)
+	default:
+		if inode.DoubleIndirect == 0 {
+			if inode.DoubleIndirect, err = fsys.allocateBlock(); err != nil {
+				return inode, err
+			}
+		}
+		index -= 4 + pointersPerBlock
+		outer := fsys.readPointers(inode.DoubleIndirect)
+		if outer[index/pointersPerBlock] == 0 {
+			if outer[index/pointersPerBlock], err = fsys.allocateBlock(); err != nil {
+				return inode, err
+			}
+			fsys.writePointers(inode.DoubleIndirect, outer)
+		}
+		inner := fsys.readPointers(outer[index/pointersPerBlock])
+		inner[index%pointersPerBlock] = block
+		fsys.writePointers(outer[index/pointersPerBlock], inner)
+	}
+	return inode, nil
+}
+
+// this function replaces the datablocks from up to to of an inode with new blocks holding
+// content, the datablocks from to up to end follow them and the ones after end are dropped.
+// The new blocks are allocated before the old ones lose their reference, so nothing the last
+// committed metadata points at is written before the new pointers are committed. Nothing
+// changes if there isn't room for it
+func (fsys *FileSystem) replaceBlocks(inode Inode, from int, to int, end int, content [][]byte) (Inode, error) {
+	superblock := fsys.ReadSuperblock()
+	kept := fsys.inodeBlocks(inode)[to:end]
+	numBlocks := from + len(content) + len(kept)
+	if numBlocks > maxInodeBlocks(superblock) {
+		return inode, ErrFileTooLarge
+	}
+	fsys.allocator.Lock()
+	if err := fsys.allocatorCorrupt(); err != nil {
+		fsys.allocator.Unlock()
+		return inode, err
+	}
+	//cutting the inode back to from and growing it again copies at most three shared indirect
+	//blocks, the double indirect block and the two indirect blocks around from
+	need := len(content) + blocksToGrow(from, numBlocks, pointersPerBlock(superblock)) + 3
+	if fsys.freeBlocks() < need {
+		fsys.allocator.Unlock()
+		return inode, ErrNoSpace
+	}
+	fresh := make([]int, len(content))
+	for i := range content {
+		var err error
+		if fresh[i], err = fsys.allocateBlock(); err != nil {
+			fsys.allocator.Unlock()
+			return inode, err
+		}
+		copy(fsys.VirtualDisk[fresh[i]], content[i])
+	}
+	//the blocks that follow keep a reference of their own while the inode lets go of them
+	for _, block := range kept {
+		fsys.shareBlock(block)
+	}
+	fsys.allocator.Unlock()
+
+	inode, err := fsys.shrinkInodeBlocks(inode, from)
+	if err != nil {
+		return inode, err
+	}
+	fsys.allocator.Lock()
+	defer fsys.allocator.Unlock()
+	if inode, err = fsys.ownDatablock(inode, from); err != nil {
+		return inode, err
+	}
+	for i, block := range append(fresh, kept...) {
+		if inode, err = fsys.placeBlock(inode, from+i, block); err != nil {
+			return inode, err
+		}
+	}
+	return inode, nil
+}
+
+// this function counts the blocks ownDatablock copies for the datablocks from up to to, the
+// caller holds the allocator lock. A block is copied when it is shared or when the indirect
+// block pointing at it is copied, since the copy shares everything it points at
+func (fsys *FileSystem) copiesNeeded(inode Inode, from int, to int) int {
+	pointersPerBlock := pointersPerBlock(fsys.ReadSuperblock())
+	copied := map[int]bool{}
+	//parent is the block that points at block, 0 for the inode itself
+	mark := func(block int, parent int) {
+		if block != 0 && (copied[parent] || fsys.refcount(block) > 1) {
+			copied[block] = true
+		}
+	}
+	for i := from; i < to; i++ {
+		switch {
+		case i < 4:
+			mark(inode.Datablocks[i], 0)
+		case i < 4+pointersPerBlock:
+			if inode.Indirect != 0 {
+				mark(inode.Indirect, 0)
+				mark(fsys.readPointers(inode.Indirect)[i-4], inode.Indirect)
+			}
+		default:
+			if inode.DoubleIndirect != 0 {
+				index := i - 4 - pointersPerBlock
+				mark(inode.DoubleIndirect, 0)
+				inner := fsys.readPointers(inode.DoubleIndirect)[index/pointersPerBlock]
+				mark(inner, inode.DoubleIndirect)
+				if inner != 0 {
+					mark(fsys.readPointers(inner)[index%pointersPerBlock], inner)
+				}
+			}
+		}
+	}
+	return len(copied)
+}
+
+// this function makes datablock index of an inode and the indirect blocks on the way to it its
+// own, copying the ones that are shared. The caller holds the allocator lock and made sure
+// there is room for the copies with copiesNeeded
+func (fsys *FileSystem) ownDatablock(inode Inode, index int) (Inode, error) {
+	pointersPerBlock := pointersPerBlock(fsys.ReadSuperblock())
+	var err error
+	switch {
+	case index < 4:
+		if inode.Datablocks[index] != 0 {
+			inode.Datablocks[index], err = fsys.ownBlock(inode.Datablocks[index], 0)
+		}
+		return inode, err
+	case index < 4+pointersPerBlock:
+		if inode.Indirect == 0 {
+			return inode, nil
+		}
+		if inode.Indirect, err = fsys.ownBlock(inode.Indirect, 1); err != nil {
+			return inode, err
+		}
+		return inode, fsys.ownPointer(inode.Indirect, index-4, 0)
+	}
+	if inode.DoubleIndirect == 0 {
+		return inode, nil
+	}
+	if inode.DoubleIndirect, err = fsys.ownBlock(inode.DoubleIndirect, 2); err != nil {
+		return inode, err
+	}
+	index -= 4 + pointersPerBlock
+	if err := fsys.ownPointer(inode.DoubleIndirect, index/pointersPerBlock, 1); err != nil {
+		return inode, err
+	}
+	inner := fsys.readPointers(inode.DoubleIndirect)[index/pointersPerBlock]
+	if inner == 0 {
+		return inode, nil
+	}
+	return inode, fsys.ownPointer(inner, index%pointersPerBlock, 0)
+}
+
+// this function makes the block that pointer i of an indirect block points at its own, levels
+// is how many levels of indirect blocks are below that block
+func (fsys *FileSystem) ownPointer(block int, i int, levels int) error {
+	pointers := fsys.readPointers(block)
+	if pointers[i] == 0 {
+		return nil
+	}
+	owned, err := fsys.ownBlock(pointers[i], levels)
+	if err != nil || owned == pointers[i] {
+		return err
+	}
+	pointers[i] = owned
+	fsys.writePointers(block, pointers)
+	return nil
+}
+
+// this function returns the block to write in place of block, the caller holds the allocator
+// lock. A block nothing else points at is returned as it is, a shared one is copied into a new
+// block that takes over this reference. levels is how many levels of indirect blocks are below
+// the block, everything a copied indirect block points at gets the reference the copy holds
+func (fsys *FileSystem) ownBlock(block int, levels int) (int, error) {
+	if fsys.refcount(block) <= 1 {
+		return block, nil
+	}
+	copied, err := fsys.allocateBlock()
+	if err != nil {
+		return block, err
+	}
+	copy(fsys.VirtualDisk[copied], fsys.VirtualDisk[block])
+	if levels > 0 {
+		for _, pointer := range fsys.readPointers(block) {
+			if pointer != 0 {
+				fsys.shareBlock(pointer)
+			}
+		}
+		fsys.markDirty(copied)
+	}
+	fsys.freeBlock(block, levels)
+	return copied, nil
+}
+
+// this function shrinks an inode to its first numBlocks datablocks, the blocks after them lose
+// the reference the inode held along with the indirect blocks that don't point at anything
+// anymore. The indirect blocks that keep some of their pointers are copied first if they are
+// shared with a snapshot, nothing changes if there isn't room for that
+func (fsys *FileSystem) shrinkInodeBlocks(inode Inode, numBlocks int) (Inode, error) {
+	if numBlocks >= len(fsys.inodeBlocks(inode)) {
+		return inode, nil
+	}
+	pointersPerBlock := pointersPerBlock(fsys.ReadSuperblock())
+	//keep is how many blocks stay under the double indirect block
+	keep := numBlocks - 4 - pointersPerBlock
+	fsys.allocator.Lock()
+	defer fsys.allocator.Unlock()
+	need := 0
+	if numBlocks > 4 && keep < 0 && fsys.refcount(inode.Indirect) > 1 {
+		need++
+	}
+	if keep > 0 {
+		shared := fsys.refcount(inode.DoubleIndirect) > 1
+		if shared {
+			need++
+		}
+		inner := fsys.readPointers(inode.DoubleIndirect)[keep/pointersPerBlock]
+		if keep%pointersPerBlock != 0 && inner != 0 && (shared || fsys.refcount(inner) > 1) {
+			need++
+		}
+	}
+	if fsys.freeBlocks() < need {
+		return inode, ErrNoSpace
+	}
+
+	for i := numBlocks; i < 4; i++ {
+		if inode.Datablocks[i] != 0 {
+			fsys.freeBlock(inode.Datablocks[i], 0)
+			inode.Datablocks[i] = 0
+		}
+	}
+	var err error
+	if inode.Indirect != 0 {
+		if numBlocks <= 4 {
+			fsys.freeBlock(inode.Indirect, 1)
+			inode.Indirect = 0
+		} else if numBlocks < 4+pointersPerBlock {
+			if inode.Indirect, err = fsys.ownBlock(inode.Indirect, 1); err != nil {
+				return inode, err
+			}
+			pointers := fsys.readPointers(inode.Indirect)
+			for i := numBlocks - 4; i < pointersPerBlock; i++ {
+				if pointers[i] != 0 {
+					fsys.freeBlock(pointers[i], 0)
+					pointers[i] = 0
+				}
+			}
+			fsys.writePointers(inode.Indirect, pointers)
+		}
+	}
+	if inode.DoubleIndirect != 0 {
+		if keep <= 0 {
+			fsys.freeBlock(inode.DoubleIndirect, 2)
+			inode.DoubleIndirect = 0
+			return inode, nil
+		}
+		if inode.DoubleIndirect, err = fsys.ownBlock(inode.DoubleIndirect, 2); err != nil {
+			return inode, err
+		}
+		outer := fsys.readPointers(inode.DoubleIndirect)
+		for i, indirect := range outer {
+			first := i * pointersPerBlock
+			switch {
+			case indirect == 0:
+			case keep <= first:
+				fsys.freeBlock(indirect, 1)
+				outer[i] = 0
+			case keep < first+pointersPerBlock:
+				if outer[i], err = fsys.ownBlock(indirect, 1); err != nil {
+					return inode, err
+				}
+				inner := fsys.readPointers(outer[i])
+				for j := keep - first; j < pointersPerBlock; j++ {
+					if inner[j] != 0 {
+						fsys.freeBlock(inner[j], 0)
+						inner[j] = 0
+					}
+				}
+				fsys.writePointers(outer[i], inner)
+			}
+		}
+		fsys.writePointers(inode.DoubleIndirect, outer)
+	}
+	return inode, nil
+}
+
+// this function drops the references an inode holds to its datablocks and indirect blocks,
+// the blocks nothing else points at are freed and zeroed
+func (fsys *FileSystem) freeInodeBlocks(inode Inode) Inode {
+	fsys.allocator.Lock()
+	defer fsys.allocator.Unlock()
+	for _, block := range inode.Datablocks {
+		if block != 0 {
+			fsys.freeBlock(block, 0)
+		}
+	}
+	if inode.Indirect != 0 {
+		fsys.freeBlock(inode.Indirect, 1)
+	}
+	if inode.DoubleIndirect != 0 {
+		fsys.freeBlock(inode.DoubleIndirect, 2)
+	}
+	inode.Datablocks = [4]int{0, 0, 0, 0}
+	inode.Indirect = 0
+	inode.DoubleIndirect = 0
+	return inode
+}
+
+// this function calls visit for every block an inode points at, its datablocks, its indirect
+// blocks and its xattr block. levels is how many levels of indirect blocks are below the block,
+// the pointers in an indirect block are only followed when visit returns true for it. A pointer
+// to something that isn't a datablock is skipped, the block holding the first one is returned
+// and 0 if there is none
+func (fsys *FileSystem) visitBlocks(inode Inode, visit func(block int, levels int) bool) int {
+	bad := 0
+	var walk func(holder int, block int, levels int)
+	walk = func(holder int, block int, levels int) {
+		if block == 0 {
+			return
+		}
+		if !fsys.inRange(block) {
+			if bad == 0 {
+				bad = holder
+			}
+			return
+		}
+		if !visit(block, levels) || levels == 0 {
+			return
+		}
+		for _, pointer := range fsys.readPointers(block) {
+			walk(block, pointer, levels-1)
+		}
+	}
+	//the pointers of the inode itself are in its block of the inode table
+	record, _ := fsys.inodeLocation(inode.Inodenumber)
+	for _, block := range inode.Datablocks {
+		walk(record, block, 0)
+	}
+	walk(record, inode.Indirect, 1)
+	walk(record, inode.DoubleIndirect, 2)
+	walk(record, inode.Xattr, 0)
+	return bad
+}
+
+// this function copies the content of an inode starting at off into p and returns how many
+// bytes were copied, it stops at the size of the inode. The content of a compressed inode is
+// decompressed first
+func (fsys *FileSystem) readInodeAt(inode Inode, p []byte, off int64) (int, error) {
+	if err := fsys.verifyInode(inode); err != nil {
+		return 0, err
+	}
+	if inode.IsCompressed {
+		return fsys.readCompressed(inode, p, off)
+	}
+	return fsys.readBlocksAt(inode, p, off), nil
+}
+
+// this function writes p into the content of an inode at off, a gap between the old size and
+// off is filled with zeros. The chunks of a compressed inode it touches are decompressed,
+// changed and compressed again
+func (fsys *FileSystem) writeInodeAt(inode Inode, p []byte, off int64) (Inode, error) {
+	if err := fsys.verifyInode(inode); err != nil {
+		return inode, err
+	}
+	if inode.IsCompressed {
+		return fsys.writeCompressed(inode, p, off)
+	}
+	return fsys.writeBlocksAt(inode, p, off)
+}
+
+// this function copies the datablocks of an inode starting at off into p and returns how many
+// bytes were copied, it stops at the size of the inode
+func (fsys *FileSystem) readBlocksAt(inode Inode, p []byte, off int64) int {
+	if off >= inode.Size {
+		return 0
+	}
+	if remaining := inode.Size - off; int64(len(p)) > remaining {
+		p = p[:remaining]
+	}
+	blocksize := int64(fsys.ReadSuperblock().Blocksize)
+	blocks := fsys.inodeBlocks(inode)
+	n := 0
+	for n < len(p) {
+		position := off + int64(n)
+		index := int(position / blocksize)
+		if index >= len(blocks) {
+			break
+		}
+		n += copy(p[n:], fsys.VirtualDisk[blocks[index]][position%blocksize:])
+	}
+	return n
+}
+
+// this function writes p into the datablocks of an inode at off, allocating blocks when the
+// content grows and copying the ones it shares with a snapshot. A gap between the old size and
+// off is filled with zeros
+func (fsys *FileSystem) writeBlocksAt(inode Inode, p []byte, off int64) (Inode, error) {
+	superblock := fsys.ReadSuperblock()
+	blocksize := int64(superblock.Blocksize)
+	end := off + int64(len(p))
+	//checked before anything is allocated, a huge offset would otherwise fill a huge gap
+	if end < off || end > int64(maxInodeBlocks(superblock))*blocksize {
+		return inode, ErrFileTooLarge
+	}
+	start := off
+	if start > inode.Size {
+		start = inode.Size
+	}
+
+	// Calculate the number of blocks needed for the data
+	inode, err := fsys.prepareBlocks(inode, int(start/blocksize), fsys.blocksFor(end))
+	if err != nil {
+		return inode, err
+	}
+
+	// Write data to the blocks, the gap between the old size and off is zeroed block by block
+	blocks := fsys.inodeBlocks(inode)
+	for position := start; position < off; {
+		block := blocks[position/blocksize]
+		from := position % blocksize
+		to := blocksize
+		if off-position < to-from {
+			to = from + off - position
+		}
+		clearBytes(fsys.VirtualDisk[block][from:to])
+		fsys.markDataDirty(block)
+		position += to - from
+	}
+	n := 0
+	for n < len(p) {
+		position := off + int64(n)
+		block := blocks[position/blocksize]
+		n += copy(fsys.VirtualDisk[block][position%blocksize:], p[n:])
+		fsys.markDataDirty(block)
+	}
+	if end > inode.Size {
+		inode.Size = end
+	}
+	return inode, nil
+}
@@ -0,0 +1,195 @@
+package filesystem
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"sort"
+)
+
+// The checksum table holds a CRC32C of every block, the checksum of block n is the uint32 at
+// byte n*4. The blocks of the checksum table itself and of the journal have no checksum, the
+// journal has its own. A checksum is updated when its block is committed to the disk image and
+// checked when the disk image is mounted, free data blocks aren't checked since their content
+// doesn't matter. A block that doesn't match is remembered as corrupt: reading a file,
+// directory or snapshot that uses it fails with a *CorruptError and Fsck reports it. A corrupt
+// block keeps its old checksum until Fsck repairs it or its content is replaced as a whole, so
+// it is still found corrupt after the next mount even if a change to it was committed. While
+// the inode bitmap or the reference counts are corrupt nothing is allocated or freed. File
+// content is written before the metadata with its checksum is committed, so a crash in between
+// leaves the blocks that were being written corrupt too.
+
+// this is the CRC32C polynomial table the checksums use
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// this is the error for a block whose content doesn't match its checksum, errors.Is(err,
+// ErrCorrupt) is true for it. Inode is the inode the block belongs to, 0 if the block is
+// metadata or the inode isn't known
+type CorruptError struct {
+	Block int
+	Inode int
+}
+
+// this function describes the corrupt block
+func (e *CorruptError) Error() string {
+	if e.Inode == 0 {
+		return fmt.Sprintf("block %d: %v", e.Block, ErrCorrupt)
+	}
+	return fmt.Sprintf("block %d of inode %d: %v", e.Block, e.Inode, ErrCorrupt)
+}
+
+// this function makes errors.Is(err, ErrCorrupt) true for a *CorruptError
+func (e *CorruptError) Is(target error) bool {
+	return target == ErrCorrupt
+}
+
+// this function says if block has a checksum in the checksum table
+func (fsys *FileSystem) checksummed(block int) bool {
+	superblock := fsys.superblock
+	if block >= superblock.Checksumoffset && block < superblock.Inodeoffset {
+		return false
+	}
+	return block < superblock.Journaloffset || block >= superblock.Journaloffset+superblock.Journalblocks
+}
+
+// this function finds where the checksum of block is kept in the checksum table
+func (fsys *FileSystem) checksumLocation(block int) (int, int) {
+	perBlock := fsys.superblock.Blocksize / 4
+	return fsys.superblock.Checksumoffset + block/perBlock, block % perBlock * 4
+}
+
+// this function writes the checksum of the content of block to the checksum table and returns
+// the block of the table it changed
+func (fsys *FileSystem) updateChecksum(block int) int {
+	tableblock, offset := fsys.checksumLocation(block)
+	binary.LittleEndian.PutUint32(fsys.VirtualDisk[tableblock][offset:], crc32.Checksum(fsys.VirtualDisk[block], castagnoli))
+	return tableblock
+}
+
+// this function updates the checksums of the blocks about to be committed, the blocks of the
+// checksum table that change are committed with them. The caller holds the disk lock
+// exclusively
+func (fsys *FileSystem) updateChecksums() {
+	var blocks []int
+	for block := range fsys.dirtydata {
+		blocks = append(blocks, block)
+	}
+	for block := range fsys.dirtyblocks {
+		blocks = append(blocks, block)
+	}
+	for _, block := range blocks {
+		if fsys.checksummed(block) && !fsys.isCorrupt(block) {
+			fsys.dirtyblocks[fsys.updateChecksum(block)] = true
+		}
+	}
+}
+
+// this function updates the checksum of every block, used before the whole disk is saved. The
+// caller holds the disk lock exclusively
+func (fsys *FileSystem) updateAllChecksums() {
+	for block := range fsys.VirtualDisk {
+		if fsys.checksummed(block) && !fsys.isCorrupt(block) {
+			fsys.markDirty(fsys.updateChecksum(block))
+		}
+	}
+}
+
+// this function checks every block that is in use against its checksum and remembers the
+// ones that don't match as corrupt, used when the disk image is mounted. The metadata is
+// checked first, the reference counts only say which datablocks are free if they are intact
+func (fsys *FileSystem) verifyChecksums() {
+	fsys.corrupt = map[int]bool{}
+	superblock := fsys.superblock
+	for block := 0; block < superblock.Datablocksoffset; block++ {
+		fsys.verifyChecksum(block)
+	}
+	counted := fsys.allocatorCorrupt() == nil
+	for block := superblock.Datablocksoffset; block < len(fsys.VirtualDisk); block++ {
+		if counted && fsys.Refcounts[block-superblock.Datablocksoffset] == 0 {
+			continue
+		}
+		fsys.verifyChecksum(block)
+	}
+}
+
+// this function remembers block as corrupt if it has a checksum its content doesn't match
+func (fsys *FileSystem) verifyChecksum(block int) {
+	if !fsys.checksummed(block) {
+		return
+	}
+	tableblock, offset := fsys.checksumLocation(block)
+	if crc32.Checksum(fsys.VirtualDisk[block], castagnoli) != binary.LittleEndian.Uint32(fsys.VirtualDisk[tableblock][offset:]) {
+		fsys.corrupt[block] = true
+	}
+}
+
+// this function says if block was found corrupt
+func (fsys *FileSystem) isCorrupt(block int) bool {
+	fsys.journallock.Lock()
+	defer fsys.journallock.Unlock()
+	return fsys.corrupt[block]
+}
+
+// this function forgets that block was corrupt once its content is replaced as a whole
+func (fsys *FileSystem) forgetCorrupt(block int) {
+	fsys.journallock.Lock()
+	defer fsys.journallock.Unlock()
+	delete(fsys.corrupt, block)
+}
+
+// this function returns the corrupt blocks in order
+func (fsys *FileSystem) corruptBlocks() []int {
+	fsys.journallock.Lock()
+	defer fsys.journallock.Unlock()
+	var blocks []int
+	for block := range fsys.corrupt {
+		blocks = append(blocks, block)
+	}
+	sort.Ints(blocks)
+	return blocks
+}
+
+// this function returns a *CorruptError for the first corrupt block an inode uses, nil if it
+// uses none. The block of the inode table that holds it counts too, and so does a block that
+// points past the datablocks. Blocks under a corrupt indirect block aren't looked at
+func (fsys *FileSystem) verifyInode(inode Inode) error {
+	if err := fsys.verifyRecord(inode.Inodenumber); err != nil {
+		return err
+	}
+	var err error
+	bad := fsys.visitBlocks(inode, func(block int, levels int) bool {
+		if err == nil && fsys.isCorrupt(block) {
+			err = &CorruptError{Block: block, Inode: inode.Inodenumber}
+		}
+		return err == nil
+	})
+	if err == nil && bad != 0 {
+		err = &CorruptError{Block: bad, Inode: inode.Inodenumber}
+	}
+	return err
+}
+
+// this function returns a *CorruptError if the block of the inode table that holds the inode
+// at number is corrupt, nothing in its record can be trusted then. The view of a snapshot reads
+// its inodes from the inode table of the snapshot instead
+func (fsys *FileSystem) verifyRecord(number int) error {
+	if fsys.readonly {
+		return nil
+	}
+	if block, _ := fsys.inodeLocation(number); fsys.isCorrupt(block) {
+		return &CorruptError{Block: block, Inode: number}
+	}
+	return nil
+}
+
+// this function returns a *CorruptError for the first corrupt block of the inode bitmap or the
+// reference counts, allocating or freeing anything could hand out blocks or inodes in use then
+func (fsys *FileSystem) allocatorCorrupt() error {
+	superblock := fsys.superblock
+	for block := superblock.Inodebitmapoffset; block < superblock.Checksumoffset; block++ {
+		if fsys.isCorrupt(block) {
+			return &CorruptError{Block: block}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,218 @@
+package filesystem
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"testing"
+)
+
+// this function flips a bit of block in the disk image at path
+func damageBlock(t *testing.T, path string, block int, blocksize int) {
+	t.Helper()
+	image, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	image[block*blocksize+7] ^= 0x40
+	if err := os.WriteFile(path, image, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestChecksumsSurviveCommits(t *testing.T) {
+	fsys := newDisk(t, Options{})
+	writeFile(t, fsys, "/big", bytes.Repeat([]byte("0123456789"), 3000))
+	fsys, path := remount(t, fsys)
+	if corrupt := fsys.corruptBlocks(); len(corrupt) > 0 {
+		t.Fatal(corrupt)
+	}
+	fsys.Mkdir("/d", RootInode, RootCred)
+	for i := 0; i < 30; i++ {
+		writeFile(t, fsys, fmt.Sprintf("/d/f%d", i), bytes.Repeat([]byte{byte(i)}, 100*i))
+		if i%3 == 0 {
+			fsys.Unlink(fmt.Sprintf("/d/f%d", i), RootInode, RootCred)
+		}
+	}
+	fsys.Snapshot("s")
+	f, _ := fsys.OpenFile("/big", RootInode, RootCred, os.O_RDWR)
+	f.Write([]byte("changed"))
+	fsys.Truncate("/big", RootInode, RootCred, 20000)
+	fsys.SetXattr("/big", RootInode, RootCred, "user.a", []byte("v"))
+	fsys.Unmount()
+	fsys = mountPath(t, path)
+	if corrupt := fsys.corruptBlocks(); len(corrupt) > 0 {
+		t.Fatal("blocks corrupt after commits", corrupt)
+	}
+	checkClean(t, fsys)
+}
+
+func TestCorruptBlocks(t *testing.T) {
+	fsys := newDisk(t, Options{})
+	free := freeCount(fsys)
+	fsys.Mkdir("/d", RootInode, RootCred)
+	writeFile(t, fsys, "/d/small", []byte("small file"))
+	writeFile(t, fsys, "/big", bytes.Repeat([]byte("0123456789"), 3000))
+	writeFile(t, fsys, "/other", []byte("other"))
+	fsys.SetXattr("/other", RootInode, RootCred, "user.a", []byte("v"))
+	_, path := remount(t, fsys)
+	blocksize := fsys.ReadSuperblock().Blocksize
+	smallnum, _ := fsys.ResolvePath("/d/small", RootInode, RootCred)
+	small := fsys.ReadInode(smallnum)
+	bignum, _ := fsys.ResolvePath("/big", RootInode, RootCred)
+	damageBlock(t, path, small.Datablocks[0], blocksize)
+	damageBlock(t, path, fsys.ReadInode(bignum).Indirect, blocksize)
+
+	fsys = mountPath(t, path)
+	_, err := fsys.FS(RootCred).ReadFile("d/small")
+	var corrupt *CorruptError
+	if !errors.Is(err, ErrCorrupt) || !errors.As(err, &corrupt) || corrupt.Inode != smallnum || corrupt.Block != small.Datablocks[0] {
+		t.Fatal(err)
+	}
+	if _, err := fsys.FS(RootCred).ReadFile("big"); !errors.Is(err, ErrCorrupt) {
+		t.Fatal(err)
+	}
+	if err := fsys.Truncate("/big", RootInode, RootCred, 5); !errors.Is(err, ErrCorrupt) {
+		t.Fatal(err)
+	}
+	//files that don't use the corrupt blocks read fine
+	if string(readFile(t, fsys, "/other")) != "other" {
+		t.Fatal("other file changed")
+	}
+	if v, err := fsys.GetXattr("/other", RootInode, RootCred, "user.a"); err != nil || string(v) != "v" {
+		t.Fatal(string(v), err)
+	}
+	findings, _ := fsys.Fsck(false)
+	if len(findings) < 2 || findings[0].Problem != BadChecksum || findings[1].Problem != BadChecksum {
+		t.Fatal(findings)
+	}
+	fsys.Fsck(true)
+	checkClean(t, fsys)
+	//the blocks under the corrupt indirect block are lost, the direct blocks are left
+	if b := readFile(t, fsys, "/big"); len(b) != 4*blocksize {
+		t.Fatal(len(b))
+	}
+	fsys.Unlink("/big", RootInode, RootCred)
+	fsys.Unlink("/d/small", RootInode, RootCred)
+	fsys.Unlink("/other", RootInode, RootCred)
+	fsys.Rmdir("/d", RootInode, RootCred, false)
+	if freeCount(fsys) != free {
+		t.Fatal("blocks leaked", free, freeCount(fsys))
+	}
+
+	//a corrupt directory block
+	fsys.Mkdir("/e", RootInode, RootCred)
+	fsys.Unmount()
+	e, _ := fsys.ResolvePath("/e", RootInode, RootCred)
+	damageBlock(t, path, fsys.ReadInode(e).Datablocks[0], blocksize)
+	fsys = mountPath(t, path)
+	if _, err := fsys.ReadDir("/e", RootInode, RootCred); !errors.Is(err, ErrCorrupt) {
+		t.Fatal(err)
+	}
+	fsys.Fsck(true)
+	checkClean(t, fsys)
+}
+
+// this function changes the disk image at path with change, the checksum of the block seal is
+// written again so the change isn't found corrupt, 0 leaves every checksum as it was
+func editImage(t *testing.T, path string, seal int, change func(image []byte, superblock SuperBlock)) {
+	t.Helper()
+	image, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	superblock, err := decodeSuperblock(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	change(image, superblock)
+	if seal != 0 {
+		bs := superblock.Blocksize
+		sum := crc32.Checksum(image[seal*bs:(seal+1)*bs], castagnoli)
+		binary.LittleEndian.PutUint32(image[superblock.Checksumoffset*bs+seal*4:], sum)
+	}
+	if err := os.WriteFile(path, image, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCorruptMetadata(t *testing.T) {
+	fsys := newDisk(t, Options{})
+	writeFile(t, fsys, "/a", []byte("hello"))
+	fsys, path := remount(t, fsys)
+	a, _ := fsys.ResolvePath("/a", RootInode, RootCred)
+	fsys.Unmount()
+	superblock := fsys.ReadSuperblock()
+	table, _ := fsys.inodeLocation(a)
+	pointer := func(image []byte, superblock SuperBlock) {
+		image[superblock.Inodeoffset*superblock.Blocksize+a*Inodesize+16+2] ^= 0x40
+	}
+
+	//a corrupt block of the inode table makes every inode in it fail instead of its pointers
+	//being followed
+	editImage(t, path, 0, pointer)
+	fsys = mountPath(t, path)
+	var corrupt *CorruptError
+	if _, err := fsys.OpenFile("/a", RootInode, RootCred, os.O_RDWR); !errors.As(err, &corrupt) || corrupt.Block != table {
+		t.Fatal(err)
+	}
+	if err := fsys.Unlink("/a", RootInode, RootCred); !errors.Is(err, ErrCorrupt) {
+		t.Fatal(err)
+	}
+	fsys.Fsck(true)
+	checkClean(t, fsys)
+	fsys.Unmount()
+	if fsys = mountPath(t, path); len(fsys.corruptBlocks()) > 0 {
+		t.Fatal(fsys.corruptBlocks())
+	}
+	checkClean(t, fsys)
+	writeFile(t, fsys, "/a", []byte("hello"))
+	fsys.Unmount()
+
+	//a pointer past the end of the disk with a checksum that matches
+	editImage(t, path, table, pointer)
+	fsys = mountPath(t, path)
+	f, err := fsys.OpenFile("/a", RootInode, RootCred, os.O_RDWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Read(make([]byte, 10)); !errors.As(err, &corrupt) || corrupt.Block != table || corrupt.Inode != a {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("x")); !errors.Is(err, ErrCorrupt) {
+		t.Fatal(err)
+	}
+	if err := fsys.Truncate("/a", RootInode, RootCred, 0); !errors.Is(err, ErrCorrupt) {
+		t.Fatal(err)
+	}
+	fsys.Fsck(true)
+	checkClean(t, fsys)
+	fsys.Unmount()
+
+	//while the reference counts or the inode bitmap are corrupt nothing is allocated or freed
+	for _, block := range []int{superblock.Refcountoffset, superblock.Inodebitmapoffset} {
+		damageBlock(t, path, block, superblock.Blocksize)
+		fsys = mountPath(t, path)
+		free := freeCount(fsys)
+		if err := fsys.Mkdir("/d", RootInode, RootCred); !errors.Is(err, ErrCorrupt) {
+			t.Fatal(block, err)
+		}
+		if err := fsys.Unlink("/a", RootInode, RootCred); err != nil {
+			t.Fatal(block, err)
+		}
+		if freeCount(fsys) != free {
+			t.Fatal(block, "blocks freed")
+		}
+		fsys.Fsck(true)
+		checkClean(t, fsys)
+		writeFile(t, fsys, "/a", []byte("hello"))
+		fsys.Unmount()
+		if fsys = mountPath(t, path); len(fsys.corruptBlocks()) > 0 {
+			t.Fatal(block, fsys.corruptBlocks())
+		}
+		fsys.Unmount()
+	}
+}
@@ -0,0 +1,300 @@
+package filesystem
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/fs"
+)
+
+// this function returns how many bytes of its datablocks the content of an inode takes
+func storedSize(inode Inode) int64 {
+	if inode.IsCompressed {
+		return inode.Storedsize
+	}
+	return inode.Size
+}
+
+// this is the longest a compressed file can get, the same as a file that isn't compressed so
+// the content always fits in memory while it is changed
+func (fsys *FileSystem) maxCompressedSize() int64 {
+	superblock := fsys.ReadSuperblock()
+	return int64(maxInodeBlocks(superblock)) * int64(superblock.Blocksize)
+}
+
+// the content of a compressed file is cut into chunks of chunkBlocks blocks that are
+// compressed on their own, so a change only compresses the chunks it touches again
+const chunkBlocks = 16
+
+// this function returns how many bytes of content a chunk holds, the last chunk of a file
+// holds what is left
+func (fsys *FileSystem) chunkSize() int64 {
+	return chunkBlocks * int64(fsys.ReadSuperblock().Blocksize)
+}
+
+// a chunk is where the compressed stream of one chunk of content is in the datablocks of its
+// inode, its first block starts with the length of the stream
+type chunk struct {
+	//first is the index of its first block in the block list of the inode
+	first  int
+	blocks int
+	//stored is the length of the stream and the 4 bytes before it
+	stored int64
+}
+
+// this function returns the index in the block list after the last chunk
+func chunksEnd(chunks []chunk) int {
+	if len(chunks) == 0 {
+		return 0
+	}
+	last := chunks[len(chunks)-1]
+	return last.first + last.blocks
+}
+
+// this function finds the chunks of a compressed inode in its datablocks, blocks. It returns
+// the chunks before the first one that doesn't fit in the datablocks along with ErrInvalid
+func (fsys *FileSystem) findChunks(inode Inode, blocks []int) ([]chunk, error) {
+	if inode.Size > fsys.maxCompressedSize() {
+		return nil, fmt.Errorf("%w: compressed size %d is past the maximum file size", ErrInvalid, inode.Size)
+	}
+	size := fsys.chunkSize()
+	count := int((inode.Size + size - 1) / size)
+	chunks := make([]chunk, 0, count)
+	for len(chunks) < count {
+		first := chunksEnd(chunks)
+		if first >= len(blocks) {
+			return chunks, fmt.Errorf("%w: chunk %d is past the end of the datablocks", ErrInvalid, len(chunks))
+		}
+		stored := 4 + int64(binary.LittleEndian.Uint32(fsys.VirtualDisk[blocks[first]]))
+		c := chunk{first: first, blocks: fsys.blocksFor(stored), stored: stored}
+		if c.first+c.blocks > len(blocks) {
+			return chunks, fmt.Errorf("%w: chunk %d is past the end of the datablocks", ErrInvalid, len(chunks))
+		}
+		chunks = append(chunks, c)
+	}
+	return chunks, nil
+}
+
+// this function returns how many bytes of content chunk n of an inode of size bytes holds
+func (fsys *FileSystem) chunkLength(size int64, n int) int64 {
+	length := size - int64(n)*fsys.chunkSize()
+	if length > fsys.chunkSize() {
+		return fsys.chunkSize()
+	}
+	return length
+}
+
+// this function decompresses the length bytes of content of chunk c, blocks are the
+// datablocks of its inode. When the stream is broken it returns what decompressed along with
+// ErrInvalid
+func (fsys *FileSystem) inflateChunk(blocks []int, c chunk, length int64) ([]byte, error) {
+	var stream []byte
+	for _, block := range blocks[c.first : c.first+c.blocks] {
+		stream = append(stream, fsys.VirtualDisk[block]...)
+	}
+	content := make([]byte, length)
+	n, err := io.ReadFull(flate.NewReader(bytes.NewReader(stream[4:c.stored])), content)
+	if err != nil {
+		return content[:n], fmt.Errorf("%w: decompressing content: %v", ErrInvalid, err)
+	}
+	return content, nil
+}
+
+// this function compresses content into the blocks of one chunk and returns them along with
+// how many bytes of them the chunk takes
+func (fsys *FileSystem) deflateChunk(content []byte) ([][]byte, int64) {
+	var stream bytes.Buffer
+	stream.Write(make([]byte, 4))
+	w, _ := flate.NewWriter(&stream, flate.DefaultCompression)
+	w.Write(content)
+	w.Close()
+	binary.LittleEndian.PutUint32(stream.Bytes(), uint32(stream.Len()-4))
+	return fsys.splitBlocks(stream.Bytes()), int64(stream.Len())
+}
+
+// this function cuts data into whole blocks, the last one padded with zeros
+func (fsys *FileSystem) splitBlocks(data []byte) [][]byte {
+	blocksize := fsys.ReadSuperblock().Blocksize
+	var blocks [][]byte
+	for start := 0; start < len(data); start += blocksize {
+		block := make([]byte, blocksize)
+		copy(block, data[start:])
+		blocks = append(blocks, block)
+	}
+	return blocks
+}
+
+// this function copies the content of a compressed inode starting at off into p and returns
+// how many bytes were copied, only the chunks it reads are decompressed
+func (fsys *FileSystem) readCompressed(inode Inode, p []byte, off int64) (int, error) {
+	if off >= inode.Size {
+		return 0, nil
+	}
+	if remaining := inode.Size - off; int64(len(p)) > remaining {
+		p = p[:remaining]
+	}
+	blocks := fsys.inodeBlocks(inode)
+	chunks, err := fsys.findChunks(inode, blocks)
+	if err != nil {
+		return 0, err
+	}
+	size := fsys.chunkSize()
+	n := 0
+	for n < len(p) {
+		at := off + int64(n)
+		i := int(at / size)
+		content, err := fsys.inflateChunk(blocks, chunks[i], fsys.chunkLength(inode.Size, i))
+		if err != nil {
+			return n, err
+		}
+		n += copy(p[n:], content[at-int64(i)*size:])
+	}
+	return n, nil
+}
+
+// this function writes p into the content of a compressed inode at off, a gap between the old
+// size and off is filled with zeros. Only the chunks it touches are compressed again
+func (fsys *FileSystem) writeCompressed(inode Inode, p []byte, off int64) (Inode, error) {
+	end := off + int64(len(p))
+	if end < off || end > fsys.maxCompressedSize() {
+		return inode, ErrFileTooLarge
+	}
+	if len(p) == 0 && off <= inode.Size {
+		return inode, nil
+	}
+	blocks := fsys.inodeBlocks(inode)
+	chunks, err := fsys.findChunks(inode, blocks)
+	if err != nil {
+		return inode, err
+	}
+	//the chunks from first up to last get new content, the gap starts in the last old chunk
+	size := fsys.chunkSize()
+	start := off
+	if start > inode.Size {
+		start = inode.Size
+	}
+	first := int(start / size)
+	last := int((end + size - 1) / size)
+	if last > len(chunks) {
+		last = len(chunks)
+	}
+	var content []byte
+	for i := first; i < last; i++ {
+		old, err := fsys.inflateChunk(blocks, chunks[i], fsys.chunkLength(inode.Size, i))
+		if err != nil {
+			return inode, err
+		}
+		content = append(content, old...)
+	}
+	if grow := end - int64(first)*size - int64(len(content)); grow > 0 {
+		content = append(content, make([]byte, grow)...)
+	}
+	copy(content[off-int64(first)*size:], p)
+	if end < inode.Size {
+		end = inode.Size
+	}
+	return fsys.replaceChunks(inode, chunks, first, last, content, end)
+}
+
+// this function replaces the chunks from first up to last of a compressed inode with content,
+// which starts at chunk first, and makes size the size of the inode. The new chunks go to new
+// blocks and the old ones are freed, so a crash before the inode is committed leaves the old
+// content as it was. chunks are the chunks the inode has now
+func (fsys *FileSystem) replaceChunks(inode Inode, chunks []chunk, first int, last int, content []byte, size int64) (Inode, error) {
+	stored := inode.Storedsize
+	for _, c := range chunks[first:last] {
+		stored -= c.stored
+	}
+	var fresh [][]byte
+	chunkSize := int(fsys.chunkSize())
+	for start := 0; start < len(content); start += chunkSize {
+		end := start + chunkSize
+		if end > len(content) {
+			end = len(content)
+		}
+		compressed, n := fsys.deflateChunk(content[start:end])
+		fresh = append(fresh, compressed...)
+		stored += n
+	}
+	from := chunksEnd(chunks)
+	if first < len(chunks) {
+		from = chunks[first].first
+	}
+	to := from
+	if last > first {
+		to = chunksEnd(chunks[:last])
+	}
+	inode, err := fsys.replaceBlocks(inode, from, to, chunksEnd(chunks), fresh)
+	if err != nil {
+		return inode, err
+	}
+	inode.IsCompressed = true
+	inode.Storedsize = stored
+	inode.Size = size
+	return inode, nil
+}
+
+// this function cuts the content of a compressed inode off at size, the caller holds its lock
+func (fsys *FileSystem) truncateCompressed(inode Inode, size int64) (Inode, error) {
+	blocks := fsys.inodeBlocks(inode)
+	chunks, err := fsys.findChunks(inode, blocks)
+	if err != nil {
+		return inode, err
+	}
+	first := int(size / fsys.chunkSize())
+	var content []byte
+	if rest := size % fsys.chunkSize(); rest != 0 {
+		if content, err = fsys.inflateChunk(blocks, chunks[first], fsys.chunkLength(inode.Size, first)); err != nil {
+			return inode, err
+		}
+		content = content[:rest]
+	}
+	return fsys.replaceChunks(inode, chunks, first, len(chunks), content, size)
+}
+
+// this function turns compression of the file at path on or off, its content is rewritten the
+// new way. Relative paths start at the directory at cwd and cred needs permission to write the
+// file. Directories and symbolic links are never compressed
+func (fsys *FileSystem) SetCompression(path string, cwd int, cred Cred, compress bool) (err error) {
+	fsys.beginTransaction()
+	defer fsys.endTransaction(&err)
+	workinginode, err := fsys.resolve(path, cwd, cred)
+	if err != nil {
+		return err
+	}
+	fsys.inodelocks[workinginode].Lock()
+	defer fsys.inodelocks[workinginode].Unlock()
+	inode := fsys.ReadInode(workinginode)
+	if !inode.IsValid {
+		return &fs.PathError{Op: "setcompression", Path: path, Err: ErrNotExist}
+	}
+	if inode.IsDirectory {
+		return &fs.PathError{Op: "setcompression", Path: path, Err: ErrIsDir}
+	}
+	if err := checkPermission(inode, cred, permWrite); err != nil {
+		return &fs.PathError{Op: "setcompression", Path: path, Err: err}
+	}
+	if inode.IsCompressed == compress {
+		return nil
+	}
+	content := make([]byte, inode.Size)
+	if _, err := fsys.readInodeAt(inode, content, 0); err != nil {
+		return &fs.PathError{Op: "setcompression", Path: path, Err: err}
+	}
+	//the content is rewritten into new blocks before the old ones are freed
+	if compress {
+		inode.Storedsize = 0
+		inode, err = fsys.replaceChunks(inode, nil, 0, 0, content, inode.Size)
+	} else if inode, err = fsys.replaceBlocks(inode, 0, 0, 0, fsys.splitBlocks(content)); err == nil {
+		inode.IsCompressed = false
+		inode.Storedsize = 0
+	}
+	if err != nil {
+		return &fs.PathError{Op: "setcompression", Path: path, Err: err}
+	}
+	inode.changed()
+	fsys.WriteInode(inode)
+	return nil
+}
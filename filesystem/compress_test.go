@@ -0,0 +1,175 @@
+package filesystem
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"testing"
+)
+
+// this function returns the stat of the file at path
+func fileStat(t *testing.T, fsys *FileSystem, path string) *FileStat {
+	t.Helper()
+	fi, err := fsys.Stat(path, RootInode, RootCred)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fi.Sys().(*FileStat)
+}
+
+func TestCompression(t *testing.T) {
+	fsys := newDisk(t, Options{Compress: true})
+	free := freeCount(fsys)
+	data := bytes.Repeat([]byte("hello compressed world "), 2000)
+	writeFile(t, fsys, "/a", data)
+	f, _ := fsys.OpenFile("/a", RootInode, RootCred, os.O_RDWR)
+	f.Seek(100, io.SeekStart)
+	f.Write([]byte("XYZ"))
+	copy(data[100:], "XYZ")
+	f.Seek(int64(len(data))+10, io.SeekStart)
+	f.Write([]byte("tail"))
+	data = append(data, make([]byte, 10)...)
+	data = append(data, "tail"...)
+	if st := fileStat(t, fsys, "/a"); st.Size != int64(len(data)) || !st.Compressed || st.StoredSize >= st.Size/4 {
+		t.Fatal(st)
+	}
+	if !bytes.Equal(readFile(t, fsys, "/a"), data) {
+		t.Fatal("content doesn't match")
+	}
+	if err := fsys.Truncate("/a", RootInode, RootCred, 50); err != nil {
+		t.Fatal(err)
+	}
+	if err := fsys.Truncate("/a", RootInode, RootCred, 70); err != nil {
+		t.Fatal(err)
+	}
+	data = append(data[:50], make([]byte, 20)...)
+	if !bytes.Equal(readFile(t, fsys, "/a"), data) {
+		t.Fatal("content doesn't match after truncate")
+	}
+
+	big := bytes.Repeat([]byte{7}, 100000)
+	writeFile(t, fsys, "/b", big)
+	if err := fsys.SetCompression("/b", RootInode, RootCred, false); err != nil {
+		t.Fatal(err)
+	}
+	if st := fileStat(t, fsys, "/b"); st.Compressed || st.StoredSize != 100000 {
+		t.Fatal(st)
+	}
+	if !bytes.Equal(readFile(t, fsys, "/b"), big) {
+		t.Fatal("content doesn't match after decompressing")
+	}
+	fsys.SetCompression("/b", RootInode, RootCred, true)
+	fsys.Symlink("/a", "/l", RootInode, RootCred)
+	if err := fsys.Snapshot("s"); err != nil {
+		t.Fatal(err)
+	}
+	b, _ := fsys.OpenFile("/b", RootInode, RootCred, os.O_RDWR)
+	b.Write([]byte("changed"))
+
+	fsys, _ = remount(t, fsys)
+	if !bytes.Equal(readFile(t, fsys, "/a"), data) {
+		t.Fatal("content doesn't match after mount")
+	}
+	if target, err := fsys.Readlink("/l", RootInode, RootCred); err != nil || target != "/a" {
+		t.Fatal(target, err)
+	}
+	view, _ := fsys.SnapshotFS("s", RootCred)
+	if content, _ := fs.ReadFile(view, "b"); !bytes.Equal(content, big) {
+		t.Fatal("snapshot changed")
+	}
+	checkClean(t, fsys)
+	fsys.DeleteSnapshot("s")
+	fsys.Unlink("/a", RootInode, RootCred)
+	fsys.Unlink("/b", RootInode, RootCred)
+	fsys.Unlink("/l", RootInode, RootCred)
+	if freeCount(fsys) != free {
+		t.Fatal("blocks leaked", free, freeCount(fsys))
+	}
+
+	plain := newDisk(t, Options{})
+	writeFile(t, plain, "/x", []byte("x"))
+	if fileStat(t, plain, "/x").Compressed {
+		t.Fatal("compressed without Compress")
+	}
+}
+
+func TestFsckRepairsCompressedSize(t *testing.T) {
+	fsys := newDisk(t, Options{Compress: true})
+	writeFile(t, fsys, "/c", bytes.Repeat([]byte("abcdefgh"), 5000))
+	n, _ := fsys.ResolvePath("/c", RootInode, RootCred)
+	inode := fsys.ReadInode(n)
+	inode.Size += 1000
+	fsys.WriteInode(inode)
+	if _, err := fsys.FS(RootCred).ReadFile("c"); err == nil {
+		t.Fatal("read past the compressed content")
+	}
+	if findings, err := fsys.Fsck(true); err != nil || len(findings) != 1 || findings[0].Problem != BadSize {
+		t.Fatal(findings, err)
+	}
+	checkClean(t, fsys)
+	if b := readFile(t, fsys, "/c"); len(b) != 40000 {
+		t.Fatal(len(b))
+	}
+}
+
+func TestCompressionRewritesOneChunk(t *testing.T) {
+	fsys := newDisk(t, Options{Compress: true})
+	var data []byte
+	for i := 0; len(data) < 200000; i++ {
+		data = append(data, fmt.Sprintf("line %d of the file\n", i)...)
+	}
+	writeFile(t, fsys, "/f", data)
+	n, _ := fsys.ResolvePath("/f", RootInode, RootCred)
+	inode := fsys.ReadInode(n)
+	before := fsys.inodeBlocks(inode)
+	chunks, err := fsys.findChunks(inode, before)
+	if err != nil || len(chunks) != 13 {
+		t.Fatal(len(chunks), err)
+	}
+
+	//only the chunk the write lands in moves, to blocks the file didn't have
+	f, _ := fsys.OpenFile("/f", RootInode, RootCred, os.O_RDWR)
+	f.Seek(50000, io.SeekStart)
+	f.Write([]byte("changed"))
+	copy(data[50000:], "changed")
+	after := fsys.inodeBlocks(fsys.ReadInode(n))
+	moved := chunks[3]
+	tail := len(before) - moved.first - moved.blocks
+	old := map[int]bool{}
+	for _, block := range before {
+		old[block] = true
+	}
+	for i, block := range after {
+		inChunk := i >= moved.first && i < len(after)-tail
+		if inChunk == old[block] {
+			t.Fatal("block", i, block, inChunk)
+		}
+	}
+	if fmt.Sprint(after[:moved.first], after[len(after)-tail:]) != fmt.Sprint(before[:moved.first], before[len(before)-tail:]) {
+		t.Fatal("other chunks moved")
+	}
+	if !bytes.Equal(readFile(t, fsys, "/f"), data) {
+		t.Fatal("content doesn't match")
+	}
+	checkClean(t, fsys)
+}
+
+func TestRewriteCompressedFile(t *testing.T) {
+	fsys := newDisk(t, Options{Compress: true})
+	writeFile(t, fsys, "/e", bytes.Repeat([]byte("old content "), 20000))
+	n, _ := fsys.ResolvePath("/e", RootInode, RootCred)
+	inode, err := fsys.EncodeDirectoryEntryToDisk(DirectoryEntry{Filename: "e", Inode: n, Fileinfo: "new content"}, fsys.ReadInode(n))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fsys.WriteInode(inode)
+	if st := fileStat(t, fsys, "/e"); st.Size != 11 || st.StoredSize > 100 {
+		t.Fatal(st)
+	}
+	if b := readFile(t, fsys, "/e"); string(b) != "new content" {
+		t.Fatal(string(b))
+	}
+	checkClean(t, fsys)
+}
@@ -0,0 +1,252 @@
+package filesystem
+
+import (
+	"io/fs"
+)
+
+// this is one entry of a directory listing returned by ReadDir
+type DirInfo struct {
+	Name        string
+	Inode       int
+	IsDirectory bool
+	IsSymlink   bool
+}
+
+// this function creates a new directory owned by cred at path, relative paths start at the
+// directory at cwd. The new directory starts with a . entry for itself and a .. entry for its parent
+func (fsys *FileSystem) Mkdir(path string, cwd int, cred Cred) (err error) {
+	fsys.beginTransaction()
+	defer fsys.endTransaction(&err)
+	searchnode, dirname, err := fsys.resolveParent(path, cwd, cred)
+	if err != nil {
+		return err
+	}
+	if len(dirname) > Filenamelength {
+		return &fs.PathError{Op: "mkdir", Path: path, Err: ErrNameTooLong}
+	}
+	if dirname == "." || dirname == ".." {
+		return &fs.PathError{Op: "mkdir", Path: path, Err: ErrInvalid}
+	}
+	fsys.inodelocks[searchnode].Lock()
+	defer fsys.inodelocks[searchnode].Unlock()
+	if _, err := fsys.lookup(dirname, searchnode); err == nil {
+		return &fs.PathError{Op: "mkdir", Path: path, Err: ErrExist}
+	}
+	disknode := fsys.ReadInode(searchnode)
+	if !disknode.IsValid {
+		return &fs.PathError{Op: "mkdir", Path: path, Err: ErrNotExist}
+	}
+	if err := checkPermission(disknode, cred, permWrite|permExec); err != nil {
+		return &fs.PathError{Op: "mkdir", Path: path, Err: err}
+	}
+	workingdirectory, err := fsys.ReadDirectoryFromInode(disknode)
+	if err != nil {
+		return &fs.PathError{Op: "mkdir", Path: path, Err: err}
+	}
+
+	//get the first free inode
+	i, err := fsys.allocateInode()
+	if err != nil {
+		return &fs.PathError{Op: "mkdir", Path: path, Err: err}
+	}
+	fsys.inodelocks[i].Lock()
+	defer fsys.inodelocks[i].Unlock()
+	//set the inode features
+	var newnode Inode
+	newnode.Inodenumber = i
+	newnode.Generation = fsys.ReadInode(i).Generation
+	newnode.created()
+	newnode.IsDirectory = true
+	newnode.IsValid = true
+	newnode.Nlink = 1
+	newnode.Uid = cred.Uid
+	newnode.Gid = cred.Gid
+	newnode.Mode = defaultDirectoryMode
+	//create the new directory and push it onto its own datablocks
+	var newdirectory Directory
+	newdirectory.Inode = i
+	newdirectory.Filenames = []string{".", ".."}
+	newdirectory.Files = []int{i, searchnode}
+	newnode, err = fsys.WriteDirectoryToInode(newdirectory, newnode)
+	fsys.WriteInode(newnode)
+	if err != nil {
+		fsys.releaseInode(i)
+		return &fs.PathError{Op: "mkdir", Path: path, Err: err}
+	}
+	//update the working directory
+	workingdirectory.Filenames = append(workingdirectory.Filenames, dirname)
+	workingdirectory.Files = append(workingdirectory.Files, i)
+	disknode, err = fsys.WriteDirectoryToInode(workingdirectory, disknode)
+	if err != nil {
+		//give back the inode and the block the new directory already took
+		fsys.releaseInode(i)
+		return &fs.PathError{Op: "mkdir", Path: path, Err: err}
+	}
+	disknode.modified()
+	fsys.WriteInode(disknode)
+	return nil
+}
+
+// this function removes the directory at path, relative paths start at the directory at cwd. A
+// directory that still has entries is only removed when recursive is true, along with everything
+// in it, and cred needs permission to change every directory that gets emptied
+func (fsys *FileSystem) Rmdir(path string, cwd int, cred Cred, recursive bool) (err error) {
+	fsys.beginTransaction()
+	defer fsys.endTransaction(&err)
+	searchnode, dirname, err := fsys.resolveParent(path, cwd, cred)
+	if err != nil {
+		return err
+	}
+	if err := fsys.rmdir(dirname, searchnode, cred, recursive); err != nil {
+		return &fs.PathError{Op: "rmdir", Path: path, Err: err}
+	}
+	return nil
+}
+
+// this function removes the directory dirname from the directory at searchnode
+func (fsys *FileSystem) rmdir(dirname string, searchnode int, cred Cred, recursive bool) error {
+	if dirname == "." || dirname == ".." {
+		return ErrInvalid
+	}
+	fsys.inodelocks[searchnode].Lock()
+	defer fsys.inodelocks[searchnode].Unlock()
+	if err := checkPermission(fsys.ReadInode(searchnode), cred, permWrite|permExec); err != nil {
+		return err
+	}
+	workinginode, err := fsys.lookup(dirname, searchnode)
+	if err != nil {
+		return err
+	}
+	fsys.inodelocks[workinginode].Lock()
+	defer fsys.inodelocks[workinginode].Unlock()
+	if !fsys.ReadInode(workinginode).IsDirectory {
+		return ErrNotDir
+	}
+	entries, err := fsys.readDir(workinginode)
+	if err != nil {
+		return err
+	}
+	if len(entries) > 0 && !recursive {
+		return ErrNotEmpty
+	}
+	//remove everything below the directory first
+	if err := fsys.emptyDirectory(workinginode, entries, cred); err != nil {
+		return err
+	}
+	return fsys.removeEntry(dirname, searchnode)
+}
+
+// this function removes the entries of the directory at searchnode and everything below them,
+// the caller holds the lock of the directory
+func (fsys *FileSystem) emptyDirectory(searchnode int, entries []DirInfo, cred Cred) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	if err := checkPermission(fsys.ReadInode(searchnode), cred, permRead|permWrite|permExec); err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		err := func() error {
+			fsys.inodelocks[entry.Inode].Lock()
+			defer fsys.inodelocks[entry.Inode].Unlock()
+			if entry.IsDirectory {
+				below, err := fsys.readDir(entry.Inode)
+				if err != nil {
+					return err
+				}
+				if err := fsys.emptyDirectory(entry.Inode, below, cred); err != nil {
+					return err
+				}
+			}
+			return fsys.removeEntry(entry.Name, searchnode)
+		}()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// this function lists the directory at path, leaving out the . and .. entries. Relative paths
+// start at the directory at cwd and cred needs read permission on the directory
+func (fsys *FileSystem) ReadDir(path string, cwd int, cred Cred) (entries []DirInfo, err error) {
+	fsys.disklock.RLock()
+	defer fsys.disklock.RUnlock()
+	searchnode, err := fsys.resolve(path, cwd, cred)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err == nil {
+			fsys.accessed(searchnode)
+		}
+	}()
+	fsys.inodelocks[searchnode].RLock()
+	defer fsys.inodelocks[searchnode].RUnlock()
+	if err := checkPermission(fsys.ReadInode(searchnode), cred, permRead); err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: path, Err: err}
+	}
+	entries, err = fsys.readDir(searchnode)
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: path, Err: err}
+	}
+	return entries, nil
+}
+
+// this function lists the directory at searchnode, the caller holds the lock of the directory
+func (fsys *FileSystem) readDir(searchnode int) ([]DirInfo, error) {
+	workingdirectory, err := fsys.ReadDirectoryFromInode(fsys.ReadInode(searchnode))
+	if err != nil {
+		return nil, err
+	}
+	var entries []DirInfo
+	for i := range workingdirectory.Filenames {
+		name := workingdirectory.Filenames[i]
+		//skip the empty entries older versions of Unlink left behind
+		if name == "" || name == "." || name == ".." {
+			continue
+		}
+		inode := fsys.readLocked(workingdirectory.Files[i])
+		entries = append(entries, DirInfo{
+			Name:        name,
+			Inode:       workingdirectory.Files[i],
+			IsDirectory: inode.IsDirectory,
+			IsSymlink:   inode.IsSymlink,
+		})
+	}
+	return entries, nil
+}
+
+// this function takes the entry filename out of the directory at searchnode and frees its inode
+// and datablocks once nothing links to them anymore. The caller holds the locks of the directory and of the inode of the entry
+func (fsys *FileSystem) removeEntry(filename string, searchnode int) error {
+	disknode := fsys.ReadInode(searchnode)
+	workingdirectory, err := fsys.ReadDirectoryFromInode(disknode)
+	if err != nil {
+		return err
+	}
+	for i := range workingdirectory.Filenames {
+		if workingdirectory.Filenames[i] == filename {
+			workinginode := workingdirectory.Files[i]
+			//the pointers of a corrupt record can't be trusted to free, Fsck repairs it first
+			if err := fsys.verifyRecord(workinginode); err != nil {
+				return err
+			}
+			workingdirectory.Filenames = append(workingdirectory.Filenames[:i], workingdirectory.Filenames[i+1:]...)
+			workingdirectory.Files = append(workingdirectory.Files[:i], workingdirectory.Files[i+1:]...)
+
+			//the directory is written first, it is the step that can run out of space copying a
+			//block it shares with a snapshot
+			disknode, err = fsys.WriteDirectoryToInode(workingdirectory, disknode)
+			if err != nil {
+				return err
+			}
+			//free the blocks and the inode, a file linked somewhere else keeps them
+			fsys.dropLink(workinginode)
+			disknode.modified()
+			fsys.WriteInode(disknode)
+			return nil
+		}
+	}
+	return ErrNotExist
+}
@@ -0,0 +1,54 @@
+package filesystem
+
+import (
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestDirectories(t *testing.T) {
+	fsys := newDisk(t, Options{})
+	free := freeCount(fsys)
+	if err := fsys.Mkdir("/a", RootInode, RootCred); err != nil {
+		t.Fatal(err)
+	}
+	if err := fsys.Mkdir("/a", RootInode, RootCred); !errors.Is(err, ErrExist) {
+		t.Fatal(err)
+	}
+	if err := fsys.Mkdir("/missing/b", RootInode, RootCred); !errors.Is(err, ErrNotExist) {
+		t.Fatal(err)
+	}
+	a, _ := fsys.ResolvePath("/a", RootInode, RootCred)
+	//relative paths start at cwd
+	if err := fsys.Mkdir("b", a, RootCred); err != nil {
+		t.Fatal(err)
+	}
+	f, _ := fsys.Create("/a/b/f", RootInode, RootCred)
+	f.Write([]byte("x"))
+	if err := fsys.Mkdir("/a/b/f/c", RootInode, RootCred); !errors.Is(err, ErrNotDir) {
+		t.Fatal(err)
+	}
+	entries, err := fsys.ReadDir("/a", RootInode, RootCred)
+	if err != nil || len(entries) != 1 || entries[0].Name != "b" || !entries[0].IsDirectory {
+		t.Fatal(entries, err)
+	}
+	if _, err := fsys.OpenFile("/a", RootInode, RootCred, os.O_RDWR); !errors.Is(err, ErrIsDir) {
+		t.Fatal(err)
+	}
+	if err := fsys.Rmdir("/a", RootInode, RootCred, false); !errors.Is(err, ErrNotEmpty) {
+		t.Fatal(err)
+	}
+	if err := fsys.Rmdir("/a/b/f", RootInode, RootCred, false); !errors.Is(err, ErrNotDir) {
+		t.Fatal(err)
+	}
+	if err := fsys.Rmdir("/", RootInode, RootCred, true); err == nil {
+		t.Fatal("removed the root directory")
+	}
+	if err := fsys.Rmdir("/a", RootInode, RootCred, true); err != nil {
+		t.Fatal(err)
+	}
+	if freeCount(fsys) != free {
+		t.Fatal("blocks leaked", free, freeCount(fsys))
+	}
+	checkClean(t, fsys)
+}
@@ -0,0 +1,188 @@
+package filesystem
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+)
+
+// An encrypted disk image keeps the superblock in block 0 as it is so the geometry and the key
+// derivation can be read before the key is known. Every other block is sealed with AES-256-GCM
+// under a key derived from the passphrase with PBKDF2-HMAC-SHA256, its block number is the
+// additional data so a block moved to another place doesn't open either. The blocks of an
+// encrypted disk image are sealOverhead bytes longer than the blocks of the disk:
+//
+//	0   12 bytes nonce, random for every write
+//	12  the block encrypted, followed by the 16 byte GCM tag
+//
+// block 0 is followed by a nonce and the GCM tag of sealing nothing with the whole block as the
+// additional data, so a changed superblock doesn't mount either once the key is known. The
+// blocks in memory are never encrypted.
+
+// this is how many iterations the key derivation of a new encrypted disk runs
+const kdfIterations = 100000
+
+// this is the most iterations a disk image may ask for, so a changed superblock can't keep
+// Mount busy deriving a key before the superblock tag is checked
+const maxKdfIterations = 10 * kdfIterations
+
+// this is how many bytes longer a block is in an encrypted disk image
+const sealOverhead = 12 + 16
+
+// this function derives the key and the key check of an encrypted disk from passphrase
+func deriveKey(passphrase string, salt []byte, iterations int) (key []byte, check []byte) {
+	derived := pbkdf2([]byte(passphrase), salt, iterations, 64)
+	return derived[:32], derived[32:]
+}
+
+// this function is PBKDF2 from RFC 8018 with HMAC-SHA256, it returns length bytes
+func pbkdf2(password []byte, salt []byte, iterations int, length int) []byte {
+	prf := hmac.New(sha256.New, password)
+	var derived []byte
+	for block := uint32(1); len(derived) < length; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		prf.Write(binary.BigEndian.AppendUint32(nil, block))
+		u := prf.Sum(nil)
+		t := append([]byte(nil), u...)
+		for i := 1; i < iterations; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		derived = append(derived, t...)
+	}
+	return derived[:length]
+}
+
+// this function returns the AES-GCM cipher for key
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// this function makes superblock the superblock of an encrypted disk with a new random salt and
+// returns the cipher for its blocks, nothing is encrypted when passphrase is empty
+func encryptSuperblock(superblock *SuperBlock, passphrase string) (cipher.AEAD, error) {
+	if passphrase == "" {
+		return nil, nil
+	}
+	if _, err := rand.Read(superblock.Salt[:]); err != nil {
+		return nil, err
+	}
+	superblock.Features |= FeatureEncryption
+	superblock.Kdfiterations = kdfIterations
+	key, check := deriveKey(passphrase, superblock.Salt[:], superblock.Kdfiterations)
+	copy(superblock.Keycheck[:], check)
+	return newAEAD(key)
+}
+
+// this function checks passphrase against the key check of superblock and returns the cipher
+// for its blocks, nil if the disk isn't encrypted
+func unlockSuperblock(superblock SuperBlock, passphrase string) (cipher.AEAD, error) {
+	if superblock.Features&FeatureEncryption == 0 {
+		if passphrase != "" {
+			return nil, fmt.Errorf("%w: disk image isn't encrypted", ErrInvalid)
+		}
+		return nil, nil
+	}
+	if passphrase == "" {
+		return nil, fmt.Errorf("%w: disk image is encrypted", ErrPassphrase)
+	}
+	key, check := deriveKey(passphrase, superblock.Salt[:], superblock.Kdfiterations)
+	if !hmac.Equal(check, superblock.Keycheck[:]) {
+		return nil, ErrPassphrase
+	}
+	return newAEAD(key)
+}
+
+// this is how many bytes one block takes in the disk image
+func (fsys *FileSystem) imageBlockSize(superblock SuperBlock) int {
+	if fsys.aead == nil {
+		return superblock.Blocksize
+	}
+	return superblock.Blocksize + sealOverhead
+}
+
+// this function returns block number block the way it is written to the disk image
+func (fsys *FileSystem) sealBlock(block int, data []byte) ([]byte, error) {
+	if fsys.aead == nil {
+		return data, nil
+	}
+	nonce := make([]byte, fsys.aead.NonceSize(), len(data)+sealOverhead)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	//the superblock stays readable, only its tag is added
+	if block == 0 {
+		return append(append([]byte(nil), data...), fsys.aead.Seal(nonce, nonce, nil, data)...), nil
+	}
+	return fsys.aead.Seal(nonce, nonce, data, binary.LittleEndian.AppendUint32(nil, uint32(block))), nil
+}
+
+// this function returns block number block of the disk image decrypted, it fails if the block
+// was changed by anything but this disk
+func (fsys *FileSystem) openBlock(block int, sealed []byte) ([]byte, error) {
+	if fsys.aead == nil {
+		return sealed, nil
+	}
+	if block == 0 {
+		data := sealed[:len(sealed)-sealOverhead]
+		nonce := sealed[len(data) : len(data)+fsys.aead.NonceSize()]
+		if _, err := fsys.aead.Open(nil, nonce, sealed[len(data)+len(nonce):], data); err != nil {
+			return nil, fmt.Errorf("%w: the superblock of the disk image was changed", ErrInvalid)
+		}
+		return data, nil
+	}
+	nonce := sealed[:fsys.aead.NonceSize()]
+	data, err := fsys.aead.Open(nil, nonce, sealed[len(nonce):], binary.LittleEndian.AppendUint32(nil, uint32(block)))
+	if err != nil {
+		return nil, fmt.Errorf("%w: block %d of the disk image doesn't decrypt, it was changed", ErrInvalid, block)
+	}
+	return data, nil
+}
+
+// this function returns the whole disk image for the blocks in disk
+func (fsys *FileSystem) sealImage(disk [][]byte) ([]byte, error) {
+	var image []byte
+	for i := range disk {
+		sealed, err := fsys.sealBlock(i, disk[i])
+		if err != nil {
+			return nil, err
+		}
+		image = append(image, sealed...)
+	}
+	return image, nil
+}
+
+// this function decrypts a whole disk image into its blocks, the journal slots past the end of
+// the disk included. A journal block that doesn't decrypt was only half written when the disk
+// crashed, it reads as zeros and the checksum of the journal drops the transaction it belonged to
+func (fsys *FileSystem) openImage(image []byte, superblock SuperBlock) ([]byte, error) {
+	if fsys.aead == nil {
+		return image, nil
+	}
+	size := fsys.imageBlockSize(superblock)
+	disk := make([]byte, 0, len(image)/size*superblock.Blocksize)
+	for i := 0; i < len(image)/size; i++ {
+		data, err := fsys.openBlock(i, image[i*size:(i+1)*size])
+		if err != nil {
+			if i < superblock.Journaloffset || i >= superblock.Journaloffset+superblock.Journalblocks && i < superblock.Numberofblocks {
+				return nil, err
+			}
+			data = make([]byte, superblock.Blocksize)
+		}
+		disk = append(disk, data...)
+	}
+	return disk, nil
+}
@@ -0,0 +1,112 @@
+package filesystem
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPBKDF2(t *testing.T) {
+	//the PBKDF2-HMAC-SHA256 vector of RFC 7914 section 11
+	got := hex.EncodeToString(pbkdf2([]byte("passwd"), []byte("salt"), 1, 64))
+	want := "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc49ca9cccf179b645991664b39d77ef317c71b845b1e30bd509112041d3a19783"
+	if got != want {
+		t.Fatal(got)
+	}
+}
+
+func TestEncryption(t *testing.T) {
+	fsys := newDisk(t, Options{Passphrase: "secret"})
+	secret := []byte("password=hunter2")
+	writeFile(t, fsys, "/creds", secret)
+	path := filepath.Join(t.TempDir(), "disk.img")
+	if err := fsys.Save(path); err != nil {
+		t.Fatal(err)
+	}
+	image, _ := os.ReadFile(path)
+	if bytes.Contains(image, []byte("hunter2")) || bytes.Contains(image, []byte("creds")) {
+		t.Fatal("plaintext in the disk image")
+	}
+	if _, err := Mount(path); !errors.Is(err, ErrPassphrase) {
+		t.Fatal(err)
+	}
+	if _, err := MountEncrypted(path, "wrong"); !errors.Is(err, ErrPassphrase) {
+		t.Fatal(err)
+	}
+	mounted, err := MountEncrypted(path, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(readFile(t, mounted, "/creds"), secret) {
+		t.Fatal("content doesn't match")
+	}
+	//changes committed through the journal
+	writeFile(t, mounted, "/more", bytes.Repeat([]byte("x"), 10000))
+	mounted.Mkdir("/d", RootInode, RootCred)
+	if err := mounted.Unmount(); err != nil {
+		t.Fatal(err)
+	}
+	if mounted, err = MountEncrypted(path, "secret"); err != nil {
+		t.Fatal(err)
+	}
+	checkClean(t, mounted)
+	if len(readFile(t, mounted, "/more")) != 10000 {
+		t.Fatal("journaled content lost")
+	}
+	mounted.Unmount()
+
+	superblock := mounted.ReadSuperblock()
+	size := superblock.Blocksize + sealOverhead
+	image, _ = os.ReadFile(path)
+	tamper := func(block int) {
+		image[block*size+40] ^= 1
+		os.WriteFile(path, image, 0644)
+	}
+	//a data block that was changed doesn't decrypt
+	tamper(superblock.Datablocksoffset + 1)
+	if _, err := MountEncrypted(path, "secret"); !errors.Is(err, ErrInvalid) {
+		t.Fatal(err)
+	}
+	tamper(superblock.Datablocksoffset + 1)
+	//garbage in the journal is a transaction that was never committed
+	tamper(superblock.Journaloffset)
+	if _, err := MountEncrypted(path, "secret"); err != nil {
+		t.Fatal(err)
+	}
+	//the superblock is readable but a change to it is found, like turning on compression
+	image, _ = os.ReadFile(path)
+	image[44] |= FeatureCompression
+	os.WriteFile(path, image, 0644)
+	if _, err := MountEncrypted(path, "secret"); !errors.Is(err, ErrInvalid) {
+		t.Fatal(err)
+	}
+	image[44] &^= FeatureCompression
+	os.WriteFile(path, image, 0644)
+	if _, err := MountEncrypted(path, "secret"); err != nil {
+		t.Fatal(err)
+	}
+
+	//a superblock asking for more key derivation iterations than any disk gets is refused before
+	//the key is derived
+	superblock, _ = decodeSuperblock(image)
+	superblock.Kdfiterations = maxKdfIterations + 1
+	if err := checkSuperblock(superblock); !errors.Is(err, ErrInvalid) {
+		t.Fatal(err)
+	}
+	binary.LittleEndian.PutUint32(image[48:], math.MaxUint32)
+	os.WriteFile(path, image, 0644)
+	if _, err := MountEncrypted(path, "secret"); !errors.Is(err, ErrInvalid) {
+		t.Fatal(err)
+	}
+
+	plainpath := filepath.Join(t.TempDir(), "plain.img")
+	newDisk(t, Options{}).Save(plainpath)
+	if _, err := MountEncrypted(plainpath, "x"); !errors.Is(err, ErrInvalid) {
+		t.Fatal(err)
+	}
+}
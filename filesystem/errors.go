@@ -0,0 +1,27 @@
+package filesystem
+
+import (
+	"errors"
+	"io/fs"
+)
+
+// these are the errors returned by the filesystem, they work with errors.Is. Errors about a
+// path are wrapped in an *fs.PathError that names the operation and the path
+var (
+	ErrNotExist     = fs.ErrNotExist
+	ErrExist        = fs.ErrExist
+	ErrPermission   = fs.ErrPermission
+	ErrInvalid      = fs.ErrInvalid
+	ErrNotDir       = errors.New("not a directory")
+	ErrIsDir        = errors.New("is a directory")
+	ErrNotEmpty     = errors.New("directory not empty")
+	ErrNoSpace      = errors.New("not enough free blocks available for data")
+	ErrNoInodes     = errors.New("no free inodes available")
+	ErrNameTooLong  = errors.New("filename exceeds maximum")
+	ErrFileTooLarge = errors.New("file exceeds maximum size")
+	ErrLoop         = errors.New("too many levels of symbolic links")
+	ErrNoAttr       = errors.New("no such attribute")
+	ErrAttrTooLarge = errors.New("attributes don't fit in the xattr block")
+	ErrPassphrase   = errors.New("wrong passphrase")
+	ErrCorrupt      = errors.New("block doesn't match its checksum")
+)
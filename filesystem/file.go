@@ -0,0 +1,476 @@
+package filesystem
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"sync"
+)
+
+// this is an open file handle, it keeps the inode of the file and the current offset
+// and implements io.ReadWriteSeeker on top of the datablocks of the inode. readable and
+// writable say what the handle was opened for
+type File struct {
+	fsys  *FileSystem
+	mu    sync.Mutex
+	name  string
+	inode int
+	//generation is the generation of the inode when the file was opened
+	generation uint32
+	offset     int64
+	readable   bool
+	writable   bool
+	closed     bool
+}
+
+var (
+	_ io.ReadWriteSeeker = (*File)(nil)
+	_ fs.File            = (*File)(nil)
+)
+
+// this function opens the existing file at path, flag is os.O_RDONLY, os.O_WRONLY or os.O_RDWR
+// and cred needs the matching permission on the file. Relative paths start at the directory
+// at cwd
+func (fsys *FileSystem) OpenFile(path string, cwd int, cred Cred, flag int) (*File, error) {
+	var want uint32
+	switch flag & (os.O_RDONLY | os.O_WRONLY | os.O_RDWR) {
+	case os.O_RDONLY:
+		want = permRead
+	case os.O_WRONLY:
+		want = permWrite
+	case os.O_RDWR:
+		want = permRead | permWrite
+	default:
+		return nil, &fs.PathError{Op: "open", Path: path, Err: ErrInvalid}
+	}
+	fsys.disklock.RLock()
+	defer fsys.disklock.RUnlock()
+	workinginode, err := fsys.resolve(path, cwd, cred)
+	if err != nil {
+		return nil, err
+	}
+	inode := fsys.readLocked(workinginode)
+	if inode.IsDirectory {
+		return nil, &fs.PathError{Op: "open", Path: path, Err: ErrIsDir}
+	}
+	if err := checkPermission(inode, cred, want); err != nil {
+		return nil, &fs.PathError{Op: "open", Path: path, Err: err}
+	}
+	return &File{fsys: fsys, name: path, inode: workinginode, generation: inode.Generation, readable: want&permRead != 0, writable: want&permWrite != 0}, nil
+}
+
+// this function creates the file at path and opens it for reading and writing, if the file
+// already exists it is truncated to zero length. A new file belongs to cred, an existing one
+// has to be readable and writable by it. Relative paths start at the directory at cwd
+func (fsys *FileSystem) Create(path string, cwd int, cred Cred) (_ *File, err error) {
+	fsys.beginTransaction()
+	defer fsys.endTransaction(&err)
+	searchnode, filename, err := fsys.resolveParent(path, cwd, cred)
+	if err != nil {
+		return nil, err
+	}
+	workinginode, created, err := fsys.findOrCreateFile(filename, searchnode, cred)
+	if err != nil {
+		return nil, &fs.PathError{Op: "create", Path: path, Err: err}
+	}
+	//an existing symbolic link truncates the file it points at
+	if fsys.readLocked(workinginode).IsSymlink {
+		if workinginode, err = fsys.resolve(path, cwd, cred); err != nil {
+			return nil, err
+		}
+	}
+	fsys.inodelocks[workinginode].Lock()
+	defer fsys.inodelocks[workinginode].Unlock()
+	inode := fsys.ReadInode(workinginode)
+	if inode.IsDirectory {
+		return nil, &fs.PathError{Op: "create", Path: path, Err: ErrIsDir}
+	}
+	if !created {
+		if err := checkPermission(inode, cred, permRead|permWrite); err != nil {
+			return nil, &fs.PathError{Op: "create", Path: path, Err: err}
+		}
+	}
+	if err := fsys.truncate(workinginode, 0); err != nil {
+		return nil, &fs.PathError{Op: "create", Path: path, Err: err}
+	}
+	return &File{fsys: fsys, name: path, inode: workinginode, generation: inode.Generation, readable: true, writable: true}, nil
+}
+
+// this function searches the directory at searchnode for filename and returns its inode
+func (fsys *FileSystem) findFile(filename string, searchnode int) (int, error) {
+	if searchnode < 0 || searchnode >= fsys.ReadSuperblock().Numberofinodes {
+		return 0, ErrNotExist
+	}
+	fsys.inodelocks[searchnode].RLock()
+	defer fsys.inodelocks[searchnode].RUnlock()
+	return fsys.lookup(filename, searchnode)
+}
+
+// this function is findFile for callers that already hold the lock of the directory
+func (fsys *FileSystem) lookup(filename string, searchnode int) (int, error) {
+	disknode := fsys.ReadInode(searchnode)
+	if !disknode.IsValid {
+		return 0, ErrNotExist
+	}
+	workingdirectory, err := fsys.ReadDirectoryFromInode(disknode)
+	if err != nil {
+		return 0, err
+	}
+	for i := range workingdirectory.Filenames {
+		if workingdirectory.Filenames[i] == filename {
+			return workingdirectory.Files[i], nil
+		}
+	}
+	return 0, ErrNotExist
+}
+
+// this function returns the inode of filename in the directory at searchnode, creating an
+// empty file for cred there first if there isn't one. created says if the file is new
+func (fsys *FileSystem) findOrCreateFile(filename string, searchnode int, cred Cred) (int, bool, error) {
+	if searchnode < 0 || searchnode >= fsys.ReadSuperblock().Numberofinodes {
+		return 0, false, ErrNotExist
+	}
+	fsys.inodelocks[searchnode].Lock()
+	defer fsys.inodelocks[searchnode].Unlock()
+	workinginode, err := fsys.lookup(filename, searchnode)
+	if errors.Is(err, ErrNotExist) {
+		workinginode, err = fsys.createFile(filename, searchnode, cred)
+		return workinginode, err == nil, err
+	}
+	return workinginode, false, err
+}
+
+// this function creates a new empty file owned by cred in the directory at searchnode and
+// returns its inode, the caller holds the lock of the directory
+func (fsys *FileSystem) createFile(filename string, searchnode int, cred Cred) (int, error) {
+	if len(filename) > Filenamelength {
+		return 0, ErrNameTooLong
+	}
+	if filename == "" || filename == "." || filename == ".." {
+		return 0, ErrInvalid
+	}
+	disknode := fsys.ReadInode(searchnode)
+	if !disknode.IsValid {
+		return 0, ErrNotExist
+	}
+	if err := checkPermission(disknode, cred, permWrite|permExec); err != nil {
+		return 0, err
+	}
+	workingdirectory, err := fsys.ReadDirectoryFromInode(disknode)
+	if err != nil {
+		return 0, err
+	}
+
+	//get the first free inode
+	i, err := fsys.allocateInode()
+	if err != nil {
+		return 0, err
+	}
+	//update the working directory
+	workingdirectory.Filenames = append(workingdirectory.Filenames, filename)
+	workingdirectory.Files = append(workingdirectory.Files, i)
+	disknode, err = fsys.WriteDirectoryToInode(workingdirectory, disknode)
+	if err != nil {
+		fsys.inodelocks[i].Lock()
+		fsys.releaseInode(i)
+		fsys.inodelocks[i].Unlock()
+		return 0, err
+	}
+	disknode.modified()
+	fsys.WriteInode(disknode)
+
+	//set the inode features, a new file has no content and no datablocks yet
+	fsys.inodelocks[i].Lock()
+	var newnode Inode
+	newnode.Inodenumber = i
+	newnode.Generation = fsys.ReadInode(i).Generation
+	newnode.IsValid = true
+	newnode.Nlink = 1
+	newnode.Uid = cred.Uid
+	newnode.Gid = cred.Gid
+	newnode.Mode = defaultFileMode
+	newnode.IsCompressed = fsys.superblock.Features&FeatureCompression != 0
+	newnode.created()
+	fsys.WriteInode(newnode)
+	fsys.inodelocks[i].Unlock()
+	return i, nil
+}
+
+// this function returns the name the file was opened with
+func (f *File) Name() string {
+	return f.name
+}
+
+// this function describes the file, File implements fs.File with it
+func (f *File) Stat() (fs.FileInfo, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return nil, fs.ErrClosed
+	}
+	f.fsys.disklock.RLock()
+	defer f.fsys.disklock.RUnlock()
+	f.fsys.inodelocks[f.inode].RLock()
+	_, err := f.current("stat")
+	f.fsys.inodelocks[f.inode].RUnlock()
+	if err != nil {
+		return nil, err
+	}
+	return f.fsys.fileInfo(path.Base(f.name), f.inode), nil
+}
+
+// this function reads the inode of the file, the caller holds its lock. The file fails with
+// ErrNotExist once it was removed, even if its inode holds another file by now
+func (f *File) current(op string) (Inode, error) {
+	inode := f.fsys.ReadInode(f.inode)
+	if !inode.IsValid || inode.Generation != f.generation {
+		return inode, &fs.PathError{Op: op, Path: f.name, Err: ErrNotExist}
+	}
+	return inode, nil
+}
+
+// this function reads the file content from the current offset into p
+func (f *File) Read(p []byte) (n int, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return 0, fs.ErrClosed
+	}
+	if !f.readable {
+		return 0, &fs.PathError{Op: "read", Path: f.name, Err: ErrPermission}
+	}
+	fsys := f.fsys
+	fsys.disklock.RLock()
+	defer fsys.disklock.RUnlock()
+	//the access time is updated once the inode is unlocked again
+	defer func() {
+		if err == nil {
+			fsys.accessed(f.inode)
+		}
+	}()
+	fsys.inodelocks[f.inode].RLock()
+	defer fsys.inodelocks[f.inode].RUnlock()
+	inode, err := f.current("read")
+	if err != nil {
+		return 0, err
+	}
+	if f.offset >= inode.Size {
+		return 0, io.EOF
+	}
+	n, err = fsys.readInodeAt(inode, p, f.offset)
+	if err != nil {
+		return 0, err
+	}
+	f.offset += int64(n)
+	return n, nil
+}
+
+// this function writes p to the file at the current offset, growing the file if needed
+func (f *File) Write(p []byte) (n int, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return 0, fs.ErrClosed
+	}
+	if !f.writable {
+		return 0, &fs.PathError{Op: "write", Path: f.name, Err: ErrPermission}
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	fsys := f.fsys
+	fsys.beginTransaction()
+	defer fsys.endTransaction(&err)
+	fsys.inodelocks[f.inode].Lock()
+	defer fsys.inodelocks[f.inode].Unlock()
+	inode, err := f.current("write")
+	if err != nil {
+		return 0, err
+	}
+	inode, err = fsys.writeInodeAt(inode, p, f.offset)
+	if err != nil {
+		return 0, err
+	}
+	inode.modified()
+	fsys.WriteInode(inode)
+	f.offset += int64(len(p))
+	return len(p), nil
+}
+
+// this function moves the offset for the next Read or Write, whence works like io.Seeker
+func (f *File) Seek(offset int64, whence int) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return 0, fs.ErrClosed
+	}
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		f.fsys.disklock.RLock()
+		f.fsys.inodelocks[f.inode].RLock()
+		inode, err := f.current("seek")
+		f.fsys.inodelocks[f.inode].RUnlock()
+		f.fsys.disklock.RUnlock()
+		if err != nil {
+			return 0, err
+		}
+		offset += inode.Size
+	default:
+		return 0, ErrInvalid
+	}
+	if offset < 0 {
+		return 0, ErrInvalid
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+// this function changes the size of the file, cutting it off or padding it with zeros
+func (f *File) Truncate(size int64) (err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return fs.ErrClosed
+	}
+	if !f.writable {
+		return &fs.PathError{Op: "truncate", Path: f.name, Err: ErrPermission}
+	}
+	if size < 0 {
+		return ErrInvalid
+	}
+	fsys := f.fsys
+	fsys.beginTransaction()
+	defer fsys.endTransaction(&err)
+	fsys.inodelocks[f.inode].Lock()
+	defer fsys.inodelocks[f.inode].Unlock()
+	if _, err := f.current("truncate"); err != nil {
+		return err
+	}
+	return fsys.truncate(f.inode, size)
+}
+
+// this function changes the size of the inode at number, the caller holds its lock. Shrinking
+// frees the datablocks past the new size, even ones Fallocate reserved
+func (fsys *FileSystem) truncate(number int, size int64) error {
+	inode := fsys.ReadInode(number)
+	if err := fsys.verifyInode(inode); err != nil {
+		return err
+	}
+	var err error
+	switch {
+	case size > inode.Size:
+		//writing nothing at size fills the gap up to it with zeros
+		inode, err = fsys.writeInodeAt(inode, nil, size)
+	case inode.IsCompressed:
+		inode, err = fsys.truncateCompressed(inode, size)
+	default:
+		inode, err = fsys.shrinkInodeBlocks(inode, fsys.blocksFor(size))
+		inode.Size = size
+	}
+	if err != nil {
+		return err
+	}
+	inode.modified()
+	fsys.WriteInode(inode)
+	return nil
+}
+
+// this function reserves the datablocks for the first size bytes of the file without changing
+// its size, so writes up to there can't run out of space
+func (f *File) Fallocate(size int64) (err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return fs.ErrClosed
+	}
+	if !f.writable {
+		return &fs.PathError{Op: "fallocate", Path: f.name, Err: ErrPermission}
+	}
+	if size < 0 {
+		return ErrInvalid
+	}
+	fsys := f.fsys
+	fsys.beginTransaction()
+	defer fsys.endTransaction(&err)
+	fsys.inodelocks[f.inode].Lock()
+	defer fsys.inodelocks[f.inode].Unlock()
+	if _, err := f.current("fallocate"); err != nil {
+		return err
+	}
+	return fsys.fallocate(f.inode, size)
+}
+
+// this function reserves the datablocks for the first size bytes of the inode at number, the
+// caller holds its lock. Nothing is reserved if there isn't room for all of them. A compressed
+// file gives back the blocks its compressed content doesn't need on its next write
+func (fsys *FileSystem) fallocate(number int, size int64) error {
+	inode := fsys.ReadInode(number)
+	if err := fsys.verifyInode(inode); err != nil {
+		return err
+	}
+	inode, err := fsys.growInodeBlocks(inode, fsys.blocksFor(size))
+	if err != nil {
+		return err
+	}
+	inode.changed()
+	fsys.WriteInode(inode)
+	return nil
+}
+
+// this function changes the size of the file at path, cutting it off and freeing the blocks
+// past the new size or padding it with zeros. Relative paths start at the directory at cwd
+func (fsys *FileSystem) Truncate(path string, cwd int, cred Cred, size int64) (err error) {
+	return fsys.resize("truncate", path, cwd, cred, size, fsys.truncate)
+}
+
+// this function reserves the datablocks for the first size bytes of the file at path without
+// changing its size, so a large write up to there can't fail halfway for lack of space.
+// Relative paths start at the directory at cwd
+func (fsys *FileSystem) Fallocate(path string, cwd int, cred Cred, size int64) (err error) {
+	return fsys.resize("fallocate", path, cwd, cred, size, fsys.fallocate)
+}
+
+// this function runs change on the file at path under its lock after checking cred may write it
+func (fsys *FileSystem) resize(op string, path string, cwd int, cred Cred, size int64, change func(int, int64) error) (err error) {
+	if size < 0 {
+		return &fs.PathError{Op: op, Path: path, Err: ErrInvalid}
+	}
+	fsys.beginTransaction()
+	defer fsys.endTransaction(&err)
+	workinginode, err := fsys.resolve(path, cwd, cred)
+	if err != nil {
+		return err
+	}
+	fsys.inodelocks[workinginode].Lock()
+	defer fsys.inodelocks[workinginode].Unlock()
+	inode := fsys.ReadInode(workinginode)
+	if !inode.IsValid {
+		return &fs.PathError{Op: op, Path: path, Err: ErrNotExist}
+	}
+	if inode.IsDirectory {
+		return &fs.PathError{Op: op, Path: path, Err: ErrIsDir}
+	}
+	if err := checkPermission(inode, cred, permWrite); err != nil {
+		return &fs.PathError{Op: op, Path: path, Err: err}
+	}
+	if err := change(workinginode, size); err != nil {
+		return &fs.PathError{Op: op, Path: path, Err: err}
+	}
+	return nil
+}
+
+// this function closes the file, it can't be used for reading or writing after this
+func (f *File) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return fs.ErrClosed
+	}
+	f.closed = true
+	return nil
+}
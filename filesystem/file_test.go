@@ -0,0 +1,212 @@
+package filesystem
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math"
+	"os"
+	"testing"
+)
+
+func TestReadWriteSeek(t *testing.T) {
+	fsys := newDisk(t, Options{})
+	f, err := fsys.Create("/f", RootInode, RootCred)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("hello world"))
+	if pos, err := f.Seek(6, io.SeekStart); err != nil || pos != 6 {
+		t.Fatal(pos, err)
+	}
+	f.Write([]byte("there"))
+	if pos, _ := f.Seek(-5, io.SeekEnd); pos != 6 {
+		t.Fatal(pos)
+	}
+	b := make([]byte, 10)
+	if n, err := f.Read(b); n != 5 || err != nil || string(b[:n]) != "there" {
+		t.Fatal(n, err, string(b[:n]))
+	}
+	if _, err := f.Read(b); err != io.EOF {
+		t.Fatal(err)
+	}
+	if _, err := f.Seek(-1, io.SeekStart); !errors.Is(err, ErrInvalid) {
+		t.Fatal(err)
+	}
+	if _, err := fsys.OpenFile("/", RootInode, RootCred, os.O_RDWR); !errors.Is(err, ErrIsDir) {
+		t.Fatal(err)
+	}
+	ro, _ := fsys.OpenFile("/f", RootInode, RootCred, os.O_RDONLY)
+	if _, err := ro.Write([]byte("x")); err == nil {
+		t.Fatal("wrote through a read-only handle")
+	}
+	if _, err := fsys.OpenFile("/missing", RootInode, RootCred, os.O_RDONLY); !errors.Is(err, ErrNotExist) {
+		t.Fatal(err)
+	}
+	if _, err := fsys.Create("/waytoolongname", RootInode, RootCred); !errors.Is(err, ErrNameTooLong) {
+		t.Fatal(err)
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	fsys := newDisk(t, Options{})
+	free := freeCount(fsys)
+	//320000 bytes reach the double indirect block
+	data := bytes.Repeat([]byte("abcdefgh"), 40000)
+	writeFile(t, fsys, "/f", data)
+	for _, size := range []int64{300000, 270000, 263168, 5000, 4096, 1000, 0} {
+		if err := fsys.Truncate("/f", RootInode, RootCred, size); err != nil {
+			t.Fatal(size, err)
+		}
+		if !bytes.Equal(readFile(t, fsys, "/f"), data[:size]) {
+			t.Fatal(size, "content doesn't match")
+		}
+		fi, _ := fsys.Stat("/f", RootInode, RootCred)
+		if fi.Size() != size || fi.Sys().(*FileStat).Blocks != free-freeCount(fsys) {
+			t.Fatal(size, fi.Sys(), free-freeCount(fsys))
+		}
+		checkClean(t, fsys)
+	}
+
+	//bytes cut off don't come back when the file grows again
+	f, _ := fsys.OpenFile("/f", RootInode, RootCred, os.O_RDWR)
+	f.Write(bytes.Repeat([]byte{1}, 3000))
+	fsys.Truncate("/f", RootInode, RootCred, 10)
+	fsys.Truncate("/f", RootInode, RootCred, 3000)
+	if b := readFile(t, fsys, "/f"); !bytes.Equal(b[10:], make([]byte, 2990)) {
+		t.Fatal("old bytes after growing")
+	}
+
+	//a size past the largest file fails before anything is allocated
+	before := freeCount(fsys)
+	if err := fsys.Truncate("/f", RootInode, RootCred, 1<<50); !errors.Is(err, ErrFileTooLarge) {
+		t.Fatal(err)
+	}
+	f.Seek(1<<50, io.SeekStart)
+	if _, err := f.Write([]byte("x")); !errors.Is(err, ErrFileTooLarge) {
+		t.Fatal(err)
+	}
+	f.Seek(math.MaxInt64, io.SeekStart)
+	if _, err := f.Write([]byte("x")); !errors.Is(err, ErrFileTooLarge) {
+		t.Fatal(err)
+	}
+	if len(readFile(t, fsys, "/f")) != 3000 || freeCount(fsys) != before {
+		t.Fatal("size changed")
+	}
+	//a gap spanning several blocks reads as zeros
+	f.Seek(9000, io.SeekStart)
+	f.Write([]byte("end"))
+	if b := readFile(t, fsys, "/f"); len(b) != 9003 || !bytes.Equal(b[10:9000], make([]byte, 8990)) || string(b[9000:]) != "end" {
+		t.Fatal("gap not zeroed")
+	}
+	if freeCount(fsys) == before {
+		t.Fatal("no blocks for the gap")
+	}
+	checkClean(t, fsys)
+
+	if err := fsys.Truncate("/f", RootInode, RootCred, -1); !errors.Is(err, ErrInvalid) {
+		t.Fatal(err)
+	}
+	if err := fsys.Truncate("/f", RootInode, Cred{Uid: 7, Gid: 7}, 0); !errors.Is(err, ErrPermission) {
+		t.Fatal(err)
+	}
+	fsys.Mkdir("/d", RootInode, RootCred)
+	if err := fsys.Truncate("/d", RootInode, RootCred, 0); !errors.Is(err, ErrIsDir) {
+		t.Fatal(err)
+	}
+	fsys.Unlink("/f", RootInode, RootCred)
+	fsys.Rmdir("/d", RootInode, RootCred, false)
+	if freeCount(fsys) != free {
+		t.Fatal("blocks leaked", free, freeCount(fsys))
+	}
+}
+
+func TestFallocate(t *testing.T) {
+	fsys := newDisk(t, Options{})
+	writeFile(t, fsys, "/f", make([]byte, 3000))
+	if err := fsys.Fallocate("/f", RootInode, RootCred, 200000); err != nil {
+		t.Fatal(err)
+	}
+	fi, _ := fsys.Stat("/f", RootInode, RootCred)
+	if fi.Size() != 3000 || fi.Sys().(*FileStat).Blocks < 196 {
+		t.Fatal(fi.Sys())
+	}
+	checkClean(t, fsys)
+
+	//fill the disk, the reserved blocks are still there to write into
+	g, _ := fsys.Create("/g", RootInode, RootCred)
+	var err error
+	for err == nil {
+		_, err = g.Write(make([]byte, 1024))
+	}
+	if !errors.Is(err, ErrNoSpace) || freeCount(fsys) != 0 {
+		t.Fatal(err, freeCount(fsys))
+	}
+	f, _ := fsys.OpenFile("/f", RootInode, RootCred, os.O_RDWR)
+	if n, err := f.Write(make([]byte, 200000)); n != 200000 || err != nil {
+		t.Fatal(n, err)
+	}
+	if _, err := f.Write(make([]byte, 2048)); !errors.Is(err, ErrNoSpace) {
+		t.Fatal(err)
+	}
+	if err := fsys.Fallocate("/f", RootInode, RootCred, 1<<30); !errors.Is(err, ErrFileTooLarge) {
+		t.Fatal(err)
+	}
+	checkClean(t, fsys)
+}
+
+func TestRemovedFileFails(t *testing.T) {
+	fsys := newDisk(t, Options{})
+	alice := Cred{Uid: 1000, Gid: 100}
+	bob := Cred{Uid: 1001, Gid: 100}
+	fsys.Mkdir("/tmp", RootInode, RootCred)
+	fsys.Chmod("/tmp", RootInode, RootCred, 0777)
+	free := freeCount(fsys)
+	f, err := fsys.Create("/tmp/a", RootInode, alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("alice"))
+	fsys.Unlink("/tmp/a", RootInode, alice)
+	//the open file doesn't write into the freed inode and leaks no blocks
+	if _, err := f.Write(make([]byte, 5000)); !errors.Is(err, ErrNotExist) {
+		t.Fatal(err)
+	}
+	if freeCount(fsys) != free {
+		t.Fatal("blocks leaked", free, freeCount(fsys))
+	}
+
+	//a file that gets the same inode isn't reachable through the old handle
+	secret, _ := fsys.Create("/tmp/secret", RootInode, bob)
+	secret.Write([]byte("bob's secret"))
+	fsys.Chmod("/tmp/secret", RootInode, bob, 0600)
+	if number, _ := fsys.ResolvePath("/tmp/secret", RootInode, bob); number != f.inode {
+		t.Fatal("inode not reused", number, f.inode)
+	}
+	f.Seek(0, io.SeekStart)
+	if _, err := f.Read(make([]byte, 100)); !errors.Is(err, ErrNotExist) {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("overwritten")); !errors.Is(err, ErrNotExist) {
+		t.Fatal(err)
+	}
+	if err := f.Truncate(0); !errors.Is(err, ErrNotExist) {
+		t.Fatal(err)
+	}
+	if _, err := f.Stat(); !errors.Is(err, ErrNotExist) {
+		t.Fatal(err)
+	}
+	if string(readFile(t, fsys, "/tmp/secret")) != "bob's secret" {
+		t.Fatal("secret changed")
+	}
+
+	//the generation survives a remount
+	fsys, _ = remount(t, fsys)
+	g, _ := fsys.OpenFile("/tmp/secret", RootInode, bob, os.O_RDWR)
+	fsys.Unlink("/tmp/secret", RootInode, bob)
+	fsys.Create("/tmp/b", RootInode, alice)
+	if _, err := g.Write([]byte("x")); !errors.Is(err, ErrNotExist) {
+		t.Fatal(err)
+	}
+	checkClean(t, fsys)
+}
@@ -0,0 +1,707 @@
+package filesystem
+
+import (
+	"fmt"
+	"math"
+)
+
+// this is the kind of problem Fsck found
+type FsckProblem int
+
+const (
+	//a valid inode that can't be reached from the root directory
+	OrphanedInode FsckProblem = iota
+	//a bit of the inode bitmap that doesn't match whether the inode is valid
+	InodeBitmapMismatch
+	//a block with a reference count that nothing points at
+	LeakedBlock
+	//a block an inode or a snapshot uses that has no reference count
+	UnmarkedBlock
+	//a block used by more than one inode, or twice by the same one
+	DuplicateBlock
+	//a block pointer outside the data blocks or after the end of the block list
+	BadBlockPointer
+	//an inode size that its datablocks can't hold
+	BadSize
+	//a directory entry that names a missing or free inode
+	DanglingEntry
+	//entries with no name and no inode in a directory, older versions of Unlink left them behind
+	EmptyEntries
+	//a name used twice in one directory
+	DuplicateEntry
+	//a second directory entry for a directory that is already linked somewhere else
+	ExtraLink
+	//a missing or wrong . or .. entry
+	BadDotEntry
+	//an inode record that doesn't make sense on its own
+	BadInode
+	//a link count that doesn't match the directory entries naming the inode
+	BadLinkCount
+	//an xattr block whose records don't decode
+	BadXattr
+	//a reference count that doesn't match the number of pointers to the block
+	BadRefcount
+	//a snapshot whose inode table or blocks can't be read
+	BadSnapshot
+	//a block that didn't match its checksum when the disk image was mounted
+	BadChecksum
+)
+
+// this function returns a short description of the problem
+func (p FsckProblem) String() string {
+	switch p {
+	case OrphanedInode:
+		return "orphaned inode"
+	case InodeBitmapMismatch:
+		return "inode bitmap mismatch"
+	case LeakedBlock:
+		return "leaked block"
+	case UnmarkedBlock:
+		return "unmarked block"
+	case DuplicateBlock:
+		return "duplicate block"
+	case BadBlockPointer:
+		return "bad block pointer"
+	case BadSize:
+		return "bad size"
+	case DanglingEntry:
+		return "dangling entry"
+	case EmptyEntries:
+		return "empty entries"
+	case DuplicateEntry:
+		return "duplicate entry"
+	case ExtraLink:
+		return "extra link"
+	case BadDotEntry:
+		return "bad . or .. entry"
+	case BadInode:
+		return "bad inode"
+	case BadLinkCount:
+		return "bad link count"
+	case BadXattr:
+		return "bad xattr block"
+	case BadRefcount:
+		return "bad reference count"
+	case BadSnapshot:
+		return "bad snapshot"
+	case BadChecksum:
+		return "bad checksum"
+	}
+	return fmt.Sprintf("FsckProblem(%d)", int(p))
+}
+
+// this is one problem found by Fsck. Inode and Block are 0 when the problem isn't about one,
+// Path is the path of the inode or directory entry when it is known
+type FsckFinding struct {
+	Problem  FsckProblem
+	Inode    int
+	Block    int
+	Path     string
+	Detail   string
+	Repaired bool
+}
+
+// this function formats a finding as one line
+func (f FsckFinding) String() string {
+	s := f.Problem.String()
+	if f.Path != "" {
+		s += " " + f.Path
+	}
+	if f.Inode != 0 {
+		s += fmt.Sprintf(" inode %d", f.Inode)
+	}
+	if f.Block != 0 {
+		s += fmt.Sprintf(" block %d", f.Block)
+	}
+	s += ": " + f.Detail
+	if f.Repaired {
+		s += " (repaired)"
+	}
+	return s
+}
+
+// this is the state of one run of Fsck, used maps every block the live inodes use to the inode
+// using it, reached maps every inode found walking from the root directory to its first path
+// and links counts the directory entries naming every file
+type fsckState struct {
+	fsys        *FileSystem
+	superblock  SuperBlock
+	repair      bool
+	inodes      []Inode
+	changed     map[int]bool
+	inodebitmap []bool
+	refcounts   []int
+	used        map[int]int
+	reached     map[int]string
+	links       map[int]int
+	snapshots   []fsckSnapshot
+	findings    []FsckFinding
+}
+
+// this is a snapshot with the inode table it was taken of, inodes is nil if the table can't be read
+type fsckSnapshot struct {
+	snapshot
+	inodes []Inode
+}
+
+// this function checks that the inode bitmap, the reference counts, the inode table, the
+// directories and the snapshots agree with each other, walking the directories from the root
+// directory, and reports the blocks that didn't match their checksum. With repair set it fixes
+// what it finds: corrupt data blocks are zeroed, bad block pointers cut the file off before
+// them, bad entries are taken out of their directory, orphaned inodes are freed, bad snapshots
+// are deleted and the inode bitmap and the reference counts are made to match what is in use
+func (fsys *FileSystem) Fsck(repair bool) (findings []FsckFinding, err error) {
+	//nothing else may run while the disk is checked, it would look like damage
+	fsys.disklock.Lock()
+	defer fsys.disklock.Unlock()
+	superblock := fsys.ReadSuperblock()
+	if superblock.Numberofinodes <= RootInode {
+		return nil, fmt.Errorf("%w: no disk is formatted", ErrInvalid)
+	}
+	if repair {
+		defer func() {
+			if commiterr := fsys.commitTransaction(); commiterr != nil && err == nil {
+				err = commiterr
+			}
+		}()
+	}
+	s := &fsckState{
+		fsys:        fsys,
+		superblock:  superblock,
+		repair:      repair,
+		inodes:      append([]Inode(nil), fsys.Inodes...),
+		changed:     map[int]bool{},
+		inodebitmap: fsys.ReadInodeBitmapFromDisk(),
+		refcounts:   fsys.ReadRefcountsFromDisk(),
+		used:        map[int]int{},
+		reached:     map[int]string{RootInode: "/"},
+		links:       map[int]int{},
+	}
+
+	//repairing zeroes a corrupt data block and keeps the content of a corrupt metadata block,
+	//the checks below find what either one broke
+	for _, block := range fsys.corruptBlocks() {
+		s.report(BadChecksum, 0, block, "", "content doesn't match its checksum")
+		if !repair {
+			continue
+		}
+		if block >= superblock.Datablocksoffset {
+			fsys.clearBlock(block)
+			fsys.markDataDirty(block)
+		} else {
+			fsys.forgetCorrupt(block)
+			fsys.markDirty(block)
+		}
+	}
+
+	//inode 0 is never used and every record has to know its own number
+	if s.inodes[0].IsValid {
+		s.report(BadInode, 0, 0, "", "inode 0 is reserved but marked valid")
+		s.inodes[0].IsValid = false
+		s.changed[0] = true
+	}
+	for i := range s.inodes {
+		if s.inodes[i].IsValid && s.inodes[i].Inodenumber != i {
+			s.report(BadInode, i, 0, "", fmt.Sprintf("record says it is inode %d", s.inodes[i].Inodenumber))
+			s.changed[i] = true
+		}
+		s.inodes[i].Inodenumber = i
+		//the walk below treats it as the directory it is marked as
+		if s.inodes[i].IsValid && s.inodes[i].IsDirectory && s.inodes[i].IsSymlink {
+			s.report(BadInode, i, 0, "", "marked as both a directory and a symbolic link")
+			s.inodes[i].IsSymlink = false
+			s.changed[i] = true
+		}
+		//only the content of a file is ever compressed
+		if s.inodes[i].IsValid && s.inodes[i].IsCompressed && (s.inodes[i].IsDirectory || s.inodes[i].IsSymlink) {
+			s.report(BadInode, i, 0, "", "directory or symbolic link marked as compressed")
+			s.inodes[i].IsCompressed = false
+			s.changed[i] = true
+		}
+	}
+	root := s.inodes[RootInode]
+	if !root.IsValid || !root.IsDirectory {
+		s.findings = append(s.findings, FsckFinding{Problem: BadInode, Inode: RootInode, Path: "/", Detail: "root directory is missing"})
+		return s.findings, nil
+	}
+
+	//the snapshot list is the content of inode 0, its blocks can't be used by anything else
+	listblocks := s.checkBlocks(0, "")
+
+	//walk the directories breadth first, parents[i] is the directory that reached directories[i]
+	directories := []int{RootInode}
+	parents := []int{RootInode}
+	for len(directories) > 0 {
+		children, err := s.checkDirectory(directories[0], parents[0])
+		if err != nil {
+			return s.findings, err
+		}
+		for _, child := range children {
+			directories = append(directories, child)
+			parents = append(parents, directories[0])
+		}
+		directories = directories[1:]
+		parents = parents[1:]
+	}
+
+	//every file has as many links as entries naming it, directories and the root have one
+	for i := RootInode; i < len(s.inodes); i++ {
+		if _, ok := s.reached[i]; !ok || !s.inodes[i].IsValid {
+			continue
+		}
+		want := s.links[i]
+		if s.inodes[i].IsDirectory {
+			want = 1
+		}
+		if s.inodes[i].Nlink != want {
+			s.report(BadLinkCount, i, 0, s.reached[i], fmt.Sprintf("link count is %d, %d entries name it", s.inodes[i].Nlink, want))
+			s.inodes[i].Nlink = want
+			s.changed[i] = true
+		}
+	}
+
+	//valid inodes that weren't reached are orphans, they're freed along with their blocks
+	inodebitmapchanged := false
+	for i := RootInode + 1; i < len(s.inodes); i++ {
+		if !s.inodes[i].IsValid {
+			continue
+		}
+		if _, ok := s.reached[i]; ok {
+			continue
+		}
+		s.report(OrphanedInode, i, 0, "", "not reachable from the root directory")
+		s.checkBlocks(i, "")
+		if !repair {
+			continue
+		}
+		//the blocks nothing else points at are freed with the reference counts below
+		for block, owner := range s.used {
+			if owner == i {
+				delete(s.used, block)
+			}
+		}
+		s.inodes[i] = Inode{Inodenumber: i, Generation: s.inodes[i].Generation + 1}
+		s.changed[i] = true
+		s.inodebitmap[i] = false
+		inodebitmapchanged = true
+	}
+
+	s.checkSnapshots(listblocks)
+
+	//make the inode bitmap and the reference counts match what is in use
+	for i := range s.inodebitmap {
+		want := i == 0 || s.inodes[i].IsValid
+		if s.inodebitmap[i] != want {
+			s.report(InodeBitmapMismatch, i, 0, s.reached[i], fmt.Sprintf("bitmap says %v, inode valid is %v", s.inodebitmap[i], s.inodes[i].IsValid))
+			s.inodebitmap[i] = want
+			inodebitmapchanged = true
+		}
+	}
+	refcountschanged := false
+	counted := s.countReferences()
+	for i := range s.refcounts {
+		block := i + superblock.Datablocksoffset
+		owner := s.used[block]
+		switch {
+		case s.refcounts[i] == counted[i]:
+			continue
+		case counted[i] == 0:
+			s.report(LeakedBlock, 0, block, "", fmt.Sprintf("reference count is %d but nothing points at it", s.refcounts[i]))
+			if repair {
+				fsys.clearBlock(block)
+			}
+		case s.refcounts[i] == 0:
+			s.report(UnmarkedBlock, owner, block, s.reached[owner], "used but marked free")
+		default:
+			s.report(BadRefcount, owner, block, s.reached[owner], fmt.Sprintf("reference count is %d, %d pointers name it", s.refcounts[i], counted[i]))
+		}
+		s.refcounts[i] = counted[i]
+		refcountschanged = true
+	}
+
+	if repair {
+		for i := range s.changed {
+			fsys.WriteInode(s.inodes[i])
+		}
+		if inodebitmapchanged {
+			fsys.AddInodeBitmapToDisk(s.inodebitmap)
+		}
+		if refcountschanged {
+			fsys.AddRefcountsToDisk(s.refcounts)
+		}
+	}
+	return s.findings, nil
+}
+
+// this function records a finding, it counts as repaired when Fsck is repairing
+func (s *fsckState) report(problem FsckProblem, inode int, block int, path string, detail string) {
+	s.findings = append(s.findings, FsckFinding{
+		Problem:  problem,
+		Inode:    inode,
+		Block:    block,
+		Path:     path,
+		Detail:   detail,
+		Repaired: s.repair,
+	})
+}
+
+// this function checks the block pointers of an inode and marks its blocks as used, it returns
+// the datablocks in file order. The block list ends at the first pointer that is 0, outside the
+// data blocks or already in use, repairing sets that pointer and every pointer after it to 0
+func (s *fsckState) checkBlocks(number int, path string) []int {
+	inode := s.inodes[number]
+	modified := false
+	var blocks []int
+	end := false
+	//take checks one pointer and returns false if the list has to be cut off there
+	take := func(block int) bool {
+		problem, detail := BadBlockPointer, ""
+		if end {
+			detail = "pointer after the end of the block list"
+		} else if block < s.superblock.Datablocksoffset || block >= s.superblock.Numberofblocks {
+			detail = "block outside the data blocks"
+		} else if owner, ok := s.used[block]; ok {
+			problem, detail = DuplicateBlock, fmt.Sprintf("block is already used by inode %d", owner)
+		}
+		if detail == "" {
+			s.used[block] = number
+			return true
+		}
+		s.report(problem, number, block, path, detail)
+		end = true
+		return false
+	}
+	//pointers checks the pointers stored in an indirect block, following them down through
+	//levels of indirect blocks, and returns the datablocks they end at
+	var pointers func(block int, levels int) []int
+	pointers = func(block int, levels int) []int {
+		var data []int
+		list := s.fsys.readPointers(block)
+		cut := false
+		for i, pointer := range list {
+			if pointer == 0 {
+				end = true
+			} else if !take(pointer) {
+				list[i] = 0
+				cut = true
+			} else if levels == 1 {
+				data = append(data, pointer)
+			} else {
+				data = append(data, pointers(pointer, levels-1)...)
+			}
+		}
+		if cut && s.repair {
+			s.fsys.writePointers(block, list)
+		}
+		return data
+	}
+
+	for i, block := range inode.Datablocks {
+		if block == 0 {
+			end = true
+		} else if take(block) {
+			blocks = append(blocks, block)
+		} else {
+			inode.Datablocks[i] = 0
+			modified = true
+		}
+	}
+	if inode.Indirect != 0 {
+		if take(inode.Indirect) {
+			blocks = append(blocks, pointers(inode.Indirect, 1)...)
+		} else {
+			inode.Indirect = 0
+			modified = true
+		}
+	}
+	if inode.DoubleIndirect != 0 {
+		if take(inode.DoubleIndirect) {
+			blocks = append(blocks, pointers(inode.DoubleIndirect, 2)...)
+		} else {
+			inode.DoubleIndirect = 0
+			modified = true
+		}
+	}
+
+	//the xattr block isn't part of the block list, repairing drops a broken one so it is leaked
+	if inode.Xattr != 0 {
+		end = false
+		if !take(inode.Xattr) {
+			inode.Xattr = 0
+			modified = true
+		} else if _, err := decodeXattrs(s.fsys.VirtualDisk[inode.Xattr]); err != nil {
+			s.report(BadXattr, number, inode.Xattr, path, err.Error())
+			if s.repair {
+				delete(s.used, inode.Xattr)
+			}
+			inode.Xattr = 0
+			modified = true
+		}
+	}
+
+	limit := int64(len(blocks)) * int64(s.superblock.Blocksize)
+	if !inode.IsCompressed && inode.Size > limit {
+		s.report(BadSize, number, 0, path, fmt.Sprintf("size %d is past the %d bytes of its datablocks", inode.Size, limit))
+		inode.Size = limit
+		modified = true
+	}
+	//repairing keeps as much of compressed content as decompresses
+	if inode.IsCompressed {
+		n, stored := s.inflatedSize(inode, blocks)
+		if n < inode.Size {
+			s.report(BadSize, number, 0, path, fmt.Sprintf("compressed content only decompresses to %d of its %d bytes", n, inode.Size))
+			inode.Size = n
+			modified = true
+		}
+		if stored != inode.Storedsize {
+			s.report(BadSize, number, 0, path, fmt.Sprintf("stored size %d is not the %d bytes its chunks take", inode.Storedsize, stored))
+			inode.Storedsize = stored
+			modified = true
+		}
+	}
+	if inode.IsDirectory && inode.Size%Direntsize != 0 {
+		s.report(BadSize, number, 0, path, fmt.Sprintf("directory size %d is not a whole number of entries", inode.Size))
+		inode.Size -= inode.Size % Direntsize
+		modified = true
+	}
+	if modified && s.repair {
+		s.inodes[number] = inode
+		s.changed[number] = true
+	}
+	return blocks
+}
+
+// this function returns how many bytes of its size the compressed content of an inode
+// decompresses to and how many bytes the chunks holding them take, blocks are its datablocks
+func (s *fsckState) inflatedSize(inode Inode, blocks []int) (int64, int64) {
+	chunks, _ := s.fsys.findChunks(inode, blocks)
+	var n, stored int64
+	for i, c := range chunks {
+		content, err := s.fsys.inflateChunk(blocks, c, s.fsys.chunkLength(inode.Size, i))
+		if len(content) > 0 {
+			stored += c.stored
+		}
+		n += int64(len(content))
+		if err != nil {
+			break
+		}
+	}
+	return n, stored
+}
+
+// this function checks the entries of the directory at number, whose parent is the directory
+// at parent, and returns the directories it reached for the first time
+func (s *fsckState) checkDirectory(number int, parent int) ([]int, error) {
+	path := s.reached[number]
+	blocks := s.checkBlocks(number, path)
+	inode := s.inodes[number]
+
+	var data []byte
+	for _, block := range blocks {
+		data = append(data, s.fsys.VirtualDisk[block]...)
+	}
+	size := inode.Size
+	if int64(len(data)) < size {
+		size = int64(len(data))
+	}
+	//inode numbers are checked here so decoding takes every one of them
+	directory, err := decodeDirectory(data[:size], math.MaxInt)
+	if err != nil {
+		return nil, err
+	}
+
+	var cleaned Directory
+	cleaned.Inode = number
+	changed := false
+	empty := int(size/Direntsize) - len(directory.Files)
+	var dot, dotdot bool
+	var children []int
+	names := map[string]bool{}
+	for i, name := range directory.Filenames {
+		child := directory.Files[i]
+		entrypath := path + name
+		if path != "/" {
+			entrypath = path + "/" + name
+		}
+		var problem FsckProblem
+		detail := ""
+		switch {
+		case name == "" && child == 0:
+			empty++
+			continue
+		case names[name]:
+			problem, detail = DuplicateEntry, fmt.Sprintf("name %q is already used in this directory", name)
+		case name == "." || name == "..":
+			want := number
+			if name == ".." {
+				want = parent
+				dotdot = true
+			} else {
+				dot = true
+			}
+			if child != want {
+				s.report(BadDotEntry, number, 0, path, fmt.Sprintf("%s points at inode %d instead of %d", name, child, want))
+				child = want
+				changed = true
+			}
+		case name == "" || child == 0 || child >= len(s.inodes) || !s.inodes[child].IsValid:
+			problem, detail = DanglingEntry, fmt.Sprintf("entry %q names inode %d which isn't in use", name, child)
+		default:
+			if linked, ok := s.reached[child]; ok {
+				//files can have any number of links, directories only one
+				if s.inodes[child].IsDirectory {
+					problem, detail = ExtraLink, fmt.Sprintf("inode %d is already linked at %s", child, linked)
+				} else {
+					s.links[child]++
+				}
+				break
+			}
+			s.reached[child] = entrypath
+			s.links[child] = 1
+			if s.inodes[child].IsDirectory {
+				children = append(children, child)
+			} else {
+				s.checkBlocks(child, entrypath)
+			}
+		}
+		if detail != "" {
+			s.report(problem, child, 0, entrypath, detail)
+			changed = true
+			continue
+		}
+		names[name] = true
+		cleaned.Filenames = append(cleaned.Filenames, name)
+		cleaned.Files = append(cleaned.Files, child)
+	}
+	if empty > 0 {
+		s.report(EmptyEntries, number, 0, path, fmt.Sprintf("%d empty entries", empty))
+		changed = true
+	}
+	if !dotdot {
+		s.report(BadDotEntry, number, 0, path, ".. entry is missing")
+		cleaned.Filenames = append([]string{".."}, cleaned.Filenames...)
+		cleaned.Files = append([]int{parent}, cleaned.Files...)
+		changed = true
+	}
+	if !dot {
+		s.report(BadDotEntry, number, 0, path, ". entry is missing")
+		cleaned.Filenames = append([]string{"."}, cleaned.Filenames...)
+		cleaned.Files = append([]int{number}, cleaned.Files...)
+		changed = true
+	}
+
+	if changed && s.repair {
+		//the directory only grows if . or .. were missing, which needs a block that may not be there
+		if err := s.fsys.AddWorkingDirectoryToDisk(cleaned, blocks); err != nil {
+			return nil, fmt.Errorf("repairing directory %s: %w", path, err)
+		}
+		s.inodes[number].Size = int64(len(cleaned.Files) * Direntsize)
+		s.changed[number] = true
+	}
+	return children, nil
+}
+
+// this function checks the snapshot list in the datablocks listblocks of inode 0 and the inode
+// tables of the snapshots, repairing deletes a snapshot that points outside the data blocks.
+// The blocks only it pointed at are freed with the reference counts
+func (s *fsckState) checkSnapshots(listblocks []int) {
+	var data []byte
+	for _, block := range listblocks {
+		data = append(data, s.fsys.VirtualDisk[block]...)
+	}
+	if int64(len(data)) > s.inodes[0].Size {
+		data = data[:s.inodes[0].Size]
+	}
+	if extra := len(data) % snapshotRecordSize; extra != 0 {
+		s.report(BadSnapshot, 0, 0, "", fmt.Sprintf("snapshot list ends with %d bytes that aren't a whole record", extra))
+		data = data[:len(data)-extra]
+		if s.repair {
+			s.inodes[0].Size = int64(len(data))
+			s.changed[0] = true
+		}
+	}
+	snapshots, _ := decodeSnapshots(data)
+
+	//bad says if inode points outside the data blocks, "" if it doesn't
+	bad := func(inode Inode) string {
+		if s.fsys.visitBlocks(inode, func(int, int) bool { return true }) != 0 {
+			return "points outside the data blocks"
+		}
+		return ""
+	}
+	var kept []snapshot
+	for _, snap := range snapshots {
+		checked := fsckSnapshot{snapshot: snap}
+		detail := bad(snap.table)
+		if detail == "" {
+			inodes, err := s.fsys.snapshotInodes(snap)
+			if err != nil {
+				detail = err.Error()
+			}
+			for i := RootInode; i < len(inodes) && detail == ""; i++ {
+				if inodes[i].IsValid {
+					if detail = bad(inodes[i]); detail != "" {
+						detail = fmt.Sprintf("inode %d %s", i, detail)
+					}
+				}
+			}
+			checked.inodes = inodes
+		}
+		if detail != "" {
+			s.report(BadSnapshot, 0, 0, "", fmt.Sprintf("snapshot %q: %s", snap.name, detail))
+			if s.repair {
+				continue
+			}
+		}
+		s.snapshots = append(s.snapshots, checked)
+		kept = append(kept, snap)
+	}
+	if !s.repair || len(kept) == len(snapshots) {
+		return
+	}
+	//the list only shrinks, it is written over its own blocks
+	data = encodeSnapshots(kept)
+	blocksize := s.superblock.Blocksize
+	for i, block := range listblocks {
+		s.fsys.clearBlock(block)
+		if i*blocksize < len(data) {
+			copy(s.fsys.VirtualDisk[block], data[i*blocksize:])
+		}
+		s.fsys.markDirty(block)
+	}
+	s.inodes[0].Size = int64(len(data))
+	s.changed[0] = true
+}
+
+// this function counts the pointers to every datablock from the inodes, inode 0 with the
+// snapshot list and the snapshots. The pointers in an indirect block count once however many
+// inodes share it
+func (s *fsckState) countReferences() []int {
+	counted := make([]int, len(s.refcounts))
+	followed := map[int]bool{}
+	visit := func(block int, levels int) bool {
+		if block < s.superblock.Datablocksoffset || block >= s.superblock.Numberofblocks {
+			return false
+		}
+		counted[block-s.superblock.Datablocksoffset]++
+		if followed[block] {
+			return false
+		}
+		followed[block] = true
+		return true
+	}
+	for i, inode := range s.inodes {
+		if i == 0 || inode.IsValid {
+			s.fsys.visitBlocks(inode, visit)
+		}
+	}
+	for _, snap := range s.snapshots {
+		s.fsys.visitBlocks(snap.table, visit)
+		for i := RootInode; i < len(snap.inodes); i++ {
+			if snap.inodes[i].IsValid {
+				s.fsys.visitBlocks(snap.inodes[i], visit)
+			}
+		}
+	}
+	return counted
+}
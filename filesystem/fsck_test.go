@@ -0,0 +1,85 @@
+package filesystem
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestFsckCleanAfterUnlink(t *testing.T) {
+	fsys := newDisk(t, Options{})
+	for _, name := range []string{"/a", "/b", "/c"} {
+		if _, err := fsys.Create(name, RootInode, RootCred); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := fsys.Unlink("/b", RootInode, RootCred); err != nil {
+		t.Fatal(err)
+	}
+	checkClean(t, fsys)
+	entries, err := fsys.ReadDir("/", RootInode, RootCred)
+	if err != nil || len(entries) != 2 || entries[0].Name != "a" || entries[1].Name != "c" {
+		t.Fatal(entries, err)
+	}
+}
+
+func TestFsckRepairs(t *testing.T) {
+	fsys := newDisk(t, Options{})
+	fsys.Mkdir("/a", RootInode, RootCred)
+	fsys.Mkdir("/a/b", RootInode, RootCred)
+	for i := 0; i < 5; i++ {
+		writeFile(t, fsys, fmt.Sprintf("/a/f%d", i), make([]byte, 6000))
+	}
+	writeFile(t, fsys, "/y", nil)
+	checkClean(t, fsys)
+	superblock := fsys.ReadSuperblock()
+	f0, _ := fsys.ResolvePath("/a/f0", RootInode, RootCred)
+	y, _ := fsys.ResolvePath("/y", RootInode, RootCred)
+
+	//an inode nothing links to that shares a block with /a/f0
+	orphan := fsys.ReadInode(50)
+	orphan.IsValid = true
+	orphan.Inodenumber = 50
+	orphan.Datablocks[0] = fsys.ReadInode(f0).Datablocks[0]
+	fsys.WriteInode(orphan)
+	refcounts := fsys.ReadRefcountsFromDisk()
+	refcounts[500] = 1
+	refcounts[1] = 0
+	fsys.AddRefcountsToDisk(refcounts)
+	bitmap := fsys.ReadInodeBitmapFromDisk()
+	bitmap[60] = true
+	fsys.AddInodeBitmapToDisk(bitmap)
+	root, _ := fsys.ReadDirectoryFromInode(fsys.ReadInode(RootInode))
+	root.Filenames = append(root.Filenames, "ghost", "y")
+	root.Files = append(root.Files, 77, y)
+	inode, _ := fsys.WriteDirectoryToInode(root, fsys.ReadInode(RootInode))
+	fsys.WriteInode(inode)
+	inode = fsys.ReadInode(f0)
+	inode.Size = 1 << 20
+	inode.Datablocks[3] = superblock.Datablocksoffset - 1
+	fsys.WriteInode(inode)
+
+	findings, err := fsys.Fsck(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := map[FsckProblem]bool{}
+	for _, finding := range findings {
+		if finding.Repaired {
+			t.Fatal("repaired without repair:", finding)
+		}
+		found[finding.Problem] = true
+	}
+	for _, problem := range []FsckProblem{DanglingEntry, DuplicateEntry, BadBlockPointer, BadSize, OrphanedInode, DuplicateBlock, InodeBitmapMismatch, UnmarkedBlock, LeakedBlock} {
+		if !found[problem] {
+			t.Error("not found:", problem)
+		}
+	}
+	if findings, err = fsys.Fsck(true); err != nil || len(findings) == 0 {
+		t.Fatal(findings, err)
+	}
+	checkClean(t, fsys)
+	entries, _ := fsys.ReadDir("/", RootInode, RootCred)
+	if len(entries) != 2 || entries[0].Name != "a" || entries[1].Name != "y" {
+		t.Fatal(entries)
+	}
+}
@@ -0,0 +1,160 @@
+package filesystem
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// this function saves the whole VirtualDisk (superblock, bitmaps, inode table, journal and data
+// blocks) to a disk image on the host at path, encrypted if the disk is. Saving to the mounted
+// disk image only commits the blocks that changed since the last commit
+func (fsys *FileSystem) Save(path string) error {
+	fsys.disklock.Lock()
+	defer fsys.disklock.Unlock()
+	if fsys.backingfile != nil {
+		mounted, err := fsys.backingfile.Stat()
+		if err != nil {
+			return err
+		}
+		if target, err := os.Stat(path); err == nil && os.SameFile(mounted, target) {
+			return fsys.commitTransaction()
+		}
+	}
+	fsys.updateAllChecksums()
+	image, err := fsys.sealImage(fsys.VirtualDisk)
+	if err != nil {
+		return err
+	}
+	//write to a temporary file first so a failed save doesn't destroy the old image
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, image, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// this function mounts a disk image that was written by Save, loading it into VirtualDisk and
+// restoring the inode bitmap, the reference counts and the inode table from it. A transaction
+// left in the journal by a crash is replayed first. The disk image stays open and every transaction after this is committed
+// to it until Unmount. An encrypted disk image needs MountEncrypted
+func Mount(path string) (*FileSystem, error) {
+	return MountEncrypted(path, "")
+}
+
+// this function is Mount for a disk image encrypted with passphrase, it fails with
+// ErrPassphrase if passphrase is wrong and with ErrInvalid if a block of the disk image was
+// tampered with
+func MountEncrypted(path string, passphrase string) (*FileSystem, error) {
+	file, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	fsys := &FileSystem{}
+	image, err := io.ReadAll(file)
+	if err == nil {
+		err = fsys.mountImage(file, image, passphrase)
+	}
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return fsys, nil
+}
+
+// this function checks image, decrypts it with passphrase, replays its journal and makes it
+// the disk with file as its disk image
+func (fsys *FileSystem) mountImage(file *os.File, image []byte, passphrase string) error {
+	superblock, err := decodeSuperblock(image)
+	if err != nil {
+		return err
+	}
+	if err := checkSuperblock(superblock); err != nil {
+		return err
+	}
+	if fsys.aead, err = unlockSuperblock(superblock, passphrase); err != nil {
+		return err
+	}
+	//anything past the end of the disk is journal slots of a transaction that was too big for
+	//the journal, the journal header says how far they go
+	size := fsys.imageBlockSize(superblock)
+	expected := superblock.Numberofblocks * size
+	length := len(image)
+	if length < expected || length%size != 0 {
+		return fmt.Errorf("image is %d bytes, expected a %d byte disk image", length, expected)
+	}
+	if image, err = fsys.openImage(image, superblock); err != nil {
+		return err
+	}
+	if length > imageBlocks(image, superblock)*size {
+		return fmt.Errorf("image is %d bytes, expected a %d byte disk image", length, expected)
+	}
+	replayed, err := fsys.replayJournal(image, superblock)
+	if err != nil {
+		return err
+	}
+	if replayed {
+		disk := make([][]byte, superblock.Numberofblocks)
+		for i := range disk {
+			disk[i] = image[i*superblock.Blocksize : (i+1)*superblock.Blocksize]
+		}
+		sealed, err := fsys.sealImage(disk)
+		if err != nil {
+			return err
+		}
+		//the header is written last, so the slots past the end are cut off while it still
+		//accounts for them
+		header := superblock.Journaloffset * size
+		if _, err := file.WriteAt(sealed[:header], 0); err != nil {
+			return err
+		}
+		if _, err := file.WriteAt(sealed[header+size:], int64(header+size)); err != nil {
+			return err
+		}
+		if err := file.Sync(); err != nil {
+			return err
+		}
+		if length > expected {
+			if err := file.Truncate(int64(expected)); err != nil {
+				return err
+			}
+			if err := file.Sync(); err != nil {
+				return err
+			}
+		}
+		if _, err := file.WriteAt(sealed[header:header+size], int64(header)); err != nil {
+			return err
+		}
+		if err := file.Sync(); err != nil {
+			return err
+		}
+	}
+	//copy the image into the disk block by block
+	fsys.VirtualDisk = make([][]byte, superblock.Numberofblocks)
+	for i := range fsys.VirtualDisk {
+		fsys.VirtualDisk[i] = image[i*superblock.Blocksize : (i+1)*superblock.Blocksize]
+	}
+	fsys.backingfile = file
+	fsys.resetTransaction()
+
+	//rebuild the in memory inode bitmap, reference counts and inode table from the disk
+	fsys.loadTables()
+	fsys.verifyChecksums()
+	return nil
+}
+
+// this function commits what is left to the mounted disk image and closes it, the disk stays
+// in memory. It does nothing if no disk image is mounted
+func (fsys *FileSystem) Unmount() error {
+	fsys.disklock.Lock()
+	defer fsys.disklock.Unlock()
+	if fsys.backingfile == nil {
+		return nil
+	}
+	err := fsys.commitTransaction()
+	if closeerr := fsys.backingfile.Close(); err == nil {
+		err = closeerr
+	}
+	fsys.backingfile = nil
+	return err
+}
@@ -0,0 +1,217 @@
+package filesystem
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"time"
+)
+
+// this is the disk seen as an io/fs file system, so it works with fs.WalkDir, fs.Glob,
+// http.FS and template.ParseFS. Names are slash separated and start at the root directory,
+// "." is the root directory itself. Everything is read as the caller cred. Make one with
+// FileSystem.FS
+type FS struct {
+	fsys *FileSystem
+	cred Cred
+}
+
+var (
+	_ fs.FS         = (*FS)(nil)
+	_ fs.ReadDirFS  = (*FS)(nil)
+	_ fs.StatFS     = (*FS)(nil)
+	_ fs.ReadFileFS = (*FS)(nil)
+)
+
+// this function returns the disk as an io/fs file system used by cred
+func (fsys *FileSystem) FS(cred Cred) *FS {
+	return &FS{fsys: fsys, cred: cred}
+}
+
+// this function opens the file or directory name, files are *File and directories implement
+// fs.ReadDirFile
+func (fsys *FS) Open(name string) (fs.File, error) {
+	number, inode, err := fsys.lookup("open", name)
+	if err != nil {
+		return nil, err
+	}
+	if !inode.IsDirectory {
+		if err := checkPermission(inode, fsys.cred, permRead); err != nil {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+		}
+		return &File{fsys: fsys.fsys, name: name, inode: number, generation: inode.Generation, readable: true}, nil
+	}
+	entries, err := fsys.ReadDir(name)
+	if err != nil {
+		return nil, err
+	}
+	return &dirFile{info: fsys.fsys.fileInfo(path.Base(name), number), entries: entries}, nil
+}
+
+// this function returns the entries of the directory name sorted by name, without . and ..
+func (fsys *FS) ReadDir(name string) (entries []fs.DirEntry, err error) {
+	number, _, err := fsys.lookup("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	disk := fsys.fsys
+	disk.disklock.RLock()
+	defer disk.disklock.RUnlock()
+	defer func() {
+		if err == nil {
+			disk.accessed(number)
+		}
+	}()
+	disk.inodelocks[number].RLock()
+	defer disk.inodelocks[number].RUnlock()
+	inode := disk.ReadInode(number)
+	if !inode.IsDirectory {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: ErrNotDir}
+	}
+	if err := checkPermission(inode, fsys.cred, permRead); err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+	infos, err := disk.readDir(number)
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+	entries = make([]fs.DirEntry, len(infos))
+	for i, info := range infos {
+		entries[i] = fs.FileInfoToDirEntry(disk.fileInfo(info.Name, info.Inode))
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name() < entries[j].Name()
+	})
+	return entries, nil
+}
+
+// this function describes the file or directory name
+func (fsys *FS) Stat(name string) (fs.FileInfo, error) {
+	number, _, err := fsys.lookup("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	fsys.fsys.disklock.RLock()
+	defer fsys.fsys.disklock.RUnlock()
+	return fsys.fsys.fileInfo(path.Base(name), number), nil
+}
+
+// this function returns the whole content of the file name
+func (fsys *FS) ReadFile(name string) (data []byte, err error) {
+	number, _, err := fsys.lookup("readfile", name)
+	if err != nil {
+		return nil, err
+	}
+	disk := fsys.fsys
+	disk.disklock.RLock()
+	defer disk.disklock.RUnlock()
+	defer func() {
+		if err == nil {
+			disk.accessed(number)
+		}
+	}()
+	disk.inodelocks[number].RLock()
+	defer disk.inodelocks[number].RUnlock()
+	inode := disk.ReadInode(number)
+	if !inode.IsValid {
+		return nil, &fs.PathError{Op: "readfile", Path: name, Err: ErrNotExist}
+	}
+	if inode.IsDirectory {
+		return nil, &fs.PathError{Op: "readfile", Path: name, Err: ErrIsDir}
+	}
+	if err := checkPermission(inode, fsys.cred, permRead); err != nil {
+		return nil, &fs.PathError{Op: "readfile", Path: name, Err: err}
+	}
+	data = make([]byte, inode.Size)
+	n, err := disk.readInodeAt(inode, data, 0)
+	if err != nil {
+		return nil, &fs.PathError{Op: "readfile", Path: name, Err: err}
+	}
+	return data[:n], nil
+}
+
+// this function resolves name from the root directory and reads its inode, errors name op and
+// name the way io/fs expects instead of the path that was resolved
+func (fsys *FS) lookup(op string, name string) (int, Inode, error) {
+	if !fs.ValidPath(name) {
+		return 0, Inode{}, &fs.PathError{Op: op, Path: name, Err: ErrInvalid}
+	}
+	disk := fsys.fsys
+	disk.disklock.RLock()
+	defer disk.disklock.RUnlock()
+	number, err := disk.resolve("/"+name, RootInode, fsys.cred)
+	if err != nil {
+		var patherr *fs.PathError
+		if errors.As(err, &patherr) {
+			err = patherr.Err
+		}
+		return 0, Inode{}, &fs.PathError{Op: op, Path: name, Err: err}
+	}
+	return number, disk.readLocked(number), nil
+}
+
+// this is the fs.FileInfo of an inode, Sys returns a *FileStat with everything else about it
+type fileInfo struct {
+	name string
+	stat FileStat
+}
+
+func (fi fileInfo) Name() string       { return fi.name }
+func (fi fileInfo) Size() int64        { return fi.stat.Size }
+func (fi fileInfo) Mode() fs.FileMode  { return fi.stat.Mode }
+func (fi fileInfo) ModTime() time.Time { return fi.stat.Modified }
+func (fi fileInfo) IsDir() bool        { return fi.stat.Mode.IsDir() }
+
+func (fi fileInfo) Sys() any {
+	stat := fi.stat
+	return &stat
+}
+
+// this is a directory opened through FS, its entries are read when it is opened
+type dirFile struct {
+	info    fileInfo
+	entries []fs.DirEntry
+	closed  bool
+}
+
+var _ fs.ReadDirFile = (*dirFile)(nil)
+
+func (d *dirFile) Stat() (fs.FileInfo, error) {
+	if d.closed {
+		return nil, fs.ErrClosed
+	}
+	return d.info, nil
+}
+
+func (d *dirFile) Read(p []byte) (int, error) {
+	if d.closed {
+		return 0, fs.ErrClosed
+	}
+	return 0, &fs.PathError{Op: "read", Path: d.info.name, Err: ErrIsDir}
+}
+
+// this function returns the next n entries, or all that are left if n <= 0
+func (d *dirFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	if d.closed {
+		return nil, fs.ErrClosed
+	}
+	if n <= 0 || n > len(d.entries) {
+		if n > 0 && len(d.entries) == 0 {
+			return nil, io.EOF
+		}
+		n = len(d.entries)
+	}
+	entries := d.entries[:n]
+	d.entries = d.entries[n:]
+	return entries, nil
+}
+
+func (d *dirFile) Close() error {
+	if d.closed {
+		return fs.ErrClosed
+	}
+	d.closed = true
+	return nil
+}
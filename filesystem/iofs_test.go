@@ -0,0 +1,47 @@
+package filesystem
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"reflect"
+	"testing"
+	"testing/fstest"
+)
+
+func TestIOFS(t *testing.T) {
+	fsys := newDisk(t, Options{})
+	fsys.Mkdir("/a", RootInode, RootCred)
+	fsys.Mkdir("/a/b", RootInode, RootCred)
+	writeFile(t, fsys, "/a/b/x.txt", []byte("hello"))
+	writeFile(t, fsys, "/top.txt", make([]byte, 9000))
+	if err := fstest.TestFS(fsys.FS(RootCred), "a/b/x.txt", "top.txt", "a", "a/b"); err != nil {
+		t.Fatal(err)
+	}
+	if matches, err := fs.Glob(fsys.FS(RootCred), "a/*/*.txt"); err != nil || !reflect.DeepEqual(matches, []string{"a/b/x.txt"}) {
+		t.Fatal(matches, err)
+	}
+	if _, err := fs.Stat(fsys.FS(RootCred), "a/missing"); !errors.Is(err, ErrNotExist) {
+		t.Fatal(err)
+	}
+	if _, err := fs.ReadFile(fsys.FS(RootCred), "top.txt/x"); !errors.Is(err, ErrNotDir) {
+		t.Fatal(err)
+	}
+	if _, err := fsys.FS(RootCred).Open("/top.txt"); !errors.Is(err, ErrInvalid) {
+		t.Fatal(err)
+	}
+	sub, _ := fs.Sub(fsys.FS(RootCred), "a")
+	if b, err := fs.ReadFile(sub, "b/x.txt"); err != nil || string(b) != "hello" {
+		t.Fatal(string(b), err)
+	}
+	//a new file in the inode of a removed one reads as the new file
+	fsys.Unlink("/top.txt", RootInode, RootCred)
+	writeFile(t, fsys, "/new.txt", []byte("new"))
+	f, err := fsys.FS(RootCred).Open("new.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, err := io.ReadAll(f); err != nil || string(b) != "new" {
+		t.Fatal(string(b), err)
+	}
+}
@@ -0,0 +1,338 @@
+package filesystem
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"sort"
+)
+
+// The journal is Journalblocks blocks starting at Journaloffset. Its first block is the header,
+// the blocks after it are the first slots of the transaction. A transaction that needs more
+// slots than that continues past the end of the disk in the disk image, slot n is block
+// Numberofblocks+n-(Journalblocks-1) then, and the disk image is cut back to the disk once the
+// transaction is written home. So a transaction of any size is committed as a whole. Before
+// such a transaction writes its slots the header holds the magic "VSFP" and the number of
+// blocks, a transaction left like that was never committed and only its slots are cut off.
+//
+//	0   uint32   magic, the bytes "VSFJ", anything else means the journal is empty
+//	4   uint32   sequence number of the transaction
+//	8   uint32   number of blocks in the transaction
+//	12  uint32   crc32 of bytes 16 to the end of the header and every slot of the transaction
+//	16  uint32   home block of every journaled block, in journal order
+//
+// the home blocks that don't fit in the header continue in the first slots, block size/4 of them
+// in each, and the copies of the journaled blocks follow in the slots after them.
+//
+// A transaction is written in four steps, each one synced before the next begins: changed file
+// content goes straight to its home blocks, the changed metadata blocks are copied into the
+// journal, the header is written, and the metadata blocks are copied to their home blocks. The
+// header is the commit point, a crash before it leaves the old metadata and a crash after it is
+// finished by replaying the journal on the next Mount.
+const journalHeaderSize = 16
+
+// these are the first bytes of a journal header that holds a committed transaction
+var journalMagic = [4]byte{'V', 'S', 'F', 'J'}
+
+// these are the first bytes of a journal header whose transaction is writing slots past the end
+// of the disk
+var journalPendingMagic = [4]byte{'V', 'S', 'F', 'P'}
+
+// this function records that a metadata block changed, it is committed through the journal
+func (fsys *FileSystem) markDirty(block int) {
+	if fsys.backingfile == nil {
+		return
+	}
+	fsys.journallock.Lock()
+	fsys.dirtyblocks[block] = true
+	fsys.journallock.Unlock()
+}
+
+// this function records that a block of file content changed, it is written in place before
+// the metadata that points at it is committed
+func (fsys *FileSystem) markDataDirty(block int) {
+	if fsys.backingfile == nil {
+		return
+	}
+	fsys.journallock.Lock()
+	fsys.dirtydata[block] = true
+	fsys.journallock.Unlock()
+}
+
+// this function starts a transaction, it holds the disk lock shared so transactions run side
+// by side. A transaction must not start another one
+func (fsys *FileSystem) beginTransaction() {
+	fsys.disklock.RLock()
+}
+
+// this function ends a transaction and commits every block changed since the last commit. The
+// commit waits for the transactions still running so it never sees half of one, and commits
+// their blocks along with these. A commit error is stored in err unless err already holds one
+func (fsys *FileSystem) endTransaction(err *error) {
+	mounted := fsys.backingfile != nil
+	fsys.disklock.RUnlock()
+	if !mounted {
+		return
+	}
+	fsys.disklock.Lock()
+	defer fsys.disklock.Unlock()
+	if commiterr := fsys.commitTransaction(); commiterr != nil && *err == nil {
+		*err = commiterr
+	}
+}
+
+// this function commits the blocks changed by an operation that holds the disk lock
+// exclusively. A commit error is stored in err unless err already holds one
+func (fsys *FileSystem) commitExclusive(err *error) {
+	if commiterr := fsys.commitTransaction(); commiterr != nil && *err == nil {
+		*err = commiterr
+	}
+}
+
+// this function commits every block changed since the last commit to the disk image
+func (fsys *FileSystem) Sync() error {
+	fsys.disklock.Lock()
+	defer fsys.disklock.Unlock()
+	return fsys.commitTransaction()
+}
+
+// this function forgets the changed blocks, used when the whole disk is replaced
+func (fsys *FileSystem) resetTransaction() {
+	fsys.dirtyblocks = map[int]bool{}
+	fsys.dirtydata = map[int]bool{}
+}
+
+// this function returns the block of the disk image that holds slot n of the journal
+func journalSlot(superblock SuperBlock, n int) int {
+	if n < superblock.Journalblocks-1 {
+		return superblock.Journaloffset + 1 + n
+	}
+	return superblock.Numberofblocks + n - (superblock.Journalblocks - 1)
+}
+
+// this function returns how many slots the list of home blocks of a transaction of count
+// blocks takes, the part of it that doesn't fit in the header
+func journalListSlots(superblock SuperBlock, count int) int {
+	rest := count - (superblock.Blocksize-journalHeaderSize)/4
+	if rest <= 0 {
+		return 0
+	}
+	perSlot := superblock.Blocksize / 4
+	return (rest + perSlot - 1) / perSlot
+}
+
+// this function returns the block of the disk image after the last slot of a transaction of
+// count blocks
+func journalEnd(superblock SuperBlock, count int) int {
+	return journalSlot(superblock, journalListSlots(superblock, count)+count-1) + 1
+}
+
+// this function returns how many blocks the disk image of a disk may have. It has more blocks
+// than the disk only while the transaction in its journal header has slots past the end
+func imageBlocks(image []byte, superblock SuperBlock) int {
+	header := image[superblock.Journaloffset*superblock.Blocksize:][:superblock.Blocksize]
+	if !bytes.Equal(header[0:4], journalMagic[:]) && !bytes.Equal(header[0:4], journalPendingMagic[:]) {
+		return superblock.Numberofblocks
+	}
+	count := int(binary.LittleEndian.Uint32(header[8:]))
+	if count < 1 || count > superblock.Numberofblocks {
+		return superblock.Numberofblocks
+	}
+	if end := journalEnd(superblock, count); end > superblock.Numberofblocks {
+		return end
+	}
+	return superblock.Numberofblocks
+}
+
+// this function writes the changed blocks to the disk image, a disk without a disk image
+// just forgets them. The blocks stay marked as changed if writing them fails
+func (fsys *FileSystem) commitTransaction() error {
+	if fsys.backingfile == nil {
+		fsys.resetTransaction()
+		return nil
+	}
+	superblock := fsys.ReadSuperblock()
+	//the checksums of the changed blocks are committed along with them
+	fsys.updateChecksums()
+
+	//file content goes to its home blocks first so committed metadata never points at old content
+	var data []int
+	for block := range fsys.dirtydata {
+		if !fsys.dirtyblocks[block] {
+			data = append(data, block)
+		}
+	}
+	sort.Ints(data)
+	for _, block := range data {
+		if err := fsys.writeHomeBlock(block, fsys.VirtualDisk[block]); err != nil {
+			return err
+		}
+	}
+	if len(data) > 0 {
+		if err := fsys.backingfile.Sync(); err != nil {
+			return err
+		}
+	}
+
+	var metadata []int
+	for block := range fsys.dirtyblocks {
+		metadata = append(metadata, block)
+	}
+	sort.Ints(metadata)
+	if len(metadata) > 0 {
+		if err := fsys.writeJournal(superblock, metadata); err != nil {
+			return err
+		}
+		if err := fsys.checkpoint(superblock, metadata); err != nil {
+			return err
+		}
+	}
+	fsys.dirtyblocks = map[int]bool{}
+	fsys.dirtydata = map[int]bool{}
+	return nil
+}
+
+// this function commits the given metadata blocks to the journal, once it returns they are
+// written home by the next Mount even if checkpoint never runs
+func (fsys *FileSystem) writeJournal(superblock SuperBlock, blocks []int) error {
+	//the list of home blocks fills the header first and then the list slots
+	listslots := journalListSlots(superblock, len(blocks))
+	list := make([]byte, superblock.Blocksize-journalHeaderSize+listslots*superblock.Blocksize)
+	for i, block := range blocks {
+		binary.LittleEndian.PutUint32(list[i*4:], uint32(block))
+	}
+	header := make([]byte, superblock.Blocksize)
+	//a Mount that finds slots past the end of the disk before the header is written learns
+	//from the pending header how far they go
+	if journalEnd(superblock, len(blocks)) > superblock.Numberofblocks {
+		copy(header[0:4], journalPendingMagic[:])
+		binary.LittleEndian.PutUint32(header[8:], uint32(len(blocks)))
+		if err := fsys.writeHomeBlock(superblock.Journaloffset, header); err != nil {
+			return err
+		}
+		if err := fsys.backingfile.Sync(); err != nil {
+			return err
+		}
+		clearBytes(header)
+	}
+	copy(header[journalHeaderSize:], list)
+	checksum := crc32.NewIEEE()
+	checksum.Write(header[journalHeaderSize:])
+	for n := 0; n < listslots; n++ {
+		slot := list[len(header)-journalHeaderSize+n*superblock.Blocksize:][:superblock.Blocksize]
+		checksum.Write(slot)
+		if err := fsys.writeHomeBlock(journalSlot(superblock, n), slot); err != nil {
+			return err
+		}
+	}
+	for i, block := range blocks {
+		checksum.Write(fsys.VirtualDisk[block])
+		if err := fsys.writeHomeBlock(journalSlot(superblock, listslots+i), fsys.VirtualDisk[block]); err != nil {
+			return err
+		}
+	}
+	if err := fsys.backingfile.Sync(); err != nil {
+		return err
+	}
+
+	//writing the header commits the transaction
+	fsys.journalsequence++
+	copy(header[0:4], journalMagic[:])
+	binary.LittleEndian.PutUint32(header[4:], fsys.journalsequence)
+	binary.LittleEndian.PutUint32(header[8:], uint32(len(blocks)))
+	binary.LittleEndian.PutUint32(header[12:], checksum.Sum32())
+	if err := fsys.writeHomeBlock(superblock.Journaloffset, header); err != nil {
+		return err
+	}
+	return fsys.backingfile.Sync()
+}
+
+// this function writes the blocks of the transaction in the journal to their home blocks,
+// empties the journal and cuts off the slots past the end of the disk
+func (fsys *FileSystem) checkpoint(superblock SuperBlock, blocks []int) error {
+	for _, block := range blocks {
+		if err := fsys.writeHomeBlock(block, fsys.VirtualDisk[block]); err != nil {
+			return err
+		}
+	}
+	if err := fsys.backingfile.Sync(); err != nil {
+		return err
+	}
+	//the slots go before the header that accounts for them, a disk image longer than the disk
+	//with an empty journal is never mounted
+	if journalEnd(superblock, len(blocks)) > superblock.Numberofblocks {
+		if err := fsys.backingfile.Truncate(int64(superblock.Numberofblocks) * int64(fsys.imageBlockSize(superblock))); err != nil {
+			return err
+		}
+		if err := fsys.backingfile.Sync(); err != nil {
+			return err
+		}
+	}
+	return fsys.writeHomeBlock(superblock.Journaloffset, make([]byte, superblock.Blocksize))
+}
+
+// this function writes the content of one block to its place in the disk image, encrypted if
+// the disk is
+func (fsys *FileSystem) writeHomeBlock(block int, data []byte) error {
+	sealed, err := fsys.sealBlock(block, data)
+	if err != nil {
+		return err
+	}
+	_, err = fsys.backingfile.WriteAt(sealed, int64(block)*int64(len(sealed)))
+	return err
+}
+
+// this function replays a transaction that was committed to the journal of image but not
+// written home yet, a transaction with a bad checksum or with slots past the end of image was
+// never committed and is dropped. image holds the slots past the end of the disk as well. It
+// returns true if the image was changed
+func (fsys *FileSystem) replayJournal(image []byte, superblock SuperBlock) (bool, error) {
+	blocksize := superblock.Blocksize
+	block := func(n int) []byte {
+		return image[n*blocksize : (n+1)*blocksize]
+	}
+	header := block(superblock.Journaloffset)
+	if bytes.Equal(header[0:4], journalPendingMagic[:]) {
+		clearBytes(header)
+		return true, nil
+	}
+	if !bytes.Equal(header[0:4], journalMagic[:]) {
+		return false, nil
+	}
+	count := int(binary.LittleEndian.Uint32(header[8:]))
+	listslots := journalListSlots(superblock, count)
+	if count > superblock.Numberofblocks || journalSlot(superblock, listslots+count-1) >= len(image)/blocksize {
+		clearBytes(header)
+		return true, nil
+	}
+	var list []byte
+	list = append(list, header[journalHeaderSize:]...)
+	for n := 0; n < listslots; n++ {
+		list = append(list, block(journalSlot(superblock, n))...)
+	}
+	checksum := crc32.NewIEEE()
+	checksum.Write(list)
+	for i := 0; i < count; i++ {
+		checksum.Write(block(journalSlot(superblock, listslots+i)))
+	}
+	if checksum.Sum32() == binary.LittleEndian.Uint32(header[12:]) {
+		for i := 0; i < count; i++ {
+			home := int(binary.LittleEndian.Uint32(list[i*4:]))
+			if home >= superblock.Numberofblocks {
+				return false, fmt.Errorf("%w: journal names block %d past the end of the disk", ErrInvalid, home)
+			}
+			copy(block(home), block(journalSlot(superblock, listslots+i)))
+		}
+	}
+	fsys.journalsequence = binary.LittleEndian.Uint32(header[4:])
+	clearBytes(header)
+	return true, nil
+}
+
+// this function fills a byte slice with zeros
+func clearBytes(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
@@ -0,0 +1,200 @@
+package filesystem
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestJournalCommits(t *testing.T) {
+	fsys, path := remount(t, newDisk(t, Options{}))
+	fsys.Mkdir("/d", RootInode, RootCred)
+	writeFile(t, fsys, "/d/x", []byte("hello world"))
+	if err := fsys.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	//every operation is committed to the disk image when it returns
+	again := mountPath(t, path)
+	if string(readFile(t, again, "/d/x")) != "hello world" {
+		t.Fatal("content not committed")
+	}
+	again.Unmount()
+	fsys.Unlink("/d/x", RootInode, RootCred)
+	fsys.Unmount()
+	again = mountPath(t, path)
+	if _, err := again.ResolvePath("/d/x", RootInode, RootCred); !errors.Is(err, ErrNotExist) {
+		t.Fatal(err)
+	}
+	checkClean(t, again)
+}
+
+func TestJournalDropsTornTransaction(t *testing.T) {
+	fsys, path := remount(t, newDisk(t, Options{}))
+	fsys.Mkdir("/d", RootInode, RootCred)
+	fsys.Unmount()
+	superblock := fsys.ReadSuperblock()
+
+	//a header whose checksum doesn't match was never committed
+	image, _ := os.ReadFile(path)
+	header := image[superblock.Journaloffset*superblock.Blocksize:]
+	copy(header, journalMagic[:])
+	header[8] = 1
+	header[12] ^= 0xff
+	header[16] = 1
+	os.WriteFile(path, image, 0644)
+	fsys = mountPath(t, path)
+	if _, err := fsys.ResolvePath("/d", RootInode, RootCred); err != nil {
+		t.Fatal(err)
+	}
+	checkClean(t, fsys)
+	fsys.Unmount()
+	image, _ = os.ReadFile(path)
+	if string(image[superblock.Journaloffset*superblock.Blocksize:][:4]) == string(journalMagic[:]) {
+		t.Fatal("journal not emptied")
+	}
+}
+
+func TestJournalCommitsBigTransaction(t *testing.T) {
+	//a journal of 2 blocks holds one block of a transaction, the rest goes past the end of the disk
+	fsys, path := remount(t, newDisk(t, Options{JournalBlocks: 2}))
+	superblock := fsys.ReadSuperblock()
+	before, _ := os.ReadFile(path)
+	fsys.Mkdir("/d", RootInode, RootCred)
+	for i := 0; i < 20; i++ {
+		writeFile(t, fsys, fmt.Sprintf("/d/f%d", i), bytes.Repeat([]byte{byte(i)}, 1000*i))
+	}
+	writeFile(t, fsys, "/big", bytes.Repeat([]byte("big"), 100000))
+	image, _ := os.ReadFile(path)
+	if len(image) != len(before) {
+		t.Fatal("journal slots left past the end of the disk", len(image), len(before))
+	}
+
+	//put the old disk image back and commit everything that changed as one transaction, a crash
+	//right after the header is written is finished by the next mount
+	if err := os.WriteFile(path, before, 0644); err != nil {
+		t.Fatal(err)
+	}
+	var changed []int
+	for block := range fsys.VirtualDisk {
+		journal := block >= superblock.Journaloffset && block < superblock.Datablocksoffset
+		if !journal && !bytes.Equal(fsys.VirtualDisk[block], before[block*superblock.Blocksize:][:superblock.Blocksize]) {
+			changed = append(changed, block)
+		}
+	}
+	if journalListSlots(superblock, len(changed)) == 0 {
+		t.Fatal("transaction too small to need list slots", len(changed))
+	}
+	if err := fsys.writeJournal(superblock, changed); err != nil {
+		t.Fatal(err)
+	}
+	fsys.backingfile.Close()
+	fsys = mountPath(t, path)
+	for i := 0; i < 20; i++ {
+		if !bytes.Equal(readFile(t, fsys, fmt.Sprintf("/d/f%d", i)), bytes.Repeat([]byte{byte(i)}, 1000*i)) {
+			t.Fatal("content of", i, "not replayed")
+		}
+	}
+	if len(readFile(t, fsys, "/big")) != 300000 {
+		t.Fatal("big file not replayed")
+	}
+	checkClean(t, fsys)
+	if corrupt := fsys.corruptBlocks(); len(corrupt) > 0 {
+		t.Fatal(corrupt)
+	}
+	image, _ = os.ReadFile(path)
+	if len(image) != len(before) {
+		t.Fatal("journal slots left past the end of the disk after replay", len(image), len(before))
+	}
+
+	//a transaction whose slots were cut off was never committed
+	fsys.Unmount()
+	image, _ = os.ReadFile(path)
+	header := image[superblock.Journaloffset*superblock.Blocksize:]
+	copy(header, journalMagic[:])
+	binary.LittleEndian.PutUint32(header[8:], 5)
+	os.WriteFile(path, image, 0644)
+	fsys = mountPath(t, path)
+	checkClean(t, fsys)
+}
+
+func TestJournalCommitsBigEncryptedTransaction(t *testing.T) {
+	fsys := newDisk(t, Options{JournalBlocks: 2, Passphrase: "secret"})
+	path := filepath.Join(t.TempDir(), "disk.img")
+	if err := fsys.Save(path); err != nil {
+		t.Fatal(err)
+	}
+	before, _ := os.ReadFile(path)
+	fsys, err := MountEncrypted(path, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	//the slots past the end of the disk are sealed like every other block
+	big := bytes.Repeat([]byte("big"), 100000)
+	writeFile(t, fsys, "/big", big)
+	if image, _ := os.ReadFile(path); len(image) != len(before) {
+		t.Fatal("journal slots left past the end of the disk", len(image), len(before))
+	}
+
+	//a crash right after the header is written is finished by the next mount
+	os.WriteFile(path, before, 0644)
+	superblock := fsys.ReadSuperblock()
+	var changed []int
+	for block := range fsys.VirtualDisk {
+		if block < superblock.Journaloffset || block >= superblock.Datablocksoffset {
+			changed = append(changed, block)
+		}
+	}
+	if err := fsys.writeJournal(superblock, changed); err != nil {
+		t.Fatal(err)
+	}
+	fsys.backingfile.Close()
+	if fsys, err = MountEncrypted(path, "secret"); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(readFile(t, fsys, "/big"), big) {
+		t.Fatal("big file not replayed")
+	}
+	checkClean(t, fsys)
+	if corrupt := fsys.corruptBlocks(); len(corrupt) > 0 {
+		t.Fatal(corrupt)
+	}
+	fsys.Unmount()
+	if image, _ := os.ReadFile(path); len(image) != len(before) {
+		t.Fatal("journal slots left past the end of the disk after replay", len(image), len(before))
+	}
+}
+
+func TestMountChecksImageLength(t *testing.T) {
+	fsys, path := remount(t, newDisk(t, Options{JournalBlocks: 2}))
+	superblock := fsys.ReadSuperblock()
+	fsys.Unmount()
+	image, _ := os.ReadFile(path)
+
+	//a disk image longer than the disk is only mounted while the journal header accounts for it
+	long := append(append([]byte(nil), image...), make([]byte, 3*superblock.Blocksize)...)
+	os.WriteFile(path, long, 0644)
+	if _, err := Mount(path); err == nil {
+		t.Fatal("mounted a disk image longer than the disk")
+	}
+
+	//a transaction that was writing its slots past the end of the disk is dropped
+	header := long[superblock.Journaloffset*superblock.Blocksize:]
+	copy(header, journalPendingMagic[:])
+	binary.LittleEndian.PutUint32(header[8:], 4)
+	os.WriteFile(path, long, 0644)
+	mountPath(t, path).Unmount()
+	if cut, _ := os.ReadFile(path); !bytes.Equal(cut, image) {
+		t.Fatal("slots past the end of the disk not cut off", len(cut), len(image))
+	}
+
+	//the header doesn't cover more blocks than its transaction has
+	long = append(long, make([]byte, superblock.Blocksize)...)
+	os.WriteFile(path, long, 0644)
+	if _, err := Mount(path); err == nil {
+		t.Fatal("mounted a disk image longer than its journal")
+	}
+}
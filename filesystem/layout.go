@@ -0,0 +1,368 @@
+package filesystem
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// The disk image is a list of blocks of the block size in the superblock. Every number in it is a little endian
+// unsigned integer unless it says otherwise, and everything not listed here is zero.
+//
+//	block 0                      superblock
+//	blocks Inodebitmapoffset...  inode bitmap, one bit per inode, most significant bit first
+//	blocks Refcountoffset...     block reference counts, one uint32 per data block, 0 means free
+//	blocks Checksumoffset...     block checksums, one uint32 per block, see checksum.go
+//	blocks Inodeoffset...        inode table, one Inodesize byte record per inode
+//	blocks Journaloffset...      journal, Journalblocks blocks, see journal.go
+//	blocks Datablocksoffset...   data blocks, reference count i is block Datablocksoffset+i
+//
+// superblock
+//
+//	0   uint32   magic, the bytes "VSFS"
+//	4   uint32   format version
+//	8   uint32   Inodebitmapoffset
+//	12  uint32   Refcountoffset
+//	16  uint32   Inodeoffset
+//	20  uint32   Datablocksoffset
+//	24  uint32   block size in bytes
+//	28  uint32   number of blocks, including the superblock
+//	32  uint32   number of inodes
+//	36  uint32   Journaloffset
+//	40  uint32   Journalblocks
+//	44  uint32   feature flags, 1 = new files are compressed, 2 = encrypted
+//	48  uint32   iterations of the key derivation of an encrypted disk
+//	52  16 bytes salt of the key derivation
+//	68  32 bytes key check, the second half of what the key derivation returns
+//	100 uint32   Checksumoffset
+//
+// inode record, inode n is at byte n*Inodesize of the inode table
+//
+//	0   uint32   flags, 1 = valid, 2 = directory, 4 = symbolic link, 8 = compressed
+//	4   uint32   inode number
+//	8   uint64   size of the content in bytes
+//	16  uint32   4 direct datablocks
+//	32  uint32   indirect block
+//	36  uint32   double indirect block
+//	40  int64    created, nanoseconds since 1970, 0 if not set
+//	48  int64    modified, nanoseconds since 1970, 0 if not set
+//	56  uint32   generation, how often the inode was freed
+//	60  uint32   link count, the number of directory entries naming the inode besides . and ..
+//	64  uint32   uid of the owner
+//	68  uint32   gid of the group
+//	72  uint32   permission bits, rwx for the owner, the group and everyone else like 0755
+//	76  int64    accessed, nanoseconds since 1970, 0 if not set
+//	84  int64    changed, when the inode itself last changed, nanoseconds since 1970, 0 if not set
+//	92  uint32   xattr block, 0 if the inode has no extended attributes
+//	96  uint64   stored size, the bytes of compressed content in the datablocks
+//
+// an indirect block holds block size/4 uint32 block numbers, a double indirect block holds
+// indirect blocks. The list of datablocks ends at the first 0.
+//
+// the reference count of a block is the number of inode records, in the inode table and in
+// the inode tables of the snapshots, and of indirect blocks that point at it. A block with a
+// count above 1 is shared with a snapshot and is copied before it is written.
+//
+// inode 0 is never valid, its content is the list of snapshots with one snapshot record each
+//
+//	0   [32]byte name, padded with zero bytes
+//	32  int64    taken, nanoseconds since 1970
+//	40  [Inodesize]byte inode record, its content is the inode table the snapshot was taken of
+//
+// directory record, a directory is size/Direntsize records stored in its datablocks
+//
+//	0   uint32   inode, 0 marks an empty slot
+//	4   [12]byte name, padded with zero bytes
+//
+// xattr record, the xattr block holds the extended attributes of an inode sorted by name
+//
+//	0   uint16   length of the name, 0 ends the list
+//	2   uint16   length of the value
+//	4   the name followed by the value
+//
+// file content is stored as is across the datablocks, the inode size says where it ends. The
+// content of a compressed file is cut into chunks of 16 blocks of content instead, the last
+// one holding what is left, and every chunk is compressed on its own. The chunks follow each
+// other in the datablocks, each one starting on a new block with a uint32 length followed by
+// a DEFLATE stream of that length. The stored size adds up the lengths and their 4 bytes, the
+// inode size is how long the content is decompressed. A symbolic link stores the path it
+// points at as its content.
+const (
+	Inodesize     = 128
+	Direntsize    = 16
+	Formatversion = 11
+)
+
+// this is how many bytes of block 0 the superblock uses
+const superblockSize = 104
+
+// these are the first bytes of every disk image
+var magic = [4]byte{'V', 'S', 'F', 'S'}
+
+// these are the feature flags of the superblock, a disk with a flag this code doesn't know
+// isn't mounted
+const (
+	//FeatureCompression makes every new file compressed
+	FeatureCompression = 1
+	//FeatureEncryption marks a disk whose disk image is encrypted with a key from a passphrase
+	FeatureEncryption = 2
+
+	knownFeatures = FeatureCompression | FeatureEncryption
+)
+
+// these are the bits of the inode flags field
+const (
+	flagValid      = 1
+	flagDirectory  = 2
+	flagSymlink    = 4
+	flagCompressed = 8
+)
+
+// this function encodes the superblock into a block
+func encodeSuperblock(superblock SuperBlock) []byte {
+	b := make([]byte, superblock.Blocksize)
+	copy(b[0:4], magic[:])
+	binary.LittleEndian.PutUint32(b[4:], Formatversion)
+	binary.LittleEndian.PutUint32(b[8:], uint32(superblock.Inodebitmapoffset))
+	binary.LittleEndian.PutUint32(b[12:], uint32(superblock.Refcountoffset))
+	binary.LittleEndian.PutUint32(b[16:], uint32(superblock.Inodeoffset))
+	binary.LittleEndian.PutUint32(b[20:], uint32(superblock.Datablocksoffset))
+	binary.LittleEndian.PutUint32(b[24:], uint32(superblock.Blocksize))
+	binary.LittleEndian.PutUint32(b[28:], uint32(superblock.Numberofblocks))
+	binary.LittleEndian.PutUint32(b[32:], uint32(superblock.Numberofinodes))
+	binary.LittleEndian.PutUint32(b[36:], uint32(superblock.Journaloffset))
+	binary.LittleEndian.PutUint32(b[40:], uint32(superblock.Journalblocks))
+	binary.LittleEndian.PutUint32(b[44:], uint32(superblock.Features))
+	binary.LittleEndian.PutUint32(b[48:], uint32(superblock.Kdfiterations))
+	copy(b[52:68], superblock.Salt[:])
+	copy(b[68:100], superblock.Keycheck[:])
+	binary.LittleEndian.PutUint32(b[100:], uint32(superblock.Checksumoffset))
+	return b
+}
+
+// this function decodes the superblock from a block, it fails if the block isn't a superblock
+func decodeSuperblock(b []byte) (SuperBlock, error) {
+	var superblock SuperBlock
+	if len(b) < superblockSize || !bytes.Equal(b[0:4], magic[:]) {
+		return superblock, fmt.Errorf("%w: no superblock found", ErrInvalid)
+	}
+	if version := binary.LittleEndian.Uint32(b[4:]); version != Formatversion {
+		return superblock, fmt.Errorf("%w: unsupported format version %d", ErrInvalid, version)
+	}
+	superblock.Inodebitmapoffset = int(binary.LittleEndian.Uint32(b[8:]))
+	superblock.Refcountoffset = int(binary.LittleEndian.Uint32(b[12:]))
+	superblock.Inodeoffset = int(binary.LittleEndian.Uint32(b[16:]))
+	superblock.Datablocksoffset = int(binary.LittleEndian.Uint32(b[20:]))
+	superblock.Blocksize = int(binary.LittleEndian.Uint32(b[24:]))
+	superblock.Numberofblocks = int(binary.LittleEndian.Uint32(b[28:]))
+	superblock.Numberofinodes = int(binary.LittleEndian.Uint32(b[32:]))
+	superblock.Journaloffset = int(binary.LittleEndian.Uint32(b[36:]))
+	superblock.Journalblocks = int(binary.LittleEndian.Uint32(b[40:]))
+	superblock.Features = int(binary.LittleEndian.Uint32(b[44:]))
+	superblock.Kdfiterations = int(binary.LittleEndian.Uint32(b[48:]))
+	copy(superblock.Salt[:], b[52:68])
+	copy(superblock.Keycheck[:], b[68:100])
+	superblock.Checksumoffset = int(binary.LittleEndian.Uint32(b[100:]))
+	return superblock, nil
+}
+
+// this function encodes an inode into its Inodesize byte record
+func encodeInode(inode Inode, b []byte) {
+	var flags uint32
+	if inode.IsValid {
+		flags |= flagValid
+	}
+	if inode.IsDirectory {
+		flags |= flagDirectory
+	}
+	if inode.IsSymlink {
+		flags |= flagSymlink
+	}
+	if inode.IsCompressed {
+		flags |= flagCompressed
+	}
+	binary.LittleEndian.PutUint32(b[0:], flags)
+	binary.LittleEndian.PutUint32(b[4:], uint32(inode.Inodenumber))
+	binary.LittleEndian.PutUint64(b[8:], uint64(inode.Size))
+	for i, block := range inode.Datablocks {
+		binary.LittleEndian.PutUint32(b[16+i*4:], uint32(block))
+	}
+	binary.LittleEndian.PutUint32(b[32:], uint32(inode.Indirect))
+	binary.LittleEndian.PutUint32(b[36:], uint32(inode.DoubleIndirect))
+	binary.LittleEndian.PutUint64(b[40:], uint64(encodeTime(inode.Filecreated)))
+	binary.LittleEndian.PutUint64(b[48:], uint64(encodeTime(inode.Filemodified)))
+	binary.LittleEndian.PutUint32(b[56:], inode.Generation)
+	binary.LittleEndian.PutUint32(b[60:], uint32(inode.Nlink))
+	binary.LittleEndian.PutUint32(b[64:], uint32(inode.Uid))
+	binary.LittleEndian.PutUint32(b[68:], uint32(inode.Gid))
+	binary.LittleEndian.PutUint32(b[72:], inode.Mode)
+	binary.LittleEndian.PutUint64(b[76:], uint64(encodeTime(inode.Fileaccessed)))
+	binary.LittleEndian.PutUint64(b[84:], uint64(encodeTime(inode.Filechanged)))
+	binary.LittleEndian.PutUint32(b[92:], uint32(inode.Xattr))
+	binary.LittleEndian.PutUint64(b[96:], uint64(inode.Storedsize))
+	//clear the reserved part of the record
+	for i := 104; i < Inodesize; i++ {
+		b[i] = 0
+	}
+}
+
+// this function decodes an inode from its Inodesize byte record
+func decodeInode(b []byte) Inode {
+	var inode Inode
+	flags := binary.LittleEndian.Uint32(b[0:])
+	inode.IsValid = flags&flagValid != 0
+	inode.IsDirectory = flags&flagDirectory != 0
+	inode.IsSymlink = flags&flagSymlink != 0
+	inode.IsCompressed = flags&flagCompressed != 0
+	inode.Inodenumber = int(binary.LittleEndian.Uint32(b[4:]))
+	inode.Size = int64(binary.LittleEndian.Uint64(b[8:]))
+	for i := range inode.Datablocks {
+		inode.Datablocks[i] = int(binary.LittleEndian.Uint32(b[16+i*4:]))
+	}
+	inode.Indirect = int(binary.LittleEndian.Uint32(b[32:]))
+	inode.DoubleIndirect = int(binary.LittleEndian.Uint32(b[36:]))
+	inode.Filecreated = decodeTime(int64(binary.LittleEndian.Uint64(b[40:])))
+	inode.Filemodified = decodeTime(int64(binary.LittleEndian.Uint64(b[48:])))
+	inode.Generation = binary.LittleEndian.Uint32(b[56:])
+	inode.Nlink = int(binary.LittleEndian.Uint32(b[60:]))
+	inode.Uid = int(binary.LittleEndian.Uint32(b[64:]))
+	inode.Gid = int(binary.LittleEndian.Uint32(b[68:]))
+	inode.Mode = binary.LittleEndian.Uint32(b[72:])
+	inode.Fileaccessed = decodeTime(int64(binary.LittleEndian.Uint64(b[76:])))
+	inode.Filechanged = decodeTime(int64(binary.LittleEndian.Uint64(b[84:])))
+	inode.Xattr = int(binary.LittleEndian.Uint32(b[92:]))
+	inode.Storedsize = int64(binary.LittleEndian.Uint64(b[96:]))
+	return inode
+}
+
+// this function turns a time into nanoseconds since 1970, the zero time is stored as 0
+func encodeTime(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+// this function turns nanoseconds since 1970 back into a time
+func decodeTime(nanoseconds int64) time.Time {
+	if nanoseconds == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, nanoseconds)
+}
+
+// this function encodes the entries of a directory into Direntsize byte records, empty
+// slots left by Unlink are kept as records with inode 0
+func encodeDirectory(directory Directory) ([]byte, error) {
+	data := make([]byte, len(directory.Files)*Direntsize)
+	for i := range directory.Files {
+		if len(directory.Filenames[i]) > Filenamelength {
+			return nil, ErrNameTooLong
+		}
+		record := data[i*Direntsize : (i+1)*Direntsize]
+		binary.LittleEndian.PutUint32(record[0:], uint32(directory.Files[i]))
+		copy(record[4:], directory.Filenames[i])
+	}
+	return data, nil
+}
+
+// this function decodes directory records, empty records at the end are dropped
+func decodeDirectory(data []byte, numberofinodes int) (Directory, error) {
+	var directory Directory
+	for i := 0; i+Direntsize <= len(data); i += Direntsize {
+		record := data[i : i+Direntsize]
+		inode := int(binary.LittleEndian.Uint32(record[0:]))
+		if inode >= numberofinodes {
+			return directory, fmt.Errorf("decoding directory: inode %d out of range", inode)
+		}
+		name := string(bytes.TrimRight(record[4:], "\x00"))
+		directory.Files = append(directory.Files, inode)
+		directory.Filenames = append(directory.Filenames, name)
+		if name == "." {
+			directory.Inode = inode
+		}
+	}
+	//drop the empty slots at the end
+	for len(directory.Files) > 0 && directory.Files[len(directory.Files)-1] == 0 {
+		directory.Files = directory.Files[:len(directory.Files)-1]
+		directory.Filenames = directory.Filenames[:len(directory.Filenames)-1]
+	}
+	return directory, nil
+}
+
+// this is the size of the fixed part of an xattr record
+const xattrHeaderSize = 4
+
+// this function encodes extended attributes into an xattr block of blocksize bytes
+func encodeXattrs(attrs map[string][]byte, blocksize int) ([]byte, error) {
+	names := make([]string, 0, len(attrs))
+	for name := range attrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b []byte
+	for _, name := range names {
+		b = binary.LittleEndian.AppendUint16(b, uint16(len(name)))
+		b = binary.LittleEndian.AppendUint16(b, uint16(len(attrs[name])))
+		b = append(b, name...)
+		b = append(b, attrs[name]...)
+	}
+	if len(b) > blocksize {
+		return nil, ErrAttrTooLarge
+	}
+	block := make([]byte, blocksize)
+	copy(block, b)
+	return block, nil
+}
+
+// this function decodes the extended attributes stored in an xattr block
+func decodeXattrs(b []byte) (map[string][]byte, error) {
+	attrs := map[string][]byte{}
+	for len(b) >= xattrHeaderSize {
+		namelength := int(binary.LittleEndian.Uint16(b[0:]))
+		valuelength := int(binary.LittleEndian.Uint16(b[2:]))
+		if namelength == 0 {
+			break
+		}
+		if xattrHeaderSize+namelength+valuelength > len(b) {
+			return nil, fmt.Errorf("decoding xattrs: record runs past the end of the block")
+		}
+		name := string(b[xattrHeaderSize : xattrHeaderSize+namelength])
+		value := b[xattrHeaderSize+namelength : xattrHeaderSize+namelength+valuelength]
+		attrs[name] = append([]byte{}, value...)
+		b = b[xattrHeaderSize+namelength+valuelength:]
+	}
+	return attrs, nil
+}
+
+// this is the size of one snapshot record in the snapshot list
+const snapshotRecordSize = 40 + Inodesize
+
+// this function encodes the snapshot list into snapshot records
+func encodeSnapshots(snapshots []snapshot) []byte {
+	data := make([]byte, len(snapshots)*snapshotRecordSize)
+	for i, s := range snapshots {
+		record := data[i*snapshotRecordSize : (i+1)*snapshotRecordSize]
+		copy(record[0:Snapshotnamelength], s.name)
+		binary.LittleEndian.PutUint64(record[32:], uint64(encodeTime(s.taken)))
+		encodeInode(s.table, record[40:])
+	}
+	return data
+}
+
+// this function decodes the snapshot list from snapshot records
+func decodeSnapshots(data []byte) ([]snapshot, error) {
+	if len(data)%snapshotRecordSize != 0 {
+		return nil, fmt.Errorf("decoding snapshots: %d bytes is not a whole number of records", len(data))
+	}
+	snapshots := make([]snapshot, len(data)/snapshotRecordSize)
+	for i := range snapshots {
+		record := data[i*snapshotRecordSize : (i+1)*snapshotRecordSize]
+		snapshots[i].name = string(bytes.TrimRight(record[0:Snapshotnamelength], "\x00"))
+		snapshots[i].taken = decodeTime(int64(binary.LittleEndian.Uint64(record[32:])))
+		snapshots[i].table = decodeInode(record[40:])
+	}
+	return snapshots, nil
+}
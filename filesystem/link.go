@@ -0,0 +1,82 @@
+package filesystem
+
+import (
+	"io/fs"
+)
+
+// this function gives the file at existing a second name at newpath, both names share the
+// inode and its content. Relative paths start at the directory at cwd. Directories can't be
+// linked, they only ever have the entry in their parent. cred needs permission to add the entry
+func (fsys *FileSystem) Link(existing string, newpath string, cwd int, cred Cred) (err error) {
+	fsys.beginTransaction()
+	defer fsys.endTransaction(&err)
+	workinginode, err := fsys.resolve(existing, cwd, cred)
+	if err != nil {
+		return err
+	}
+	if fsys.readLocked(workinginode).IsDirectory {
+		return &fs.PathError{Op: "link", Path: existing, Err: ErrIsDir}
+	}
+	searchnode, filename, err := fsys.resolveParent(newpath, cwd, cred)
+	if err != nil {
+		return err
+	}
+	if len(filename) > Filenamelength {
+		return &fs.PathError{Op: "link", Path: newpath, Err: ErrNameTooLong}
+	}
+	if filename == "." || filename == ".." {
+		return &fs.PathError{Op: "link", Path: newpath, Err: ErrInvalid}
+	}
+
+	//the directory is locked before the file like everywhere else
+	fsys.inodelocks[searchnode].Lock()
+	defer fsys.inodelocks[searchnode].Unlock()
+	if _, err := fsys.lookup(filename, searchnode); err == nil {
+		return &fs.PathError{Op: "link", Path: newpath, Err: ErrExist}
+	}
+	disknode := fsys.ReadInode(searchnode)
+	if !disknode.IsValid {
+		return &fs.PathError{Op: "link", Path: newpath, Err: ErrNotExist}
+	}
+	if err := checkPermission(disknode, cred, permWrite|permExec); err != nil {
+		return &fs.PathError{Op: "link", Path: newpath, Err: err}
+	}
+	fsys.inodelocks[workinginode].Lock()
+	defer fsys.inodelocks[workinginode].Unlock()
+	//the file may have been removed since it was resolved
+	inode := fsys.ReadInode(workinginode)
+	if !inode.IsValid {
+		return &fs.PathError{Op: "link", Path: existing, Err: ErrNotExist}
+	}
+
+	workingdirectory, err := fsys.ReadDirectoryFromInode(disknode)
+	if err != nil {
+		return &fs.PathError{Op: "link", Path: newpath, Err: err}
+	}
+	workingdirectory.Filenames = append(workingdirectory.Filenames, filename)
+	workingdirectory.Files = append(workingdirectory.Files, workinginode)
+	disknode, err = fsys.WriteDirectoryToInode(workingdirectory, disknode)
+	if err != nil {
+		return &fs.PathError{Op: "link", Path: newpath, Err: err}
+	}
+	disknode.modified()
+	fsys.WriteInode(disknode)
+	inode.Nlink++
+	inode.changed()
+	fsys.WriteInode(inode)
+	return nil
+}
+
+// this function takes away one link of the inode at number after a directory entry naming it
+// was removed, the inode and its datablocks are freed with the last link. The caller holds the
+// lock of the inode
+func (fsys *FileSystem) dropLink(number int) {
+	inode := fsys.ReadInode(number)
+	if inode.Nlink > 1 {
+		inode.Nlink--
+		inode.changed()
+		fsys.WriteInode(inode)
+		return
+	}
+	fsys.releaseInode(number)
+}
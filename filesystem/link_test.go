@@ -0,0 +1,64 @@
+package filesystem
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestLink(t *testing.T) {
+	fsys := newDisk(t, Options{})
+	free := freeCount(fsys)
+	fsys.Mkdir("/a", RootInode, RootCred)
+	writeFile(t, fsys, "/a/x", make([]byte, 5000))
+	if err := fsys.Link("/a/x", "/y", RootInode, RootCred); err != nil {
+		t.Fatal(err)
+	}
+	if err := fsys.Link("/a/x", "/y", RootInode, RootCred); !errors.Is(err, ErrExist) {
+		t.Fatal(err)
+	}
+	if err := fsys.Link("/a", "/z", RootInode, RootCred); !errors.Is(err, ErrIsDir) {
+		t.Fatal(err)
+	}
+	n, _ := fsys.ResolvePath("/y", RootInode, RootCred)
+	if nlink := fsys.ReadInode(n).Nlink; nlink != 2 {
+		t.Fatal(nlink)
+	}
+	fsys, _ = remount(t, fsys)
+	checkClean(t, fsys)
+
+	//the file lives on under its other name
+	if err := fsys.Rmdir("/a", RootInode, RootCred, true); err != nil {
+		t.Fatal(err)
+	}
+	if inode := fsys.ReadInode(n); inode.Nlink != 1 || !inode.IsValid {
+		t.Fatal(inode.Nlink, inode.IsValid)
+	}
+	if len(readFile(t, fsys, "/y")) != 5000 {
+		t.Fatal("content lost")
+	}
+	if err := fsys.Unlink("/y", RootInode, RootCred); err != nil {
+		t.Fatal(err)
+	}
+	if fsys.ReadInode(n).IsValid || freeCount(fsys) != free {
+		t.Fatal("inode or blocks not freed")
+	}
+	checkClean(t, fsys)
+}
+
+func TestFsckRepairsLinkCount(t *testing.T) {
+	fsys := newDisk(t, Options{})
+	writeFile(t, fsys, "/q", nil)
+	fsys.Link("/q", "/r", RootInode, RootCred)
+	n, _ := fsys.ResolvePath("/q", RootInode, RootCred)
+	inode := fsys.ReadInode(n)
+	inode.Nlink = 5
+	fsys.WriteInode(inode)
+	findings, err := fsys.Fsck(true)
+	if err != nil || len(findings) != 1 || findings[0].Problem != BadLinkCount || !findings[0].Repaired {
+		t.Fatal(findings, err)
+	}
+	checkClean(t, fsys)
+	if nlink := fsys.ReadInode(n).Nlink; nlink != 2 {
+		t.Fatal(nlink)
+	}
+}
@@ -0,0 +1,203 @@
+package filesystem
+
+import (
+	"fmt"
+	"sync"
+)
+
+// these are the limits Format accepts for the disk geometry
+const (
+	Minblocksize = 512
+	Maxblocksize = 65536
+)
+
+// this is the geometry of a new disk, fields left at 0 get the default from the constants.
+// JournalBlocks left at 0 gets a journal big enough to rewrite the reference counts, the inode
+// bitmap and the inode table.
+// Owner owns the root directory, the superuser if it is left empty. Compress makes every new
+// file compressed, SetCompression changes it per file. A disk with a Passphrase is encrypted
+// when it is saved and only MountEncrypted with the same passphrase mounts it again
+type Options struct {
+	BlockSize     int
+	Blocks        int
+	Inodes        int
+	JournalBlocks int
+	Owner         Cred
+	Compress      bool
+	Passphrase    string
+}
+
+// this function fills in the default geometry and checks that a disk can be laid out with it
+func (o Options) withDefaults() (Options, error) {
+	if o.BlockSize == 0 {
+		o.BlockSize = Blocksize
+	}
+	if o.Blocks == 0 {
+		o.Blocks = Numberofblocks
+	}
+	if o.Inodes == 0 {
+		o.Inodes = Numberofinodes
+	}
+	if o.BlockSize < Minblocksize || o.BlockSize > Maxblocksize || o.BlockSize&(o.BlockSize-1) != 0 {
+		return o, fmt.Errorf("%w: block size %d must be a power of two from %d to %d", ErrInvalid, o.BlockSize, Minblocksize, Maxblocksize)
+	}
+	//inode 0 is never used and inode 1 is the root directory
+	if o.Inodes < 2 {
+		return o, fmt.Errorf("%w: need at least 2 inodes, got %d", ErrInvalid, o.Inodes)
+	}
+	if o.Blocks < 1 || o.Blocks > 1<<32-1 {
+		return o, fmt.Errorf("%w: block count %d out of range", ErrInvalid, o.Blocks)
+	}
+	//the journal needs its header and room for at least one block
+	if o.JournalBlocks < 0 || o.JournalBlocks == 1 {
+		return o, fmt.Errorf("%w: journal needs at least 2 blocks, got %d", ErrInvalid, o.JournalBlocks)
+	}
+	return o, nil
+}
+
+// this function works out where everything goes on a disk with the given geometry
+func layoutSuperblock(o Options) (SuperBlock, error) {
+	var superblock SuperBlock
+	superblock.Blocksize = o.BlockSize
+	superblock.Numberofblocks = o.Blocks
+	superblock.Numberofinodes = o.Inodes
+	if o.Compress {
+		superblock.Features |= FeatureCompression
+	}
+	bitsPerBlock := o.BlockSize * 8
+	//there is a reference count and a checksum for every block on the disk, the reference counts
+	//before the data blocks are never used
+	superblock.Inodebitmapoffset = 1
+	superblock.Refcountoffset = superblock.Inodebitmapoffset + (o.Inodes+bitsPerBlock-1)/bitsPerBlock
+	superblock.Checksumoffset = superblock.Refcountoffset + (o.Blocks*4+o.BlockSize-1)/o.BlockSize
+	superblock.Inodeoffset = superblock.Checksumoffset + (o.Blocks*4+o.BlockSize-1)/o.BlockSize
+	superblock.Journaloffset = superblock.Inodeoffset + (o.Inodes*Inodesize+o.BlockSize-1)/o.BlockSize
+	superblock.Journalblocks = o.JournalBlocks
+	if superblock.Journalblocks == 0 {
+		//room for the header, every metadata block before the journal but the superblock, and some directory blocks
+		superblock.Journalblocks = superblock.Journaloffset + 16
+		if perHeader := (o.BlockSize-journalHeaderSize)/4 + 1; superblock.Journalblocks > perHeader {
+			superblock.Journalblocks = perHeader
+		}
+	}
+	superblock.Datablocksoffset = superblock.Journaloffset + superblock.Journalblocks
+	//the root directory needs one data block
+	if superblock.Datablocksoffset >= o.Blocks {
+		return superblock, fmt.Errorf("%w: %d blocks is too small, the metadata alone takes %d", ErrInvalid, o.Blocks, superblock.Datablocksoffset)
+	}
+	return superblock, nil
+}
+
+// this function formats a new disk with the geometry in o, laying out the superblock, the
+// inode bitmap, the reference counts, the inode table, the journal and the data blocks, and creates the root directory at
+// inode 1. The new disk only lives in memory until it is saved, a mounted disk image is let go
+func (fsys *FileSystem) Format(o Options) error {
+	o, err := o.withDefaults()
+	if err != nil {
+		return err
+	}
+	superblock, err := layoutSuperblock(o)
+	if err != nil {
+		return err
+	}
+	aead, err := encryptSuperblock(&superblock, o.Passphrase)
+	if err != nil {
+		return err
+	}
+
+	if err := fsys.Unmount(); err != nil {
+		return err
+	}
+	fsys.disklock.Lock()
+	defer fsys.disklock.Unlock()
+	fsys.resetTransaction()
+	fsys.aead = aead
+	fsys.corrupt = nil
+
+	//create an empty disk and push the superblock onto block 0 so everything else can find its offset
+	fsys.VirtualDisk = make([][]byte, o.Blocks)
+	for i := range fsys.VirtualDisk {
+		fsys.VirtualDisk[i] = make([]byte, o.BlockSize)
+	}
+	if err := fsys.WriteSuperblock(superblock); err != nil {
+		return err
+	}
+
+	//prepare an empty Inode array
+	fsys.inodelocks = make([]sync.RWMutex, o.Inodes)
+	fsys.Inodes = make([]Inode, o.Inodes)
+	for i := range fsys.Inodes {
+		fsys.Inodes[i].created()
+		fsys.Inodes[i].Inodenumber = i
+	}
+
+	//inititate second to first inode with root directory in the first data block
+	fsys.Inodes[1].IsDirectory = true
+	fsys.Inodes[1].IsValid = true
+	fsys.Inodes[1].Nlink = 1
+	fsys.Inodes[1].Uid = o.Owner.Uid
+	fsys.Inodes[1].Gid = o.Owner.Gid
+	fsys.Inodes[1].Mode = defaultDirectoryMode
+	fsys.Inodes[1].Datablocks = [4]int{superblock.Datablocksoffset, 0, 0, 0}
+
+	//create a root directory, the root directory is its own parent
+	var rootdirectory Directory
+	rootdirectory.Inode = 1
+	rootdirectory.Filenames = []string{".", ".."}
+	rootdirectory.Files = []int{1, 1}
+	if err := fsys.AddWorkingDirectoryToDisk(rootdirectory, fsys.inodeBlocks(fsys.Inodes[1])); err != nil {
+		return err
+	}
+	fsys.Inodes[1].Size = int64(len(rootdirectory.Files) * Direntsize)
+
+	//the root inode is used and its directory block has the one reference from it
+	fsys.Refcounts = make([]int, numDataBlocks(superblock))
+	fsys.InodeBitmap = make([]bool, o.Inodes)
+	fsys.Refcounts[0] = 1
+	fsys.InodeBitmap[0] = true
+	fsys.InodeBitmap[1] = true
+
+	//put the inode bitmap, the reference counts and the inodes on disk
+	fsys.AddInodeBitmapToDisk(fsys.InodeBitmap)
+	fsys.AddRefcountsToDisk(fsys.Refcounts)
+	fsys.WriteInodesToDisk(fsys.Inodes)
+	fsys.resetTransaction()
+	return nil
+}
+
+// this function checks that a superblock read from a disk image has a layout Format could have made
+func checkSuperblock(superblock SuperBlock) error {
+	if superblock.Features&^knownFeatures != 0 {
+		return fmt.Errorf("%w: superblock has unknown features %#x", ErrInvalid, superblock.Features&^knownFeatures)
+	}
+	o := Options{BlockSize: superblock.Blocksize, Blocks: superblock.Numberofblocks, Inodes: superblock.Numberofinodes, JournalBlocks: superblock.Journalblocks,
+		Compress: superblock.Features&FeatureCompression != 0}
+	if o.BlockSize == 0 || o.Blocks == 0 || o.Inodes == 0 || o.JournalBlocks == 0 {
+		return fmt.Errorf("%w: superblock has no geometry", ErrInvalid)
+	}
+	o, err := o.withDefaults()
+	if err != nil {
+		return err
+	}
+	expected, err := layoutSuperblock(o)
+	if err != nil {
+		return err
+	}
+	//the key derivation of an encrypted disk is random, only its iterations are checked
+	if superblock.Features&FeatureEncryption != 0 {
+		if superblock.Kdfiterations < 1 {
+			return fmt.Errorf("%w: superblock has no key derivation", ErrInvalid)
+		}
+		if superblock.Kdfiterations > maxKdfIterations {
+			return fmt.Errorf("%w: superblock asks for %d key derivation iterations, at most %d are run", ErrInvalid, superblock.Kdfiterations, maxKdfIterations)
+		}
+		expected.Features |= FeatureEncryption
+		expected.Kdfiterations = superblock.Kdfiterations
+		expected.Salt = superblock.Salt
+		expected.Keycheck = superblock.Keycheck
+	}
+	if expected != superblock {
+		return fmt.Errorf("%w: superblock offsets don't match its geometry", ErrInvalid)
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+package filesystem
+
+import (
+	"io/fs"
+	"strings"
+)
+
+// this is the inode of the root directory, absolute paths start from here
+const RootInode = 1
+
+// this function walks path through the directories and returns the inode it names. Paths that
+// start with / begin at the root directory, everything else begins at the directory at cwd.
+// cred needs search permission on every directory on the way
+func (fsys *FileSystem) ResolvePath(path string, cwd int, cred Cred) (int, error) {
+	fsys.disklock.RLock()
+	defer fsys.disklock.RUnlock()
+	return fsys.resolve(path, cwd, cred)
+}
+
+// this is how many symbolic links one path may go through before it counts as a loop
+const maxSymlinks = 40
+
+// this function is ResolvePath for callers that already hold the disk lock, each directory
+// is only locked while it is searched. Symbolic links are followed, even the last element
+func (fsys *FileSystem) resolve(path string, cwd int, cred Cred) (int, error) {
+	return fsys.walk(path, cwd, cred, true)
+}
+
+// this function is resolve without following a symbolic link at the last element of path
+func (fsys *FileSystem) lresolve(path string, cwd int, cred Cred) (int, error) {
+	return fsys.walk(path, cwd, cred, false)
+}
+
+// this function resolves path, following the symbolic link at its last element if follow is set
+func (fsys *FileSystem) walk(path string, cwd int, cred Cred, follow bool) (int, error) {
+	links := 0
+	current, err := fsys.walkFrom(path, cwd, cred, follow, &links)
+	if err != nil {
+		return 0, &fs.PathError{Op: "resolve", Path: path, Err: err}
+	}
+	return current, nil
+}
+
+// this function walks path from the directory at cwd, links counts the symbolic links followed
+// so far by the whole resolution. A link is resolved from the directory that holds it
+func (fsys *FileSystem) walkFrom(path string, cwd int, cred Cred, follow bool, links *int) (int, error) {
+	current := cwd
+	if strings.HasPrefix(path, "/") {
+		current = RootInode
+	}
+	if current < 0 || current >= fsys.superblock.Numberofinodes || !fsys.readLocked(current).IsValid {
+		return 0, ErrNotExist
+	}
+	if err := fsys.verifyRecord(current); err != nil {
+		return 0, err
+	}
+	var names []string
+	for _, name := range strings.Split(path, "/") {
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+	for i, name := range names {
+		//only directories can be walked through, findFile fails on anything else
+		if inode := fsys.readLocked(current); inode.IsDirectory {
+			if err := checkPermission(inode, cred, permExec); err != nil {
+				return 0, err
+			}
+		}
+		next, err := fsys.findFile(name, current)
+		if err != nil {
+			return 0, err
+		}
+		//nothing in a record from a corrupt block of the inode table can be trusted
+		if err := fsys.verifyRecord(next); err != nil {
+			return 0, err
+		}
+		if (i < len(names)-1 || follow) && fsys.readLocked(next).IsSymlink {
+			*links++
+			if *links > maxSymlinks {
+				return 0, ErrLoop
+			}
+			target, err := fsys.readLink(next)
+			if err != nil {
+				return 0, err
+			}
+			if next, err = fsys.walkFrom(target, current, cred, true, links); err != nil {
+				return 0, err
+			}
+		}
+		current = next
+	}
+	return current, nil
+}
+
+// this function reads the inode at number under its lock
+func (fsys *FileSystem) readLocked(number int) Inode {
+	fsys.inodelocks[number].RLock()
+	defer fsys.inodelocks[number].RUnlock()
+	return fsys.ReadInode(number)
+}
+
+// this function resolves the directory that holds the last element of path and returns
+// its inode along with the name of the last element, the caller holds the disk lock
+func (fsys *FileSystem) resolveParent(path string, cwd int, cred Cred) (int, string, error) {
+	trimmed := strings.TrimRight(path, "/")
+	if trimmed == "" {
+		return 0, "", &fs.PathError{Op: "resolve", Path: path, Err: fs.ErrInvalid}
+	}
+	dir, name := "", trimmed
+	if i := strings.LastIndex(trimmed, "/"); i >= 0 {
+		dir, name = trimmed[:i+1], trimmed[i+1:]
+	}
+	parent, err := fsys.resolve(dir, cwd, cred)
+	if err != nil {
+		return 0, "", err
+	}
+	if !fsys.readLocked(parent).IsDirectory {
+		return 0, "", &fs.PathError{Op: "resolve", Path: path, Err: ErrNotDir}
+	}
+	return parent, name, nil
+}
+
+// this function returns the last element of path, or / for the root directory
+func lastElement(path string) string {
+	trimmed := strings.TrimRight(path, "/")
+	if trimmed == "" {
+		if path == "" {
+			return "."
+		}
+		return "/"
+	}
+	return trimmed[strings.LastIndex(trimmed, "/")+1:]
+}
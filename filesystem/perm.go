@@ -0,0 +1,98 @@
+package filesystem
+
+import (
+	"io/fs"
+)
+
+// this is who is calling an operation, every operation on a path checks the permission bits of
+// the inodes it uses against it. Uid 0 is the superuser and is allowed everything
+type Cred struct {
+	Uid int
+	Gid int
+}
+
+// this is the superuser, for tools that have the disk to themselves
+var RootCred = Cred{}
+
+// these are the permission bits of Inode.Mode for the owner, they are shifted right by 3 for
+// the group and by 6 for everyone else
+const (
+	permRead  = 0400
+	permWrite = 0200
+	permExec  = 0100
+)
+
+// these are the modes new inodes get, the owner is the caller that made them
+const (
+	defaultFileMode      = 0644
+	defaultDirectoryMode = 0755
+	symlinkMode          = 0777
+)
+
+// this function checks that cred may do want to inode, want is a combination of permRead,
+// permWrite and permExec
+func checkPermission(inode Inode, cred Cred, want uint32) error {
+	if cred.Uid == 0 {
+		return nil
+	}
+	switch {
+	case cred.Uid == inode.Uid:
+	case cred.Gid == inode.Gid:
+		want >>= 3
+	default:
+		want >>= 6
+	}
+	if inode.Mode&want != want {
+		return ErrPermission
+	}
+	return nil
+}
+
+// this function changes the permission bits of the file or directory at path, only its owner
+// and the superuser may. Relative paths start at the directory at cwd
+func (fsys *FileSystem) Chmod(path string, cwd int, cred Cred, mode fs.FileMode) (err error) {
+	fsys.beginTransaction()
+	defer fsys.endTransaction(&err)
+	workinginode, err := fsys.resolve(path, cwd, cred)
+	if err != nil {
+		return err
+	}
+	fsys.inodelocks[workinginode].Lock()
+	defer fsys.inodelocks[workinginode].Unlock()
+	inode := fsys.ReadInode(workinginode)
+	if cred.Uid != 0 && cred.Uid != inode.Uid {
+		return &fs.PathError{Op: "chmod", Path: path, Err: ErrPermission}
+	}
+	inode.Mode = uint32(mode.Perm())
+	inode.changed()
+	fsys.WriteInode(inode)
+	return nil
+}
+
+// this function changes the owner and group of the file or directory at path, a negative uid
+// or gid is left as it is. Only the superuser may give a file away, the owner may only move it
+// into its own group. Relative paths start at the directory at cwd
+func (fsys *FileSystem) Chown(path string, cwd int, cred Cred, uid int, gid int) (err error) {
+	fsys.beginTransaction()
+	defer fsys.endTransaction(&err)
+	workinginode, err := fsys.resolve(path, cwd, cred)
+	if err != nil {
+		return err
+	}
+	fsys.inodelocks[workinginode].Lock()
+	defer fsys.inodelocks[workinginode].Unlock()
+	inode := fsys.ReadInode(workinginode)
+	if uid < 0 {
+		uid = inode.Uid
+	}
+	if gid < 0 {
+		gid = inode.Gid
+	}
+	if cred.Uid != 0 && (cred.Uid != inode.Uid || uid != inode.Uid || (gid != inode.Gid && gid != cred.Gid)) {
+		return &fs.PathError{Op: "chown", Path: path, Err: ErrPermission}
+	}
+	inode.Uid, inode.Gid = uid, gid
+	inode.changed()
+	fsys.WriteInode(inode)
+	return nil
+}
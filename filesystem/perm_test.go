@@ -0,0 +1,85 @@
+package filesystem
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"testing"
+)
+
+func TestPermissions(t *testing.T) {
+	fsys := newDisk(t, Options{})
+	alice := Cred{Uid: 1000, Gid: 100}
+	bob := Cred{Uid: 1001, Gid: 100}
+	eve := Cred{Uid: 1002, Gid: 200}
+	denied := func(err error) {
+		t.Helper()
+		if !errors.Is(err, ErrPermission) {
+			t.Fatal("expected permission denied:", err)
+		}
+	}
+	allowed := func(err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	denied(fsys.Mkdir("/home", RootInode, alice))
+	allowed(fsys.Mkdir("/home", RootInode, RootCred))
+	allowed(fsys.Chown("/home", RootInode, RootCred, 1000, 100))
+	allowed(fsys.Mkdir("/home/a", RootInode, alice))
+	f, err := fsys.Create("/home/a/f", RootInode, alice)
+	allowed(err)
+	f.Write([]byte("secret"))
+
+	//0644: the group and everyone else can read but not write
+	_, err = fsys.OpenFile("/home/a/f", RootInode, bob, os.O_RDONLY)
+	allowed(err)
+	_, err = fsys.OpenFile("/home/a/f", RootInode, bob, os.O_WRONLY)
+	denied(err)
+	denied(fsys.Chmod("/home/a/f", RootInode, bob, 0777))
+	allowed(fsys.Chmod("/home/a/f", RootInode, alice, 0600))
+	_, err = fsys.OpenFile("/home/a/f", RootInode, bob, os.O_RDONLY)
+	denied(err)
+	_, err = fsys.OpenFile("/home/a/f", RootInode, RootCred, os.O_RDWR)
+	allowed(err)
+
+	//a directory without permission for others hides what is in it
+	allowed(fsys.Chmod("/home/a", RootInode, alice, 0700))
+	_, err = fsys.Stat("/home/a/f", RootInode, bob)
+	denied(err)
+	_, err = fsys.ReadDir("/home/a", RootInode, bob)
+	denied(err)
+	denied(fsys.Unlink("/home/a/f", RootInode, bob))
+	denied(fsys.Rmdir("/home/a", RootInode, bob, true))
+
+	//the owner can only give the file to a group it is in
+	denied(fsys.Chown("/home/a/f", RootInode, alice, 1001, -1))
+	allowed(fsys.Chown("/home/a/f", RootInode, alice, -1, 100))
+	denied(fsys.Chown("/home/a/f", RootInode, alice, -1, 200))
+
+	allowed(fsys.Chmod("/home/a", RootInode, alice, 0750))
+	allowed(fsys.Chmod("/home/a/f", RootInode, alice, 0640))
+	if b, err := fsys.FS(bob).ReadFile("home/a/f"); err != nil || string(b) != "secret" {
+		t.Fatal(string(b), err)
+	}
+	_, err = fsys.FS(eve).ReadFile("home/a/f")
+	denied(err)
+	fi, _ := fsys.Stat("/home/a/f", RootInode, alice)
+	st := fi.Sys().(*FileStat)
+	if fi.Mode() != 0640 || st.Uid != 1000 || st.Gid != 100 {
+		t.Fatal(fi.Mode(), st.Uid, st.Gid)
+	}
+
+	allowed(fsys.Mkdir("/home/k", RootInode, alice))
+	mounted, _ := remount(t, fsys)
+	fi, err = mounted.Stat("/home/k", RootInode, RootCred)
+	allowed(err)
+	st = fi.Sys().(*FileStat)
+	if fi.Mode() != fs.ModeDir|0755 || st.Uid != 1000 || st.Gid != 100 {
+		t.Fatal(fi.Mode(), st.Uid, st.Gid)
+	}
+	allowed(mounted.Rmdir("/home/a", RootInode, alice, true))
+	checkClean(t, mounted)
+}
@@ -0,0 +1,264 @@
+package filesystem
+
+import (
+	"io/fs"
+)
+
+// this function moves the file or directory at oldpath to newpath, relative paths start at the
+// directory at cwd. Both directories change in one transaction so the entry is never lost or
+// seen twice, a directory that moves gets its .. entry pointed at its new parent. An existing
+// file or empty directory at newpath is only replaced when replace is true, and a directory
+// can't be moved into itself. cred needs permission to change both directories
+func (fsys *FileSystem) Rename(oldpath string, newpath string, cwd int, cred Cred, replace bool) (err error) {
+	fsys.beginTransaction()
+	defer fsys.endTransaction(&err)
+	//one rename at a time, so the tree can't change shape while the directories are locked
+	fsys.renamelock.Lock()
+	defer fsys.renamelock.Unlock()
+	oldparent, oldname, err := fsys.resolveParent(oldpath, cwd, cred)
+	if err != nil {
+		return err
+	}
+	newparent, newname, err := fsys.resolveParent(newpath, cwd, cred)
+	if err != nil {
+		return err
+	}
+	if oldname == "." || oldname == ".." {
+		return &fs.PathError{Op: "rename", Path: oldpath, Err: ErrInvalid}
+	}
+	if newname == "." || newname == ".." {
+		return &fs.PathError{Op: "rename", Path: newpath, Err: ErrInvalid}
+	}
+	if len(newname) > Filenamelength {
+		return &fs.PathError{Op: "rename", Path: newpath, Err: ErrNameTooLong}
+	}
+
+	//the directories are only checked again once they are locked, an entry that changed in
+	//between means the checks start over
+	for {
+		done, err := fsys.rename(oldpath, oldparent, oldname, newpath, newparent, newname, cred, replace)
+		if done {
+			return err
+		}
+	}
+}
+
+// this function is one attempt of Rename, done is false when an entry changed before the
+// directories were locked. Everything that walks up the tree is checked before anything is
+// locked, since directories are only ever locked before the directories below them
+func (fsys *FileSystem) rename(oldpath string, oldparent int, oldname string, newpath string, newparent int, newname string, cred Cred, replace bool) (done bool, err error) {
+	workinginode, err := fsys.findFile(oldname, oldparent)
+	if err != nil {
+		return true, &fs.PathError{Op: "rename", Path: oldpath, Err: err}
+	}
+	//the file that is already at newpath, 0 if there is none
+	target, err := fsys.findFile(newname, newparent)
+	if err != nil {
+		target = 0
+	}
+	moving := fsys.readLocked(workinginode)
+	if moving.IsDirectory && fsys.isAncestor(workinginode, newparent) {
+		return true, &fs.PathError{Op: "rename", Path: newpath, Err: ErrInvalid}
+	}
+	//a directory above oldpath can't be empty
+	if target != 0 && target != workinginode && fsys.isAncestor(target, oldparent) {
+		return true, &fs.PathError{Op: "rename", Path: newpath, Err: ErrNotEmpty}
+	}
+	first, second := oldparent, newparent
+	if fsys.isAncestor(newparent, oldparent) {
+		first, second = newparent, oldparent
+	}
+
+	fsys.inodelocks[first].Lock()
+	defer fsys.inodelocks[first].Unlock()
+	if second != first {
+		fsys.inodelocks[second].Lock()
+		defer fsys.inodelocks[second].Unlock()
+	}
+	if number, err := fsys.lookup(oldname, oldparent); err != nil || number != workinginode {
+		return false, nil
+	}
+	if number, err := fsys.lookup(newname, newparent); (err == nil && number != target) || (err != nil && target != 0) {
+		return false, nil
+	}
+	olddisknode := fsys.ReadInode(oldparent)
+	newdisknode := fsys.ReadInode(newparent)
+	if err := checkPermission(olddisknode, cred, permWrite|permExec); err != nil {
+		return true, &fs.PathError{Op: "rename", Path: oldpath, Err: err}
+	}
+	if err := checkPermission(newdisknode, cred, permWrite|permExec); err != nil {
+		return true, &fs.PathError{Op: "rename", Path: newpath, Err: err}
+	}
+	if target == workinginode {
+		//both names are links to the same file, there is nothing to do
+		return true, nil
+	}
+
+	//the directories are locked before the files in them
+	fsys.inodelocks[workinginode].Lock()
+	defer fsys.inodelocks[workinginode].Unlock()
+	moving = fsys.ReadInode(workinginode)
+	//the .. entry of a directory changes when it gets a new parent
+	if moving.IsDirectory && oldparent != newparent {
+		if err := checkPermission(moving, cred, permWrite); err != nil {
+			return true, &fs.PathError{Op: "rename", Path: oldpath, Err: err}
+		}
+	}
+	if target != 0 {
+		if !replace {
+			return true, &fs.PathError{Op: "rename", Path: newpath, Err: ErrExist}
+		}
+		fsys.inodelocks[target].Lock()
+		defer fsys.inodelocks[target].Unlock()
+		if err := fsys.verifyRecord(target); err != nil {
+			return true, &fs.PathError{Op: "rename", Path: newpath, Err: err}
+		}
+		replaced := fsys.ReadInode(target)
+		switch {
+		case moving.IsDirectory && !replaced.IsDirectory:
+			return true, &fs.PathError{Op: "rename", Path: newpath, Err: ErrNotDir}
+		case !moving.IsDirectory && replaced.IsDirectory:
+			return true, &fs.PathError{Op: "rename", Path: newpath, Err: ErrIsDir}
+		case replaced.IsDirectory:
+			entries, err := fsys.readDir(target)
+			if err != nil {
+				return true, &fs.PathError{Op: "rename", Path: newpath, Err: err}
+			}
+			if len(entries) > 0 {
+				return true, &fs.PathError{Op: "rename", Path: newpath, Err: ErrNotEmpty}
+			}
+		}
+	}
+
+	if err := fsys.moveEntry(oldname, oldparent, newname, newparent, workinginode); err != nil {
+		return true, &fs.PathError{Op: "rename", Path: oldpath, Err: err}
+	}
+	if moving.IsDirectory && oldparent != newparent {
+		if err := fsys.setEntry("..", workinginode, newparent); err != nil {
+			return true, &fs.PathError{Op: "rename", Path: oldpath, Err: err}
+		}
+	}
+	moving = fsys.ReadInode(workinginode)
+	moving.changed()
+	fsys.WriteInode(moving)
+	//the replaced file loses the link its entry was
+	if target != 0 {
+		fsys.dropLink(target)
+	}
+	return true, nil
+}
+
+// this function moves the entry oldname for the inode workinginode from the directory at
+// oldparent to newname in the directory at newparent, replacing an entry newname already
+// has. The only step that can run out of space comes first so a failure changes nothing. The
+// caller holds the locks of both directories
+func (fsys *FileSystem) moveEntry(oldname string, oldparent int, newname string, newparent int, workinginode int) error {
+	newdisknode := fsys.ReadInode(newparent)
+	newdirectory, err := fsys.ReadDirectoryFromInode(newdisknode)
+	if err != nil {
+		return err
+	}
+	if oldparent == newparent {
+		//take out the replaced entry and rename the moved one in place
+		for i := 0; i < len(newdirectory.Filenames); i++ {
+			if newdirectory.Filenames[i] == newname {
+				newdirectory.Filenames = append(newdirectory.Filenames[:i], newdirectory.Filenames[i+1:]...)
+				newdirectory.Files = append(newdirectory.Files[:i], newdirectory.Files[i+1:]...)
+				i--
+			}
+		}
+		for i := range newdirectory.Filenames {
+			if newdirectory.Filenames[i] == oldname {
+				newdirectory.Filenames[i] = newname
+			}
+		}
+		newdisknode, err = fsys.WriteDirectoryToInode(newdirectory, newdisknode)
+		if err != nil {
+			return err
+		}
+		newdisknode.modified()
+		fsys.WriteInode(newdisknode)
+		return nil
+	}
+
+	replaced := false
+	for i := range newdirectory.Filenames {
+		if newdirectory.Filenames[i] == newname {
+			newdirectory.Files[i] = workinginode
+			replaced = true
+		}
+	}
+	if !replaced {
+		newdirectory.Filenames = append(newdirectory.Filenames, newname)
+		newdirectory.Files = append(newdirectory.Files, workinginode)
+	}
+	newdisknode, err = fsys.WriteDirectoryToInode(newdirectory, newdisknode)
+	if err != nil {
+		return err
+	}
+	newdisknode.modified()
+	fsys.WriteInode(newdisknode)
+
+	//the old directory only shrinks so its existing blocks are enough
+	olddisknode := fsys.ReadInode(oldparent)
+	olddirectory, err := fsys.ReadDirectoryFromInode(olddisknode)
+	if err != nil {
+		return err
+	}
+	for i := range olddirectory.Filenames {
+		if olddirectory.Filenames[i] == oldname {
+			olddirectory.Filenames = append(olddirectory.Filenames[:i], olddirectory.Filenames[i+1:]...)
+			olddirectory.Files = append(olddirectory.Files[:i], olddirectory.Files[i+1:]...)
+			break
+		}
+	}
+	olddisknode, err = fsys.WriteDirectoryToInode(olddirectory, olddisknode)
+	if err != nil {
+		return err
+	}
+	olddisknode.modified()
+	fsys.WriteInode(olddisknode)
+	return nil
+}
+
+// this function points the entry filename of the directory at searchnode at the inode number,
+// the caller holds the lock of the directory
+func (fsys *FileSystem) setEntry(filename string, searchnode int, number int) error {
+	disknode := fsys.ReadInode(searchnode)
+	workingdirectory, err := fsys.ReadDirectoryFromInode(disknode)
+	if err != nil {
+		return err
+	}
+	for i := range workingdirectory.Filenames {
+		if workingdirectory.Filenames[i] == filename {
+			workingdirectory.Files[i] = number
+		}
+	}
+	disknode, err = fsys.WriteDirectoryToInode(workingdirectory, disknode)
+	if err != nil {
+		return err
+	}
+	disknode.modified()
+	fsys.WriteInode(disknode)
+	return nil
+}
+
+// this function says if the directory at ancestor is the directory at number or one of the
+// directories above it, found by following the .. entries up to the root directory
+func (fsys *FileSystem) isAncestor(ancestor int, number int) bool {
+	current := number
+	for i := 0; i < fsys.superblock.Numberofinodes; i++ {
+		if current == ancestor {
+			return true
+		}
+		if current == RootInode {
+			return false
+		}
+		parent, err := fsys.findFile("..", current)
+		if err != nil {
+			return false
+		}
+		current = parent
+	}
+	return false
+}
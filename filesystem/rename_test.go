@@ -0,0 +1,78 @@
+package filesystem
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestRename(t *testing.T) {
+	fsys := newDisk(t, Options{})
+	for _, dir := range []string{"/a", "/a/b", "/c", "/e", "/g", "/p", "/p/q"} {
+		if err := fsys.Mkdir(dir, RootInode, RootCred); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeFile(t, fsys, "/a/x", []byte("hello"))
+	writeFile(t, fsys, "/c/w", nil)
+	writeFile(t, fsys, "/e/f", nil)
+	writeFile(t, fsys, "/p/q/r", nil)
+
+	if err := fsys.Rename("/a/x", "/a/y", RootInode, RootCred, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := fsys.Rename("/a/y", "/c/z", RootInode, RootCred, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := fsys.Rename("/c/z", "/c/w", RootInode, RootCred, false); !errors.Is(err, ErrExist) {
+		t.Fatal(err)
+	}
+	if err := fsys.Rename("/c/z", "/c/w", RootInode, RootCred, true); err != nil {
+		t.Fatal(err)
+	}
+	if string(readFile(t, fsys, "/c/w")) != "hello" {
+		t.Fatal("content moved wrong")
+	}
+	if _, err := fsys.Stat("/a/y", RootInode, RootCred); !errors.Is(err, ErrNotExist) {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		from, to string
+		want     error
+	}{
+		{"/a", "/a/b/q", ErrInvalid},
+		{"/a", "/a/b", ErrInvalid},
+		{"/a/b", "/c/w", ErrNotDir},
+		{"/c/w", "/a", ErrIsDir},
+		{"/a/b", "/e", ErrNotEmpty},
+		{"/p/q/r", "/p", ErrNotEmpty},
+		{"/nope", "/x", ErrNotExist},
+	} {
+		if err := fsys.Rename(c.from, c.to, RootInode, RootCred, true); !errors.Is(err, c.want) {
+			t.Errorf("%s to %s: %v, want %v", c.from, c.to, err, c.want)
+		}
+	}
+	if err := fsys.Rename("/c/w", "/w", RootInode, Cred{Uid: 5, Gid: 5}, false); !errors.Is(err, ErrPermission) {
+		t.Fatal(err)
+	}
+
+	//a moved directory gets a new .. entry
+	if err := fsys.Rename("/a/b", "/c/b", RootInode, RootCred, false); err != nil {
+		t.Fatal(err)
+	}
+	c, _ := fsys.ResolvePath("/c", RootInode, RootCred)
+	if up, err := fsys.ResolvePath("/c/b/..", RootInode, RootCred); err != nil || up != c {
+		t.Fatal(up, c, err)
+	}
+	if err := fsys.Rename("/c/b", "/g", RootInode, RootCred, true); err != nil {
+		t.Fatal(err)
+	}
+	//two names of one file
+	if err := fsys.Link("/c/w", "/c/w2", RootInode, RootCred); err != nil {
+		t.Fatal(err)
+	}
+	if err := fsys.Rename("/c/w", "/c/w2", RootInode, RootCred, true); err != nil {
+		t.Fatal(err)
+	}
+	checkClean(t, fsys)
+}
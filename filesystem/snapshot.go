@@ -0,0 +1,300 @@
+package filesystem
+
+import (
+	"fmt"
+	"io/fs"
+	"strings"
+	"sync"
+	"time"
+)
+
+// this is the longest name a snapshot can have
+const Snapshotnamelength = 32
+
+// this is one snapshot in the snapshot list, table isn't in the inode table, its content is the
+// inode table the snapshot was taken of
+type snapshot struct {
+	name  string
+	taken time.Time
+	table Inode
+}
+
+// this describes one snapshot, ListSnapshots returns them
+type SnapshotInfo struct {
+	Name  string
+	Taken time.Time
+}
+
+// this function takes a read-only snapshot named name of the root directory and everything
+// beneath it. The snapshot shares every block with the live tree, a block is only copied when
+// one of them writes it, so taking one only costs the blocks of a copy of the inode table.
+// Nothing else runs while the snapshot is taken
+func (fsys *FileSystem) Snapshot(name string) (err error) {
+	if err := checkSnapshotName(name); err != nil {
+		return &fs.PathError{Op: "snapshot", Path: name, Err: err}
+	}
+	fsys.disklock.Lock()
+	defer fsys.disklock.Unlock()
+	defer fsys.commitExclusive(&err)
+	snapshots, err := fsys.readSnapshots()
+	if err != nil {
+		return err
+	}
+	if findSnapshot(snapshots, name) >= 0 {
+		return &fs.PathError{Op: "snapshot", Path: name, Err: ErrExist}
+	}
+
+	//record 0 is left empty, inode 0 of the live disk holds the snapshot list
+	table := make([]byte, len(fsys.Inodes)*Inodesize)
+	for i := RootInode; i < len(fsys.Inodes); i++ {
+		encodeInode(fsys.Inodes[i], table[i*Inodesize:])
+	}
+	snapshots = append(snapshots, snapshot{name: name, taken: time.Now()})
+	//check there is room for the table and the longer list first so a full disk changes nothing
+	pointersPerBlock := pointersPerBlock(fsys.ReadSuperblock())
+	need := blocksToGrow(0, fsys.blocksFor(int64(len(table))), pointersPerBlock) +
+		blocksToGrow(len(fsys.inodeBlocks(fsys.Inodes[0])), fsys.blocksFor(int64(len(snapshots)*snapshotRecordSize)), pointersPerBlock)
+	fsys.allocator.Lock()
+	free := fsys.freeBlocks()
+	fsys.allocator.Unlock()
+	if free < need {
+		return &fs.PathError{Op: "snapshot", Path: name, Err: ErrNoSpace}
+	}
+	if snapshots[len(snapshots)-1].table, err = fsys.writeTable(Inode{}, table); err != nil {
+		return &fs.PathError{Op: "snapshot", Path: name, Err: err}
+	}
+	if err := fsys.writeSnapshots(snapshots); err != nil {
+		return &fs.PathError{Op: "snapshot", Path: name, Err: err}
+	}
+
+	//the copies of the inodes point at the same blocks as the inodes
+	fsys.allocator.Lock()
+	defer fsys.allocator.Unlock()
+	for _, inode := range fsys.Inodes[RootInode:] {
+		if inode.IsValid {
+			fsys.shareInodeBlocks(inode)
+		}
+	}
+	return nil
+}
+
+// this function lists the snapshots in the order they were taken
+func (fsys *FileSystem) ListSnapshots() ([]SnapshotInfo, error) {
+	fsys.disklock.RLock()
+	defer fsys.disklock.RUnlock()
+	snapshots, err := fsys.readSnapshots()
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]SnapshotInfo, len(snapshots))
+	for i, s := range snapshots {
+		infos[i] = SnapshotInfo{Name: s.name, Taken: s.taken}
+	}
+	return infos, nil
+}
+
+// this function deletes the snapshot named name, the blocks only it still pointed at are freed
+func (fsys *FileSystem) DeleteSnapshot(name string) (err error) {
+	fsys.disklock.Lock()
+	defer fsys.disklock.Unlock()
+	defer fsys.commitExclusive(&err)
+	snapshots, err := fsys.readSnapshots()
+	if err != nil {
+		return err
+	}
+	i := findSnapshot(snapshots, name)
+	if i < 0 {
+		return &fs.PathError{Op: "deletesnapshot", Path: name, Err: ErrNotExist}
+	}
+	deleted := snapshots[i]
+	inodes, err := fsys.snapshotInodes(deleted)
+	if err != nil {
+		return &fs.PathError{Op: "deletesnapshot", Path: name, Err: err}
+	}
+	//the list only shrinks so this can't run out of space
+	if err := fsys.writeSnapshots(append(snapshots[:i], snapshots[i+1:]...)); err != nil {
+		return &fs.PathError{Op: "deletesnapshot", Path: name, Err: err}
+	}
+	for _, inode := range inodes[RootInode:] {
+		if inode.IsValid {
+			fsys.freeXattrs(fsys.freeInodeBlocks(inode))
+		}
+	}
+	fsys.freeInodeBlocks(deleted.table)
+	return nil
+}
+
+// this function puts the root directory and everything beneath it back the way it was when
+// the snapshot named name was taken, the snapshot itself is kept. Whatever changed since then is
+// lost and open files see the inode they were opened with as it was in the snapshot
+func (fsys *FileSystem) Rollback(name string) (err error) {
+	fsys.disklock.Lock()
+	defer fsys.disklock.Unlock()
+	defer fsys.commitExclusive(&err)
+	snapshots, err := fsys.readSnapshots()
+	if err != nil {
+		return err
+	}
+	i := findSnapshot(snapshots, name)
+	if i < 0 {
+		return &fs.PathError{Op: "rollback", Path: name, Err: ErrNotExist}
+	}
+	inodes, err := fsys.snapshotInodes(snapshots[i])
+	if err != nil {
+		return &fs.PathError{Op: "rollback", Path: name, Err: err}
+	}
+
+	//the live inodes let go of their blocks first, the snapshot still holds on to its own
+	for i := RootInode; i < len(fsys.Inodes); i++ {
+		if fsys.Inodes[i].IsValid {
+			fsys.freeXattrs(fsys.freeInodeBlocks(fsys.Inodes[i]))
+		}
+	}
+	inodebitmap := make([]bool, len(inodes))
+	inodebitmap[0] = true
+	fsys.allocator.Lock()
+	for i := RootInode; i < len(inodes); i++ {
+		inode := inodes[i]
+		inode.Inodenumber = i
+		if inode.IsValid {
+			fsys.shareInodeBlocks(inode)
+			inodebitmap[i] = true
+		} else {
+			//a file created after the snapshot was freed, open files of it must not match the next one
+			inode.Generation = fsys.Inodes[i].Generation + 1
+		}
+		fsys.WriteInode(inode)
+	}
+	fsys.allocator.Unlock()
+	fsys.AddInodeBitmapToDisk(inodebitmap)
+	return nil
+}
+
+// this function returns the snapshot named name as a read-only io/fs file system used by cred.
+// It reads the blocks of the live disk the snapshot points at, so it only stays usable until
+// the snapshot is deleted
+func (fsys *FileSystem) SnapshotFS(name string, cred Cred) (*FS, error) {
+	fsys.disklock.RLock()
+	defer fsys.disklock.RUnlock()
+	snapshots, err := fsys.readSnapshots()
+	if err != nil {
+		return nil, err
+	}
+	i := findSnapshot(snapshots, name)
+	if i < 0 {
+		return nil, &fs.PathError{Op: "snapshotfs", Path: name, Err: ErrNotExist}
+	}
+	inodes, err := fsys.snapshotInodes(snapshots[i])
+	if err != nil {
+		return nil, &fs.PathError{Op: "snapshotfs", Path: name, Err: err}
+	}
+	//nothing the live disk writes is shared with the snapshot, so the view can share its blocks
+	view := &FileSystem{
+		VirtualDisk: append([][]byte(nil), fsys.VirtualDisk...),
+		Inodes:      inodes,
+		superblock:  fsys.superblock,
+		inodelocks:  make([]sync.RWMutex, len(inodes)),
+		readonly:    true,
+		corrupt:     map[int]bool{},
+	}
+	for _, block := range fsys.corruptBlocks() {
+		view.corrupt[block] = true
+	}
+	return view.FS(cred), nil
+}
+
+// this function checks that name can name a snapshot
+func checkSnapshotName(name string) error {
+	if name == "" || strings.ContainsRune(name, 0) {
+		return ErrInvalid
+	}
+	if len(name) > Snapshotnamelength {
+		return ErrNameTooLong
+	}
+	return nil
+}
+
+// this function returns the index of the snapshot named name, -1 if there is none
+func findSnapshot(snapshots []snapshot, name string) int {
+	for i := range snapshots {
+		if snapshots[i].name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// this function reads the snapshot list from inode 0
+func (fsys *FileSystem) readSnapshots() ([]snapshot, error) {
+	data, err := fsys.readTable(fsys.Inodes[0])
+	if err != nil {
+		return nil, fmt.Errorf("reading snapshots: %w", err)
+	}
+	return decodeSnapshots(data)
+}
+
+// this function writes the snapshot list to inode 0
+func (fsys *FileSystem) writeSnapshots(snapshots []snapshot) error {
+	list, err := fsys.writeTable(fsys.Inodes[0], encodeSnapshots(snapshots))
+	if err != nil {
+		return err
+	}
+	fsys.WriteInode(list)
+	return nil
+}
+
+// this function decodes the inode table a snapshot was taken of
+func (fsys *FileSystem) snapshotInodes(s snapshot) ([]Inode, error) {
+	data, err := fsys.readTable(s.table)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) != len(fsys.Inodes)*Inodesize {
+		return nil, fmt.Errorf("%w: snapshot inode table is %d bytes, expected %d", ErrInvalid, len(data), len(fsys.Inodes)*Inodesize)
+	}
+	inodes := make([]Inode, len(fsys.Inodes))
+	for i := range inodes {
+		inodes[i] = decodeInode(data[i*Inodesize : (i+1)*Inodesize])
+	}
+	return inodes, nil
+}
+
+// this function reads the whole content of an inode that holds metadata, like the snapshot list
+func (fsys *FileSystem) readTable(inode Inode) ([]byte, error) {
+	if limit := int64(len(fsys.inodeBlocks(inode))) * int64(fsys.ReadSuperblock().Blocksize); inode.Size > limit {
+		return nil, fmt.Errorf("%w: size %d is past the %d bytes of its datablocks", ErrInvalid, inode.Size, limit)
+	}
+	data := make([]byte, inode.Size)
+	if _, err := fsys.readInodeAt(inode, data, 0); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// this function replaces the content of an inode that holds metadata with data, its blocks are
+// committed through the journal like the rest of the metadata. The returned inode has to be
+// written wherever its record is kept
+func (fsys *FileSystem) writeTable(inode Inode, data []byte) (Inode, error) {
+	inode.Size = 0
+	inode, err := fsys.writeInodeAt(inode, data, 0)
+	if err != nil {
+		return inode, err
+	}
+	if inode, err = fsys.shrinkInodeBlocks(inode, fsys.blocksFor(inode.Size)); err != nil {
+		return inode, err
+	}
+	for _, block := range fsys.inodeBlocks(inode) {
+		fsys.markDirty(block)
+	}
+	return inode, nil
+}
+
+// this function adds a reference to every block an inode points at directly, for a copy of
+// the inode that points at them too. The caller holds the allocator lock
+func (fsys *FileSystem) shareInodeBlocks(inode Inode) {
+	for _, block := range []int{inode.Datablocks[0], inode.Datablocks[1], inode.Datablocks[2], inode.Datablocks[3], inode.Indirect, inode.DoubleIndirect, inode.Xattr} {
+		if block != 0 {
+			fsys.shareBlock(block)
+		}
+	}
+}
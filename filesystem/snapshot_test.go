@@ -0,0 +1,212 @@
+package filesystem
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"sync"
+	"testing"
+)
+
+func TestSnapshots(t *testing.T) {
+	for _, o := range []Options{{}, {BlockSize: 512, Blocks: 20000, Inodes: 300}} {
+		fsys, path := remount(t, newDisk(t, o))
+		fsys.Mkdir("/d", RootInode, RootCred)
+		small := []byte("hello")
+		//the double indirect block of 512 byte blocks
+		big := bytes.Repeat([]byte("abcdefgh"), 40000)
+		writeFile(t, fsys, "/d/small", small)
+		writeFile(t, fsys, "/big", big)
+		fsys.SetXattr("/big", RootInode, RootCred, "user.a", []byte("1"))
+		if err := fsys.Snapshot("one"); err != nil {
+			t.Fatal(err)
+		}
+		checkClean(t, fsys)
+		if err := fsys.Snapshot("one"); !errors.Is(err, ErrExist) {
+			t.Fatal(err)
+		}
+
+		f, _ := fsys.OpenFile("/big", RootInode, RootCred, os.O_RDWR)
+		f.Seek(300000, io.SeekStart)
+		f.Write([]byte("ZZZZ"))
+		f.Seek(10, io.SeekStart)
+		f.Write([]byte("YY"))
+		writeFile(t, fsys, "/d/small", []byte("changed"))
+		fsys.Mkdir("/new", RootInode, RootCred)
+		fsys.SetXattr("/big", RootInode, RootCred, "user.a", []byte("2"))
+		fsys.Rename("/d/small", "/d/renamed", RootInode, RootCred, false)
+		checkClean(t, fsys)
+		if err := fsys.Snapshot("two"); err != nil {
+			t.Fatal(err)
+		}
+		fsys.Truncate("/big", RootInode, RootCred, 3000)
+		checkClean(t, fsys)
+
+		one, err := fsys.SnapshotFS("one", RootCred)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b, err := fs.ReadFile(one, "big"); err != nil || !bytes.Equal(b, big) {
+			t.Fatal("big changed in the snapshot", err)
+		}
+		if b, _ := fs.ReadFile(one, "d/small"); !bytes.Equal(b, small) {
+			t.Fatal("small changed in the snapshot", string(b))
+		}
+		if _, err := fs.Stat(one, "new"); !errors.Is(err, ErrNotExist) {
+			t.Fatal(err)
+		}
+		two, _ := fsys.SnapshotFS("two", RootCred)
+		if b, _ := fs.ReadFile(two, "big"); len(b) != len(big) || string(b[300000:300004]) != "ZZZZ" {
+			t.Fatal("big in the second snapshot")
+		}
+		if b := readFile(t, fsys, "/big"); len(b) != 3000 || string(b[10:12]) != "YY" {
+			t.Fatal("big in the live tree")
+		}
+		snapshots, _ := fsys.ListSnapshots()
+		if len(snapshots) != 2 || snapshots[0].Name != "one" || snapshots[1].Name != "two" {
+			t.Fatal(snapshots)
+		}
+
+		fsys.Unmount()
+		fsys, err = Mount(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkClean(t, fsys)
+		if err := fsys.Rollback("one"); err != nil {
+			t.Fatal(err)
+		}
+		checkClean(t, fsys)
+		if !bytes.Equal(readFile(t, fsys, "/big"), big) {
+			t.Fatal("big after rollback")
+		}
+		if v, _ := fsys.GetXattr("/big", RootInode, RootCred, "user.a"); string(v) != "1" {
+			t.Fatal("xattr after rollback", string(v))
+		}
+		//writing after a rollback leaves the snapshot alone
+		f, _ = fsys.OpenFile("/big", RootInode, RootCred, os.O_RDWR)
+		f.Write([]byte("QQ"))
+		one, _ = fsys.SnapshotFS("one", RootCred)
+		if b, _ := fs.ReadFile(one, "big"); !bytes.Equal(b, big) {
+			t.Fatal("snapshot changed by a write after rollback")
+		}
+		if err := fsys.DeleteSnapshot("two"); err != nil {
+			t.Fatal(err)
+		}
+		checkClean(t, fsys)
+		if err := fsys.DeleteSnapshot("one"); err != nil {
+			t.Fatal(err)
+		}
+		checkClean(t, fsys)
+		for block, refcount := range fsys.Refcounts {
+			if refcount > 1 {
+				t.Fatal("block still shared", block, refcount)
+			}
+		}
+		if err := fsys.DeleteSnapshot("one"); !errors.Is(err, ErrNotExist) {
+			t.Fatal(err)
+		}
+		fsys.Unmount()
+	}
+}
+
+func TestSnapshotDiskFull(t *testing.T) {
+	fsys := newDisk(t, Options{Blocks: 200})
+	writeFile(t, fsys, "/a", make([]byte, 20*1024))
+	if err := fsys.Snapshot("s"); err != nil {
+		t.Fatal(err)
+	}
+	f, _ := fsys.Create("/fill", RootInode, RootCred)
+	var err error
+	for err == nil {
+		_, err = f.Write(make([]byte, 1024))
+	}
+	free := freeCount(fsys)
+	//a shared block can't be copied so the write fails without changing anything
+	a, _ := fsys.OpenFile("/a", RootInode, RootCred, os.O_RDWR)
+	if _, err := a.Write([]byte("x")); !errors.Is(err, ErrNoSpace) {
+		t.Fatal(err)
+	}
+	if freeCount(fsys) != free {
+		t.Fatal("failed write allocated blocks")
+	}
+	checkClean(t, fsys)
+	if err := fsys.Unlink("/a", RootInode, RootCred); err != nil {
+		t.Fatal(err)
+	}
+	checkClean(t, fsys)
+	if err := fsys.DeleteSnapshot("s"); err != nil {
+		t.Fatal(err)
+	}
+	checkClean(t, fsys)
+}
+
+func TestSnapshotWhileWriting(t *testing.T) {
+	fsys := newDisk(t, Options{Inodes: 300})
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 30; i++ {
+				path := fmt.Sprintf("/f%d_%d", g, i%5)
+				f, err := fsys.Create(path, RootInode, RootCred)
+				if err != nil {
+					continue
+				}
+				f.Write(make([]byte, 1000*(i%9)))
+				fsys.SetXattr(path, RootInode, RootCred, "user.x", []byte{byte(i)})
+				if i%4 == 0 {
+					fsys.Unlink(path, RootInode, RootCred)
+				}
+			}
+		}(g)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 10; i++ {
+			name := fmt.Sprint("s", i)
+			if err := fsys.Snapshot(name); err != nil {
+				t.Error(err)
+				return
+			}
+			view, err := fsys.SnapshotFS(name, RootCred)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			fs.WalkDir(view, ".", func(path string, d fs.DirEntry, err error) error {
+				if err == nil && !d.IsDir() {
+					if _, err := fs.ReadFile(view, path); err != nil {
+						t.Error(err)
+					}
+				}
+				return nil
+			})
+			if i%3 == 2 {
+				fsys.DeleteSnapshot(fmt.Sprint("s", i-1))
+			}
+		}
+	}()
+	wg.Wait()
+	checkClean(t, fsys)
+	if err := fsys.Rollback("s0"); err != nil {
+		t.Fatal(err)
+	}
+	checkClean(t, fsys)
+
+	//a snapshot whose inode table points outside the data blocks is dropped by repair
+	snapshots, _ := fsys.readSnapshots()
+	table := snapshots[0].table
+	binary.LittleEndian.PutUint32(fsys.VirtualDisk[table.Datablocks[0]][RootInode*Inodesize+16:], 3)
+	findings, err := fsys.Fsck(true)
+	if err != nil || len(findings) == 0 || findings[0].Problem != BadSnapshot {
+		t.Fatal(findings, err)
+	}
+	checkClean(t, fsys)
+}
@@ -0,0 +1,157 @@
+package filesystem
+
+import (
+	"io/fs"
+	"time"
+)
+
+// this is everything the disk knows about a file, Sys of the fs.FileInfo from Stat, Lstat,
+// File.Stat and FS returns it
+type FileStat struct {
+	Inode int
+	//Size is the length of the content in bytes and Blocks the number of blocks it takes on
+	//the disk, counting the indirect blocks that point at the datablocks and the xattr block
+	Size   int64
+	Blocks int
+	//StoredSize is how many bytes the content takes in its datablocks, less than Size when the
+	//file is Compressed
+	StoredSize int64
+	Compressed bool
+	Mode       fs.FileMode
+	Nlink      int
+	Uid        int
+	Gid        int
+	//Changed is when the inode itself last changed, like its owner, mode or link count
+	Created  time.Time
+	Modified time.Time
+	Accessed time.Time
+	Changed  time.Time
+}
+
+// this is how old the access time may get before a read updates it even though the file didn't
+// change, reads only update it otherwise when it is older than the last change
+const accessInterval = 24 * time.Hour
+
+// this function describes the file or directory at path, following symbolic links. Relative
+// paths start at the directory at cwd and Sys of the result returns a *FileStat
+func (fsys *FileSystem) Stat(path string, cwd int, cred Cred) (fs.FileInfo, error) {
+	fsys.disklock.RLock()
+	defer fsys.disklock.RUnlock()
+	workinginode, err := fsys.resolve(path, cwd, cred)
+	if err != nil {
+		return nil, err
+	}
+	return fsys.fileInfo(lastElement(path), workinginode), nil
+}
+
+// this function is Stat, but a symbolic link at path is described itself instead of what it
+// points at
+func (fsys *FileSystem) Lstat(path string, cwd int, cred Cred) (fs.FileInfo, error) {
+	fsys.disklock.RLock()
+	defer fsys.disklock.RUnlock()
+	workinginode, err := fsys.lresolve(path, cwd, cred)
+	if err != nil {
+		return nil, err
+	}
+	return fsys.fileInfo(lastElement(path), workinginode), nil
+}
+
+// this function describes the inode at number under its lock as the file name
+func (fsys *FileSystem) fileInfo(name string, number int) fileInfo {
+	fsys.inodelocks[number].RLock()
+	defer fsys.inodelocks[number].RUnlock()
+	inode := fsys.ReadInode(number)
+	return fileInfo{name: name, stat: FileStat{
+		Inode:      inode.Inodenumber,
+		Size:       inode.Size,
+		Blocks:     fsys.blockCount(inode),
+		StoredSize: storedSize(inode),
+		Compressed: inode.IsCompressed,
+		Mode:       inodeMode(inode),
+		Nlink:      inode.Nlink,
+		Uid:        inode.Uid,
+		Gid:        inode.Gid,
+		Created:    inode.Filecreated,
+		Modified:   inode.Filemodified,
+		Accessed:   inode.Fileaccessed,
+		Changed:    inode.Filechanged,
+	}}
+}
+
+// this function returns the permission bits of the inode along with its type
+func inodeMode(inode Inode) fs.FileMode {
+	mode := fs.FileMode(inode.Mode).Perm()
+	if inode.IsDirectory {
+		mode |= fs.ModeDir
+	}
+	if inode.IsSymlink {
+		mode |= fs.ModeSymlink
+	}
+	return mode
+}
+
+// this function counts the datablocks of the inode, the indirect blocks that point at them and
+// its xattr block
+func (fsys *FileSystem) blockCount(inode Inode) int {
+	count := len(fsys.inodeBlocks(inode))
+	if inode.Xattr != 0 {
+		count++
+	}
+	if inode.Indirect != 0 {
+		count++
+	}
+	if inode.DoubleIndirect != 0 {
+		count++
+		for _, indirect := range fsys.readPointers(inode.DoubleIndirect) {
+			if indirect == 0 {
+				break
+			}
+			count++
+		}
+	}
+	return count
+}
+
+// this function records that the content of the inode changed now, which changes the inode too
+func (inode *Inode) modified() {
+	now := time.Now()
+	inode.Filemodified = now
+	inode.Filechanged = now
+}
+
+// this function records that the inode itself changed now without its content
+func (inode *Inode) changed() {
+	inode.Filechanged = time.Now()
+}
+
+// this function sets every time of a new inode to now
+func (inode *Inode) created() {
+	now := time.Now()
+	inode.Filecreated = now
+	inode.Filemodified = now
+	inode.Fileaccessed = now
+	inode.Filechanged = now
+}
+
+// this function records that the content of the inode at number was read. The access time is
+// only written when it is older than the last change or than accessInterval, so reading
+// doesn't change the disk every time, and it is committed along with the next transaction. The
+// caller holds the disk lock shared and no lock on the inode. A snapshot is never changed
+func (fsys *FileSystem) accessed(number int) {
+	if fsys.readonly {
+		return
+	}
+	fsys.inodelocks[number].Lock()
+	defer fsys.inodelocks[number].Unlock()
+	inode := fsys.ReadInode(number)
+	if !inode.IsValid {
+		return
+	}
+	now := time.Now()
+	if inode.Fileaccessed.After(inode.Filemodified) && inode.Fileaccessed.After(inode.Filechanged) &&
+		now.Sub(inode.Fileaccessed) < accessInterval {
+		return
+	}
+	inode.Fileaccessed = now
+	fsys.WriteInode(inode)
+}
@@ -0,0 +1,78 @@
+package filesystem
+
+import (
+	"io"
+	"testing"
+	"time"
+)
+
+func TestTimes(t *testing.T) {
+	fsys := newDisk(t, Options{})
+	stat := func(path string) *FileStat {
+		t.Helper()
+		fi, err := fsys.Lstat(path, RootInode, RootCred)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fi.Sys().(*FileStat)
+	}
+	f, _ := fsys.Create("/f", RootInode, RootCred)
+	s0 := stat("/f")
+	if s0.Modified.Before(s0.Created) || s0.Nlink != 1 {
+		t.Fatal(s0)
+	}
+	time.Sleep(2 * time.Millisecond)
+	f.Write(make([]byte, 5000))
+	s1 := stat("/f")
+	if !s1.Modified.After(s0.Modified) || !s1.Changed.After(s0.Changed) || !s1.Accessed.Equal(s0.Accessed) {
+		t.Fatal("write:", s0, s1)
+	}
+	//four direct blocks and an indirect block for the fifth
+	if s1.Size != 5000 || s1.Blocks != 6 {
+		t.Fatal(s1.Size, s1.Blocks)
+	}
+	time.Sleep(2 * time.Millisecond)
+	f.Seek(0, io.SeekStart)
+	f.Read(make([]byte, 10))
+	s2 := stat("/f")
+	if !s2.Accessed.After(s1.Accessed) || !s2.Modified.Equal(s1.Modified) {
+		t.Fatal("read:", s1, s2)
+	}
+	//a second read doesn't write the inode again
+	f.Read(make([]byte, 10))
+	if s3 := stat("/f"); !s3.Accessed.Equal(s2.Accessed) {
+		t.Fatal("second read:", s2, s3)
+	}
+	time.Sleep(2 * time.Millisecond)
+	fsys.Chmod("/f", RootInode, RootCred, 0600)
+	s4 := stat("/f")
+	if !s4.Changed.After(s2.Changed) || !s4.Modified.Equal(s2.Modified) {
+		t.Fatal("chmod:", s2, s4)
+	}
+	fsys.Link("/f", "/g", RootInode, RootCred)
+	if s5 := stat("/f"); s5.Nlink != 2 {
+		t.Fatal(s5.Nlink)
+	}
+	d0 := stat("/")
+	time.Sleep(2 * time.Millisecond)
+	fsys.Rename("/g", "/h", RootInode, RootCred, false)
+	if d1 := stat("/"); !d1.Modified.After(d0.Modified) {
+		t.Fatal("rename:", d0, d1)
+	}
+
+	//the double indirect block of a big file is counted
+	writeFile(t, fsys, "/big", make([]byte, 1024*300))
+	if s := stat("/big"); s.Blocks != 300+2+1 {
+		t.Fatal(s.Blocks)
+	}
+	fsys.Symlink("/f", "/l", RootInode, RootCred)
+	if s := stat("/l"); s.Size != 2 || s.Mode&0777 != 0777 {
+		t.Fatal(s)
+	}
+
+	s6 := stat("/f")
+	fsys, _ = remount(t, fsys)
+	if s := stat("/f"); !s.Accessed.Equal(s6.Accessed) || !s.Changed.Equal(s6.Changed) || !s.Created.Equal(s6.Created) {
+		t.Fatal("after mount:", s6, s)
+	}
+}
@@ -0,0 +1,116 @@
+package filesystem
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+)
+
+// this test runs many operations at once on one disk, it is meant to be run with -race
+func TestStress(t *testing.T) {
+	for _, mounted := range []bool{false, true} {
+		fsys := newDisk(t, Options{Inodes: 512})
+		path := ""
+		if mounted {
+			fsys, path = remount(t, fsys)
+		}
+		var wg sync.WaitGroup
+		for g := 0; g < 8; g++ {
+			wg.Add(1)
+			go func(g int) {
+				defer wg.Done()
+				dir := fmt.Sprintf("/d%d", g)
+				if err := fsys.Mkdir(dir, RootInode, RootCred); err != nil {
+					t.Error(err)
+					return
+				}
+				for i := 0; i < 20; i++ {
+					name := fmt.Sprintf("%s/f%d", dir, i)
+					f, err := fsys.Create(name, RootInode, RootCred)
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					data := bytes.Repeat([]byte{byte(g), byte(i)}, 700*(i%4+1))
+					if _, err := f.Write(data); err != nil {
+						t.Error(err)
+						return
+					}
+					f.Seek(0, io.SeekStart)
+					if b, err := io.ReadAll(f); err != nil || !bytes.Equal(b, data) {
+						t.Errorf("%s: content doesn't match: %v", name, err)
+					}
+					fsys.ReadDir("/", RootInode, RootCred)
+					fsys.ReadDir(dir, RootInode, RootCred)
+					if i%3 == 0 {
+						if err := fsys.Unlink(name, RootInode, RootCred); err != nil {
+							t.Error(err)
+						}
+					}
+					fsys.Mkdir(dir+"/sub", RootInode, RootCred)
+					fsys.Create(dir+"/sub/x", RootInode, RootCred)
+					fsys.Rmdir(dir+"/sub", RootInode, RootCred, true)
+				}
+				//every goroutine changes the same directory
+				for i := 0; i < 20; i++ {
+					fsys.Create(fmt.Sprintf("/shared%d", i%5), RootInode, RootCred)
+					fsys.Unlink(fmt.Sprintf("/shared%d", (i+g)%5), RootInode, RootCred)
+					fsys.Rename(fmt.Sprintf("/shared%d", (i+1)%5), fmt.Sprintf("%s/moved", dir), RootInode, RootCred, true)
+				}
+			}(g)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				fsys.Fsck(false)
+				fsys.ReadInodesFromDisk()
+				fsys.Sync()
+			}
+		}()
+		wg.Wait()
+		checkClean(t, fsys)
+		if err := fsys.Unmount(); err != nil {
+			t.Fatal(err)
+		}
+		if mounted {
+			again, err := Mount(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if corrupt := again.corruptBlocks(); len(corrupt) > 0 {
+				t.Fatal("corrupt blocks", corrupt)
+			}
+			checkClean(t, again)
+		}
+	}
+}
+
+func TestRenameStress(t *testing.T) {
+	fsys := newDisk(t, Options{})
+	for i := 0; i < 4; i++ {
+		fsys.Mkdir(fmt.Sprintf("/d%d", i), RootInode, RootCred)
+		fsys.Mkdir(fmt.Sprintf("/d%d/s", i), RootInode, RootCred)
+	}
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				a, b := (g+i)%4, (g+2*i+1)%4
+				fsys.Rename(fmt.Sprintf("/d%d/s", a), fmt.Sprintf("/d%d/s/d%d", b, a), RootInode, RootCred, false)
+				fsys.Rename(fmt.Sprintf("/d%d", a), fmt.Sprintf("/d%d/m", b), RootInode, RootCred, false)
+				fsys.Rename(fmt.Sprintf("/d%d/m", b), fmt.Sprintf("/d%d", a), RootInode, RootCred, false)
+				fsys.Create(fmt.Sprintf("/d%d/f%d", a, g), RootInode, RootCred)
+				fsys.Rename(fmt.Sprintf("/d%d/f%d", a, g), fmt.Sprintf("/d%d/f%d", b, g), RootInode, RootCred, true)
+				fsys.Rmdir(fmt.Sprintf("/d%d/s/x", b), RootInode, RootCred, true)
+				fsys.ReadDir(fmt.Sprintf("/d%d", b), RootInode, RootCred)
+			}
+		}(g)
+	}
+	wg.Wait()
+	checkClean(t, fsys)
+}
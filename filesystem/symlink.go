@@ -0,0 +1,86 @@
+package filesystem
+
+import (
+	"io/fs"
+)
+
+// this is the longest path a symbolic link can point at
+const Symlinklength = 1024
+
+// this function makes a symbolic link owned by cred at linkpath that points at target, relative
+// paths start at the directory at cwd. The target is kept as it is, it doesn't have to exist and
+// a relative target is resolved from the directory that holds the link
+func (fsys *FileSystem) Symlink(target string, linkpath string, cwd int, cred Cred) (err error) {
+	if target == "" {
+		return &fs.PathError{Op: "symlink", Path: linkpath, Err: ErrInvalid}
+	}
+	if len(target) > Symlinklength {
+		return &fs.PathError{Op: "symlink", Path: linkpath, Err: ErrNameTooLong}
+	}
+	fsys.beginTransaction()
+	defer fsys.endTransaction(&err)
+	searchnode, filename, err := fsys.resolveParent(linkpath, cwd, cred)
+	if err != nil {
+		return err
+	}
+
+	//the directory stays locked until the link has its target so nobody sees it empty
+	fsys.inodelocks[searchnode].Lock()
+	defer fsys.inodelocks[searchnode].Unlock()
+	if _, err := fsys.lookup(filename, searchnode); err == nil {
+		return &fs.PathError{Op: "symlink", Path: linkpath, Err: ErrExist}
+	}
+	workinginode, err := fsys.createFile(filename, searchnode, cred)
+	if err != nil {
+		return &fs.PathError{Op: "symlink", Path: linkpath, Err: err}
+	}
+	fsys.inodelocks[workinginode].Lock()
+	defer fsys.inodelocks[workinginode].Unlock()
+	inode := fsys.ReadInode(workinginode)
+	inode.IsSymlink = true
+	inode.IsCompressed = false
+	inode.Mode = symlinkMode
+	inode, err = fsys.writeInodeAt(inode, []byte(target), 0)
+	if err != nil {
+		//take the half made link out again
+		fsys.removeEntry(filename, searchnode)
+		return &fs.PathError{Op: "symlink", Path: linkpath, Err: err}
+	}
+	fsys.WriteInode(inode)
+	return nil
+}
+
+// this function returns the path the symbolic link at path points at, relative paths start at
+// the directory at cwd
+func (fsys *FileSystem) Readlink(path string, cwd int, cred Cred) (target string, err error) {
+	fsys.disklock.RLock()
+	defer fsys.disklock.RUnlock()
+	workinginode, err := fsys.lresolve(path, cwd, cred)
+	if err != nil {
+		return "", err
+	}
+	if !fsys.readLocked(workinginode).IsSymlink {
+		return "", &fs.PathError{Op: "readlink", Path: path, Err: ErrInvalid}
+	}
+	target, err = fsys.readLink(workinginode)
+	if err != nil {
+		return "", &fs.PathError{Op: "readlink", Path: path, Err: err}
+	}
+	fsys.accessed(workinginode)
+	return target, nil
+}
+
+// this function reads the target of the symbolic link at number under its lock
+func (fsys *FileSystem) readLink(number int) (string, error) {
+	fsys.inodelocks[number].RLock()
+	defer fsys.inodelocks[number].RUnlock()
+	inode := fsys.ReadInode(number)
+	if !inode.IsValid {
+		return "", ErrNotExist
+	}
+	data := make([]byte, inode.Size)
+	if n, err := fsys.readInodeAt(inode, data, 0); err != nil || n != len(data) {
+		return "", ErrInvalid
+	}
+	return string(data), nil
+}
@@ -0,0 +1,63 @@
+package filesystem
+
+import (
+	"errors"
+	"io/fs"
+	"testing"
+)
+
+func TestSymlink(t *testing.T) {
+	fsys := newDisk(t, Options{})
+	fsys.Mkdir("/a", RootInode, RootCred)
+	fsys.Mkdir("/a/b", RootInode, RootCred)
+	writeFile(t, fsys, "/a/b/x", []byte("content"))
+	for _, link := range [][2]string{{"b/x", "/a/lx"}, {"/a/b", "/lb"}, {"nowhere", "/dangle"}, {"loop2", "/loop1"}, {"loop1", "/loop2"}, {"x", "/lb/y"}} {
+		if err := fsys.Symlink(link[0], link[1], RootInode, RootCred); err != nil {
+			t.Fatal(link, err)
+		}
+	}
+	for _, name := range []string{"a/lx", "lb/x", "a/b/y"} {
+		if b, err := fsys.FS(RootCred).ReadFile(name); err != nil || string(b) != "content" {
+			t.Fatal(name, string(b), err)
+		}
+	}
+	if _, err := fsys.FS(RootCred).ReadFile("loop1"); !errors.Is(err, ErrLoop) {
+		t.Fatal(err)
+	}
+	if _, err := fsys.FS(RootCred).ReadFile("dangle"); !errors.Is(err, ErrNotExist) {
+		t.Fatal(err)
+	}
+	if target, err := fsys.Readlink("/lb", RootInode, RootCred); err != nil || target != "/a/b" {
+		t.Fatal(target, err)
+	}
+	if _, err := fsys.Readlink("/a", RootInode, RootCred); !errors.Is(err, ErrInvalid) {
+		t.Fatal(err)
+	}
+	fi, _ := fsys.Stat("/lb", RootInode, RootCred)
+	lfi, _ := fsys.Lstat("/lb", RootInode, RootCred)
+	if !fi.IsDir() || lfi.Mode().Type() != fs.ModeSymlink || lfi.Size() != 4 {
+		t.Fatal(fi.Mode(), lfi.Mode(), lfi.Size())
+	}
+
+	//creating through a link opens its target
+	f, err := fsys.Create("/a/lx", RootInode, RootCred)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("new"))
+	if string(readFile(t, fsys, "/a/b/x")) != "new" {
+		t.Fatal("target not written")
+	}
+	//removing a link leaves its target
+	if err := fsys.Unlink("/lb", RootInode, RootCred); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fsys.Stat("/a/b", RootInode, RootCred); err != nil {
+		t.Fatal(err)
+	}
+	checkClean(t, fsys)
+	if err := fsys.Rmdir("/a", RootInode, RootCred, true); err != nil {
+		t.Fatal(err)
+	}
+	checkClean(t, fsys)
+}
@@ -1,38 +1,67 @@
 package filesystem
 
 import (
-	"bytes"
-	"encoding/gob"
+	"crypto/cipher"
+	"encoding/binary"
 	"fmt"
-	"log"
+	"io/fs"
+	"os"
+	"sync"
 	"time"
 )
 
+// these are the default geometry used by InitializeDisk, a disk made by Format keeps its own
+// geometry in the superblock and everything else reads it from there
 const (
 	Blocksize      = 1024
+	Numberofblocks = 6010
 	Numberofinodes = 120
 	Filenamelength = 12
 )
 
 // this is the inode struct
 type Inode struct {
-	IsValid      bool
-	IsDirectory  bool
+	IsValid     bool
+	IsDirectory bool
+	//IsSymlink marks a symbolic link, its content is the path it points at
+	IsSymlink bool
+	//IsCompressed marks a file whose content is compressed, Size is how long the content is and
+	//Storedsize how many bytes of its datablocks the compressed content takes
+	IsCompressed bool
+	Size         int64
+	Storedsize   int64
 	Datablocks   [4]int
-	Filecreated  time.Time
-	Filemodified time.Time
+	//Indirect and DoubleIndirect are blocks of pointers that hold the datablocks after the first 4
+	Indirect       int
+	DoubleIndirect int
+	Filecreated    time.Time
+	Filemodified   time.Time
+	//Fileaccessed is when the content was last read and Filechanged when the inode itself last
+	//changed, changing the content changes both Filemodified and Filechanged
+	Fileaccessed time.Time
+	Filechanged  time.Time
 	Inodenumber  int
+	//Xattr is the block that holds the extended attributes, 0 if there are none
+	Xattr int
+	//Generation goes up every time the inode is freed, an open file that remembers a different
+	//one was removed and its inode now holds another file or none
+	Generation uint32
+	//Nlink is the number of directory entries naming the inode, a directory only ever has one
+	Nlink int
+	//Uid and Gid own the inode and Mode holds its permission bits, like 0644
+	Uid  int
+	Gid  int
+	Mode uint32
 }
 
-// this is a folder struct
+// this is a folder struct, Inode is the inode of the directory itself
 type Directory struct {
-	Filename  string
 	Inode     int
 	Files     []int
 	Filenames []string
 }
 
-// this is a file struct
+// this is a file struct, the filename isn't stored with the content, it comes from the directory
 type DirectoryEntry struct {
 	Filename string
 	Inode    int
@@ -41,124 +70,93 @@ type DirectoryEntry struct {
 
 // this is the superblock
 type SuperBlock struct {
+	Blocksize         int
+	Numberofblocks    int
+	Numberofinodes    int
 	Inodeoffset       int
-	Blockbitmapoffset int
+	Refcountoffset    int
+	Checksumoffset    int
 	Inodebitmapoffset int
 	Datablocksoffset  int
+	Journaloffset     int
+	Journalblocks     int
+	//Features holds the feature flags, like FeatureCompression
+	Features int
+	//an encrypted disk keeps what it needs to check a passphrase, the key itself is never stored
+	Kdfiterations int
+	Salt          [16]byte
+	Keycheck      [32]byte
 }
 
-// these are my globals
-var VirtualDisk [6010][1024]byte
-var BlockBitmap [6000]bool
-var InodeBitmap [120]bool
-var Inodes [120]Inode
-var EndBlockBitmap int
-var EndInodeBitmap int
-var EndInodes int
-var LastInodeBlock int
-var Nextopeninode int
-
-// this is the function that initializes the disk with a root directory, bitmaps, and 120 inodes
-func InitializeDisk() {
-	//create a new encoder
-	var encoder bytes.Buffer
-	enc := gob.NewEncoder(&encoder)
-	var inode Inode
-
-	//prepare empty Inode array of size 120
-	for i := range Inodes {
-		inode.Datablocks = [4]int{0, 0, 0, 0}
-		inode.IsDirectory = false
-		inode.IsValid = false
-		inode.Filecreated = time.Now()
-		inode.Filemodified = time.Now()
-		inode.Inodenumber = i
-		Inodes[i] = inode
-	}
-
-	//inititate second to first inode with root directory
-	Inodes[1].IsDirectory = true
-	Inodes[1].IsValid = true
-	Inodes[1].Datablocks = [4]int{9, 0, 0, 0}
-
-	//create a root directory
-	var rootdirectory Directory
-	rootdirectory.Filename = "root.dir"
-	rootdirectory.Inode = 1
-
-	//encode root directory and push it onto disk
-	err := enc.Encode(rootdirectory)
-	if err != nil {
-		log.Fatal(err)
-	}
-	//add the root directory to the disk
-	for i := range encoder.Bytes() {
-		VirtualDisk[9][i] = encoder.Bytes()[i]
-	}
-	encoder.Reset()
+// this is one disk with its own blocks, bitmaps and inode table, make one with New or Mount.
+// VirtualDisk holds the blocks, Refcounts, InodeBitmap and Inodes are kept in step with the
+// reference counts, the inode bitmap and the inode table on it so they don't have to be
+// decoded for every lookup. Refcounts has the number of pointers to every datablock, 0 for a
+// free one.
+//
+// The operations on paths and files are safe for concurrent use. The helpers that work on a
+// single inode, directory or block, like ReadInode or WriteDirectoryToInode, don't lock
+// anything and are meant for tools that have the disk to themselves
+type FileSystem struct {
+	VirtualDisk [][]byte
+	Refcounts   []int
+	InodeBitmap []bool
+	Inodes      []Inode
+	superblock  SuperBlock
+	//readonly is set for the view of a snapshot from SnapshotFS, reading doesn't touch its inodes
+	readonly bool
+
+	//disklock is held shared by every operation and exclusively while the disk is committed,
+	//checked or replaced. inodelocks guard each inode with its datablocks and allocator guards
+	//the reference counts and the inode bitmap. Directories are always locked before the
+	//inodes in them and allocator and journallock are only taken last. renamelock keeps the
+	//tree from changing shape while a rename locks two directories, it is taken before any
+	//inode lock
+	disklock    sync.RWMutex
+	inodelocks  []sync.RWMutex
+	allocator   sync.Mutex
+	journallock sync.Mutex
+	renamelock  sync.Mutex
+
+	//the journal state, backingfile is the disk image a mounted disk commits to and is nil for
+	//a disk that only lives in memory
+	backingfile *os.File
+	//aead encrypts the blocks written to the disk image, nil if the disk isn't encrypted
+	aead            cipher.AEAD
+	dirtyblocks     map[int]bool
+	dirtydata       map[int]bool
+	journalsequence uint32
+	//corrupt holds the blocks that didn't match their checksum when the disk image was
+	//mounted, it is guarded by journallock
+	corrupt map[int]bool
+}
 
-	//set all bitmaps to false
-	for i := range BlockBitmap {
-		BlockBitmap[i] = false
-	}
-	for i := range InodeBitmap {
-		InodeBitmap[i] = false
+// this function makes a new disk in memory formatted with the geometry in o
+func New(o Options) (*FileSystem, error) {
+	fsys := &FileSystem{}
+	if err := fsys.Format(o); err != nil {
+		return nil, err
 	}
+	return fsys, nil
+}
 
-	//set bitmaps for root inode and root directory
-	BlockBitmap[0] = true
-	InodeBitmap[0] = true
-	InodeBitmap[1] = true
+// this function returns how many datablocks the disk has, one for every reference count
+func numDataBlocks(superblock SuperBlock) int {
+	return superblock.Numberofblocks - superblock.Datablocksoffset
+}
 
-	//create the superblock
-	var superblock SuperBlock
-	superblock.Inodeoffset = 3
-	superblock.Blockbitmapoffset = 2
-	superblock.Inodebitmapoffset = 1
-	superblock.Datablocksoffset = 9
+// this function fills a block with zeros, a corrupt block isn't corrupt anymore after that
+func (fsys *FileSystem) clearBlock(block int) {
+	clearBytes(fsys.VirtualDisk[block])
+	fsys.forgetCorrupt(block)
+}
 
-	//encode and push the superblock onto block 0
-	err = enc.Encode(superblock)
-	if err != nil {
-		log.Fatal(err)
-	}
-	for i := range encoder.Bytes() {
-		VirtualDisk[0][i] = encoder.Bytes()[i]
-	}
-	encoder.Reset()
-
-	//change bools to bytes of both bitmaps and put them on disk
-	bitmapBytesInode := boolsToBytes(InodeBitmap[:])
-	EndInodeBitmap = len(bitmapBytesInode) - 1
-	for i := range bitmapBytesInode {
-		VirtualDisk[1][i] = bitmapBytesInode[i]
-	}
-
-	bitmapBytesBlocks := boolsToBytes(BlockBitmap[:])
-	EndBlockBitmap = len(bitmapBytesBlocks) - 1
-	for i := range bitmapBytesBlocks {
-		VirtualDisk[2][i] = bitmapBytesBlocks[i]
-	}
-
-	// encode and push the inodes onto the disk
-	var buf bytes.Buffer
-	gob.NewEncoder(&buf).Encode(Inodes)
-	data := buf.Bytes()
-	EndInodes = len(data)
-	blockSize := Blocksize
-	inodeOffset := int(superblock.Inodeoffset)
-	j := 0
-	for i := 0; i < len(data); i += blockSize {
-		blockIndex := inodeOffset + i/blockSize
-		end := i + blockSize
-		if end > len(data) {
-			end = len(data)
-		}
-		copy(VirtualDisk[blockIndex][:], data[i:end])
-		j++
-	}
-	LastInodeBlock = j
+// this is the function that initializes the disk with a root directory, bitmaps, and 120 inodes
+// using the default geometry
+func (fsys *FileSystem) InitializeDisk() error {
+	return fsys.Format(Options{})
 } // end of initialize disk
+
 // this function converts a boolean array to bytes
 // boolstobytes and bytestobools comes from https://stackoverflow.com/questions/53924984/bool-array-to-byte-array
 func boolsToBytes(t []bool) []byte {
@@ -184,525 +182,319 @@ func bytesToBools(b []byte) []bool {
 	return t
 }
 
-// this function reads the superblock by decoding it from VirtualDisk[0]
-func ReadSuperblock() SuperBlock {
-	var superblock SuperBlock
-	decoder := gob.NewDecoder(bytes.NewReader(VirtualDisk[0][:]))
-	if err := decoder.Decode(&superblock); err != nil {
-		return superblock
+// this function returns the superblock, it is decoded from VirtualDisk[0] when the disk is
+// mounted and kept from then on
+func (fsys *FileSystem) ReadSuperblock() SuperBlock {
+	return fsys.superblock
+}
+
+// this function writes the superblock to VirtualDisk[0]
+func (fsys *FileSystem) WriteSuperblock(superblock SuperBlock) error {
+	if superblock.Numberofblocks != len(fsys.VirtualDisk) || superblock.Blocksize != len(fsys.VirtualDisk[0]) {
+		return fmt.Errorf("%w: superblock geometry doesn't match the disk", ErrInvalid)
+	}
+	if superblock.Datablocksoffset >= len(fsys.VirtualDisk) {
+		return fmt.Errorf("%w: data blocks start past the end of the disk", ErrInvalid)
 	}
-	return superblock
+	copy(fsys.VirtualDisk[0][:], encodeSuperblock(superblock))
+	fsys.markDirty(0)
+	fsys.superblock = superblock
+	return nil
 }
 
-// this function reads a directory by decoding it from up to 4 data blocks
-func ReadFolder(w, x, y, z int) Directory {
-	var directory Directory
+// this function reads a directory by decoding it from its data blocks, 0 means no block
+func (fsys *FileSystem) ReadFolder(datablocks ...int) (Directory, error) {
 	var blockData []byte
 	// write relevant blocks to blockdata
-	blockData = append(blockData, VirtualDisk[w][:]...)
-	blockData = append(blockData, VirtualDisk[x][:]...)
-	blockData = append(blockData, VirtualDisk[y][:]...)
-	blockData = append(blockData, VirtualDisk[z][:]...)
+	for _, block := range datablocks {
+		if block != 0 && fsys.isCorrupt(block) {
+			return Directory{}, &CorruptError{Block: block}
+		}
+		if block != 0 {
+			blockData = append(blockData, fsys.VirtualDisk[block][:]...)
+		}
+	}
 	// decode blockdata
-	decoder := gob.NewDecoder(bytes.NewReader(blockData))
-	if err := decoder.Decode(&directory); err != nil {
-		fmt.Println("Error decoding directory:", err)
+	return decodeDirectory(blockData, fsys.ReadSuperblock().Numberofinodes)
+}
+
+// this function reads the directory stored in the datablocks of a directory inode
+func (fsys *FileSystem) ReadDirectoryFromInode(inode Inode) (Directory, error) {
+	if !inode.IsDirectory {
+		return Directory{}, ErrNotDir
+	}
+	if err := fsys.verifyInode(inode); err != nil {
+		return Directory{}, err
+	}
+	var data []byte
+	for _, block := range fsys.inodeBlocks(inode) {
+		data = append(data, fsys.VirtualDisk[block][:]...)
 	}
+	if int64(len(data)) < inode.Size {
+		return Directory{}, fmt.Errorf("decoding directory: size %d is past its datablocks", inode.Size)
+	}
+	directory, err := decodeDirectory(data[:inode.Size], fsys.ReadSuperblock().Numberofinodes)
+	directory.Inode = inode.Inodenumber
+	return directory, err
+}
 
-	return directory
+// this function finds the block and the byte offset in it where an inode record is stored
+func (fsys *FileSystem) inodeLocation(number int) (int, int) {
+	superblock := fsys.ReadSuperblock()
+	return superblock.Inodeoffset + number*Inodesize/superblock.Blocksize, number * Inodesize % superblock.Blocksize
 }
 
-// this function reads the inodes from the disk
-func ReadInodesFromDisk() [120]Inode {
-	var inodes [120]Inode
-	var blockData []byte
-	superblock := ReadSuperblock()
-	//outer loop goes from superblock offset to last inode block, inner loop goes from start to end of block
-	for i := superblock.Inodeoffset; i < superblock.Inodeoffset+LastInodeBlock; i++ {
-		for j := 0; j < Blocksize; j++ {
-			blockData = append(blockData, VirtualDisk[i][j])
-			if len(blockData) > EndInodes {
-				break
-			}
-		}
+// this function reads one inode from the inode table
+func (fsys *FileSystem) ReadInode(number int) Inode {
+	return fsys.Inodes[number]
+}
+
+// this function writes one inode record in place in the inode table
+func (fsys *FileSystem) WriteInode(inode Inode) {
+	block, offset := fsys.inodeLocation(inode.Inodenumber)
+	record := fsys.VirtualDisk[block][offset : offset+Inodesize]
+	encodeInode(inode, record)
+	fsys.markDirty(block)
+	//keep the inode as it reads back from the disk
+	fsys.Inodes[inode.Inodenumber] = decodeInode(record)
+}
+
+// this function reads the inodes from the inode table, the slice returned is a copy
+func (fsys *FileSystem) ReadInodesFromDisk() []Inode {
+	fsys.disklock.RLock()
+	defer fsys.disklock.RUnlock()
+	inodes := make([]Inode, len(fsys.Inodes))
+	for i := range inodes {
+		inodes[i] = fsys.readLocked(i)
 	}
-	//decode blockData into inodes
-	buf := bytes.NewBuffer(blockData[:])
-	gob.NewDecoder(buf).Decode(&inodes)
 	return inodes
 }
 
 // this function takes an inode struct array and writes it to the appropriate disk space
-func WriteInodesToDisk(x [120]Inode) {
-	var buf bytes.Buffer
-	j := 0
-	//encode the array
-	superblock := ReadSuperblock()
-	gob.NewEncoder(&buf).Encode(x)
-	data := buf.Bytes()
-	EndInodes = len(data)
-	blockSize := Blocksize
-	inodeOffset := int(superblock.Inodeoffset)
-	//write the encoded array to proper disk space
-	for i := 0; i < len(data); i += blockSize {
-		blockIndex := inodeOffset + i/blockSize
-		end := i + blockSize
-		if end > len(data) {
-			end = len(data)
-		}
-		copy(VirtualDisk[blockIndex][:], data[i:end])
-		j++
+func (fsys *FileSystem) WriteInodesToDisk(x []Inode) {
+	for i := range x {
+		x[i].Inodenumber = i
+		fsys.WriteInode(x[i])
 	}
-	LastInodeBlock = j
 }
 
-// this function adds the blockbitmap to the disk
-func AddBlockBitmapToDisk(x []bool) {
-	bitmapBytesBlocks := boolsToBytes(x[:])
-	EndBlockBitmap = len(bitmapBytesBlocks)
-	for i := range bitmapBytesBlocks {
-		VirtualDisk[2][i] = bitmapBytesBlocks[i]
+// this function reads a bitmap of count bits that starts at block offset and can span several blocks
+func (fsys *FileSystem) readBitmap(offset int, count int) []bool {
+	var data []byte
+	for block := offset; len(data)*8 < count; block++ {
+		data = append(data, fsys.VirtualDisk[block]...)
 	}
+	return bytesToBools(data)[:count]
 }
 
-// this function adds the inode bitmap to the disk
-func AddInodeBitmapToDisk(x []bool) {
-	bitmapBytesInode := boolsToBytes(x[:])
-	EndInodeBitmap = len(bitmapBytesInode)
-	for i := range bitmapBytesInode {
-		VirtualDisk[1][i] = bitmapBytesInode[i]
-	}
-}
-
-// this function adds an updated working directory to the disk with 4 datablocks for index
-func AddWorkingDirectoryToDisk(directory Directory, datablocks [4]int) {
-	var buf bytes.Buffer
-	enc := gob.NewEncoder(&buf)
-	if err := enc.Encode(directory); err != nil {
-		fmt.Println("Error encoding directory:", err)
-		return
-	}
-	data := buf.Bytes()
-	blockIndex := 0
-	//copy to all data blocks to the end of len(data)
-	for i := 0; i < len(data); i += Blocksize {
-		start := i
-		end := start + Blocksize
-		if end > len(data) {
-			end = len(data)
-		}
-		copy(VirtualDisk[datablocks[blockIndex]][:], data[start:end])
-		blockIndex++
-		if blockIndex >= len(datablocks) {
-			break
-		}
+// this function writes a bitmap into the blocks starting at block offset
+func (fsys *FileSystem) writeBitmap(offset int, bits []bool) {
+	data := boolsToBytes(bits)
+	for block := offset; len(data) > 0; block++ {
+		data = data[copy(fsys.VirtualDisk[block], data):]
+		fsys.markDirty(block)
 	}
 }
 
-// this function decodes a directory entry at the inode datablocks
-func DecodeDirectoryEntryFromDisk(inode Inode) DirectoryEntry {
-	var entry DirectoryEntry
-	var data []byte
-
-	// iterate through the data blocks of the inode
-	for i := 0; i < len(inode.Datablocks); i++ {
-		// if the data block is not zero
-		if inode.Datablocks[i] != 0 {
-			// Read the data from the data block
-			data = append(data, VirtualDisk[inode.Datablocks[i]][:]...)
-			// Decode the data into DirectoryEntry
-		}
-	}
-	//decode data
-	decoder := gob.NewDecoder(bytes.NewReader(data))
-	if err := decoder.Decode(&entry); err != nil {
-		log.Fatal("Error decoding directory entry:", err)
+// this function reads count reference counts from the blocks starting at block offset
+func (fsys *FileSystem) readRefcounts(offset int, count int) []int {
+	perBlock := fsys.superblock.Blocksize / 4
+	refcounts := make([]int, count)
+	for i := range refcounts {
+		refcounts[i] = int(binary.LittleEndian.Uint32(fsys.VirtualDisk[offset+i/perBlock][i%perBlock*4:]))
 	}
-	return entry
+	return refcounts
 }
 
-// this function encodes a directory entry to the disk, allocates more blocks if needed
-func EncodeDirectoryEntryToDisk(entry DirectoryEntry, inode Inode) Inode {
-	var buf bytes.Buffer
-	enc := gob.NewEncoder(&buf)
-	err := enc.Encode(entry)
-	if err != nil {
-		log.Fatal(err)
+// this function writes reference count i of Refcounts in place, the caller holds the allocator lock
+func (fsys *FileSystem) writeRefcount(i int) {
+	perBlock := fsys.superblock.Blocksize / 4
+	block := fsys.superblock.Refcountoffset + i/perBlock
+	binary.LittleEndian.PutUint32(fsys.VirtualDisk[block][i%perBlock*4:], uint32(fsys.Refcounts[i]))
+	fsys.markDirty(block)
+}
+
+// this function decodes the superblock, the reference counts, the inode bitmap and the inode
+// table from the disk into Refcounts, InodeBitmap and Inodes
+func (fsys *FileSystem) loadTables() {
+	fsys.superblock, _ = decodeSuperblock(fsys.VirtualDisk[0])
+	superblock := fsys.superblock
+	fsys.inodelocks = make([]sync.RWMutex, superblock.Numberofinodes)
+	fsys.Refcounts = fsys.readRefcounts(superblock.Refcountoffset, numDataBlocks(superblock))
+	fsys.InodeBitmap = fsys.readBitmap(superblock.Inodebitmapoffset, superblock.Numberofinodes)
+	fsys.Inodes = make([]Inode, superblock.Numberofinodes)
+	for i := range fsys.Inodes {
+		block, offset := fsys.inodeLocation(i)
+		fsys.Inodes[i] = decodeInode(fsys.VirtualDisk[block][offset : offset+Inodesize])
 	}
-	data := buf.Bytes()
+}
 
-	superblock := ReadSuperblock()
-	blockBitmap := bytesToBools(VirtualDisk[superblock.Blockbitmapoffset][:EndBlockBitmap])
+// this function reads the reference counts, with one count for every datablock. The slice
+// returned is a copy, changes only count once it is passed to AddRefcountsToDisk
+func (fsys *FileSystem) ReadRefcountsFromDisk() []int {
+	fsys.allocator.Lock()
+	defer fsys.allocator.Unlock()
+	return append([]int(nil), fsys.Refcounts...)
+}
 
-	// Calculate the number of blocks needed for the data
-	numBlocksNeeded := (len(data) + Blocksize - 1) / Blocksize
+// this function reads the inode bitmap, with one bool for every inode. The slice returned is
+// a copy, changes only count once it is passed to AddInodeBitmapToDisk
+func (fsys *FileSystem) ReadInodeBitmapFromDisk() []bool {
+	fsys.allocator.Lock()
+	defer fsys.allocator.Unlock()
+	return append([]bool(nil), fsys.InodeBitmap...)
+}
 
-	// Check if any blocks are already allocated for the inode
-	allocatedBlocks := 0
-	for _, block := range inode.Datablocks {
-		if block != 0 {
-			allocatedBlocks++
-		}
+// this function adds the reference counts to the disk
+func (fsys *FileSystem) AddRefcountsToDisk(x []int) {
+	fsys.allocator.Lock()
+	defer fsys.allocator.Unlock()
+	fsys.Refcounts = append(fsys.Refcounts[:0], x...)
+	for i := range x {
+		fsys.writeRefcount(i)
 	}
+}
 
-	// Check if the existing allocated blocks are sufficient
-	if allocatedBlocks >= numBlocksNeeded {
-		// Write data to the existing blocks
-		start := 0
-		for i := 0; i < numBlocksNeeded; i++ {
-			end := start + Blocksize
-			if end > len(data) {
-				end = len(data)
-			}
-			copy(VirtualDisk[inode.Datablocks[i]][:], data[start:end])
-			start = end
-		}
-		return inode
-	}
+// this function adds the inode bitmap to the disk
+func (fsys *FileSystem) AddInodeBitmapToDisk(x []bool) {
+	fsys.allocator.Lock()
+	defer fsys.allocator.Unlock()
+	fsys.writeBitmap(fsys.ReadSuperblock().Inodebitmapoffset, x)
+	fsys.InodeBitmap = append(fsys.InodeBitmap[:0], x...)
+}
 
-	// Allocate new blocks for the remaining data
-	freeBlocks := make([]int, 0)
-	for i := range blockBitmap {
-		if !blockBitmap[i] {
-			blockBitmap[i] = true
-			freeBlocks = append(freeBlocks, i)
-			if len(freeBlocks) == numBlocksNeeded-allocatedBlocks {
-				break
-			}
+// this function adds an updated working directory to the disk with datablocks for index
+func (fsys *FileSystem) AddWorkingDirectoryToDisk(directory Directory, datablocks []int) error {
+	data, err := encodeDirectory(directory)
+	if err != nil {
+		return err
+	}
+	blocksize := fsys.ReadSuperblock().Blocksize
+	if len(data) > len(datablocks)*blocksize {
+		return ErrNoSpace
+	}
+	//copy to all data blocks, clearing what is left after the end of data
+	for i, block := range datablocks {
+		fsys.clearBlock(block)
+		if i*blocksize < len(data) {
+			copy(fsys.VirtualDisk[block][:], data[i*blocksize:])
 		}
+		fsys.markDirty(block)
 	}
+	return nil
+}
 
-	// Check if enough free blocks are available
-	if len(freeBlocks) < numBlocksNeeded-allocatedBlocks {
-		log.Fatal("Not enough free blocks available for data")
+// this function writes an updated directory into the datablocks of its inode, allocating more
+// blocks when the directory has grown and freeing the ones it doesn't need anymore. Blocks
+// shared with a snapshot are copied first. The returned inode has to be written to the inode
+// table
+func (fsys *FileSystem) WriteDirectoryToInode(directory Directory, inode Inode) (Inode, error) {
+	size := len(directory.Files) * Direntsize
+	numBlocksNeeded := fsys.blocksFor(int64(size))
+	inode, err := fsys.prepareBlocks(inode, 0, numBlocksNeeded)
+	if err != nil {
+		return inode, err
 	}
-
-	// Update the inode with the new data blocks
-	for i := allocatedBlocks; i < numBlocksNeeded; i++ {
-		inode.Datablocks[i] = freeBlocks[i-allocatedBlocks] + superblock.Datablocksoffset
+	if inode, err = fsys.shrinkInodeBlocks(inode, numBlocksNeeded); err != nil {
+		return inode, err
 	}
-
-	// Write data to the allocated blocks
-	start := 0
-	for i := 0; i < numBlocksNeeded; i++ {
-		end := start + Blocksize
-		if end > len(data) {
-			end = len(data)
-		}
-		copy(VirtualDisk[inode.Datablocks[i]][:], data[start:end])
-		start = end
+	if err := fsys.AddWorkingDirectoryToDisk(directory, fsys.inodeBlocks(inode)); err != nil {
+		return inode, err
 	}
+	inode.Size = int64(size)
+	return inode, nil
+}
 
-	// Update block bitmap on disk
-	AddBlockBitmapToDisk(blockBitmap)
+// this function reads the file content at the inode datablocks into a directory entry
+func (fsys *FileSystem) DecodeDirectoryEntryFromDisk(inode Inode) (DirectoryEntry, error) {
+	var entry DirectoryEntry
+	entry.Inode = inode.Inodenumber
+	if inode.IsDirectory {
+		return entry, ErrIsDir
+	}
+	data := make([]byte, inode.Size)
+	n, err := fsys.readInodeAt(inode, data, 0)
+	if err != nil {
+		return entry, fmt.Errorf("decoding directory entry: %w", err)
+	}
+	if n != len(data) {
+		return entry, fmt.Errorf("decoding directory entry: size %d is past its datablocks", inode.Size)
+	}
+	entry.Fileinfo = string(data)
+	return entry, nil
+}
 
-	return inode
+// this function writes the file content of a directory entry to the disk, allocates more blocks if needed
+func (fsys *FileSystem) EncodeDirectoryEntryToDisk(entry DirectoryEntry, inode Inode) (Inode, error) {
+	//the new content replaces all of the old content, compressed or not
+	inode.Size = 0
+	inode.Storedsize = 0
+	inode, err := fsys.writeInodeAt(inode, []byte(entry.Fileinfo), 0)
+	if err != nil {
+		return inode, err
+	}
+	return fsys.shrinkInodeBlocks(inode, fsys.blocksFor(storedSize(inode)))
 }
 
-// this is the Open function with open, write, read, and append options. Takes mode, filename, and inode of
-// parent directory as arguments
-func Open(mode string, filename string, searchnode int) {
-	superblock := ReadSuperblock()
+// this is the Open function with open, write, read, and append options. Takes mode, a path, the inode of
+// the working directory relative paths start from and the caller as arguments
+func (fsys *FileSystem) Open(mode string, path string, cwd int, cred Cred) error {
 	switch mode {
 	case "open":
-		//read inodes and search for correct inode
-		inodes := ReadInodesFromDisk()
-		var disknode Inode
-		var inode Inode
-		for i := range inodes {
-			if inodes[i].Inodenumber == searchnode {
-				disknode = Inodes[i]
-				break
-			}
-		}
-		//get the datablocks for the inode
-		var datablocks [4]int
-		for i := range disknode.Datablocks {
-			datablocks[i] = disknode.Datablocks[i]
-		}
-		if datablocks[0] == 0 {
-			fmt.Println("No directory present at inode ", searchnode)
-		}
-
-		//get the workingdirectory from the inodes
-		var workingfile string
-		var workinginode int
-		var found bool
-		workingdirectory := ReadFolder(datablocks[0], datablocks[1], datablocks[2], datablocks[3])
-		for i := range workingdirectory.Filenames {
-			if workingdirectory.Filenames[i] == filename {
-				workingfile = workingdirectory.Filenames[i]
-				workinginode = workingdirectory.Files[i]
-				found = true
-				break
-			}
-		}
-		//if file found, print it out
-		if found == true {
-			fmt.Println("Found file ", workingfile, " at Inode ", workinginode)
-			//file not found, create it
-		} else {
-			if len(filename) > 12 {
-				fmt.Println("Filename exceeds maximum")
-			} else {
-				fmt.Println("Creating new file ", filename, " in working directory ", workingdirectory.Filename)
-				//create a file
-				var newfile DirectoryEntry
-				inodebitmap := bytesToBools(VirtualDisk[superblock.Inodebitmapoffset][:EndInodeBitmap])
-				newfile.Filename = filename
-				//get the first free inode
-				for i := range inodebitmap {
-					if inodebitmap[i] == false {
-						//set the inode features
-						inodebitmap[i] = true
-						newfile.Inode = i
-						inodes[i].Filecreated = time.Now()
-						inodes[i].Filemodified = time.Now()
-						inodes[i].IsDirectory = false
-						inodes[i].IsValid = true
-						//get the first free block
-						inodes[i] = EncodeDirectoryEntryToDisk(newfile, inodes[i])
-						//update the working directory
-						workingdirectory.Filenames = append(workingdirectory.Filenames, filename)
-						workingdirectory.Files = append(workingdirectory.Files, i)
-						break
-					}
-				}
-				AddInodeBitmapToDisk(inodebitmap)
-				AddWorkingDirectoryToDisk(workingdirectory, datablocks)
-				inodes[inode.Inodenumber] = inode
-				WriteInodesToDisk(inodes)
-			}
-		}
+		return fsys.open(path, cwd, cred)
 	case "write":
-		//read inodes and search for correct inode
-		inodes := ReadInodesFromDisk()
-		var disknode Inode
-		var inode Inode
-		for i := range inodes {
-			if inodes[i].Inodenumber == searchnode {
-				disknode = Inodes[i]
-				break
-			}
-		}
-		//get the datablocks for the inode
-		var datablocks [4]int
-		for i := range disknode.Datablocks {
-			datablocks[i] = disknode.Datablocks[i]
-		}
-		if datablocks[0] == 0 {
-			fmt.Println("No directory present at inode ", searchnode)
-		}
-
-		//get the workingdirectory from the inodes
-		var workingfile DirectoryEntry
-		var workinginode int
-		var found bool
-		workingdirectory := ReadFolder(datablocks[0], datablocks[1], datablocks[2], datablocks[3])
-		for i := range workingdirectory.Filenames {
-			if workingdirectory.Filenames[i] == filename {
-				workinginode = workingdirectory.Files[i]
-				found = true
-				break
-			}
-		}
-		if found == true {
-			fmt.Println("Writing to file: ", filename)
-			var info string
-			fmt.Println("Please enter a string to write to disk")
-			fmt.Scanln(&info)
-			inode = inodes[workinginode]
-			workingfile = DecodeDirectoryEntryFromDisk(inode)
-			workingfile.Fileinfo = info
-			inode = EncodeDirectoryEntryToDisk(workingfile, inode)
-			inode.Filemodified = time.Now()
-			inodes[inode.Inodenumber] = inode
-		} else {
-			fmt.Println("Could not find file")
-		}
-		WriteInodesToDisk(inodes)
+		return fsys.Write(path, cwd, cred)
 	case "read":
-		//read inodes and search for correct inode
-		inodes := ReadInodesFromDisk()
-		var disknode Inode
-		var inode Inode
-		for i := range inodes {
-			if inodes[i].Inodenumber == searchnode {
-				disknode = Inodes[i]
-				break
-			}
-		}
-		//get the datablocks for the inode
-		var datablocks [4]int
-		for i := range disknode.Datablocks {
-			datablocks[i] = disknode.Datablocks[i]
-		}
-		if datablocks[0] == 0 {
-			fmt.Println("No directory present at inode ", searchnode)
-		}
-
-		//get the workingdirectory from the inodes
-		var workingfile DirectoryEntry
-		var workinginode int
-		var found bool
-		workingdirectory := ReadFolder(datablocks[0], datablocks[1], datablocks[2], datablocks[3])
-		for i := range workingdirectory.Filenames {
-			if workingdirectory.Filenames[i] == filename {
-				workinginode = workingdirectory.Files[i]
-				found = true
-				break
-			}
-		}
-		if found == true {
-			inode = inodes[workinginode]
-			workingfile = DecodeDirectoryEntryFromDisk(inode)
-			fmt.Println("File ", workingfile.Filename, " contains info: ", workingfile.Fileinfo)
-			inode = EncodeDirectoryEntryToDisk(workingfile, inode)
-			inodes[inode.Inodenumber] = inode
-		} else {
-			fmt.Println("Could not find file")
-		}
-		WriteInodesToDisk(inodes)
+		return fsys.Read(path, cwd, cred)
 	case "append":
-		//read inodes and search for correct inode
-		fmt.Println("appending to file: ", filename)
-		inodes := ReadInodesFromDisk()
-		var disknode Inode
-		var inode Inode
-		for i := range inodes {
-			if inodes[i].Inodenumber == searchnode {
-				disknode = Inodes[i]
-				break
-			}
-		}
-		//get the datablocks for the inode
-		var datablocks [4]int
-		for i := range disknode.Datablocks {
-			datablocks[i] = disknode.Datablocks[i]
-		}
-		if datablocks[0] == 0 {
-			fmt.Println("No directory present at inode ", searchnode)
-		}
-
-		//get the workingdirectory from the inodes
-		var workingfile DirectoryEntry
-		var workinginode int
-		var found bool
-		workingdirectory := ReadFolder(datablocks[0], datablocks[1], datablocks[2], datablocks[3])
-		for i := range workingdirectory.Filenames {
-			if workingdirectory.Filenames[i] == filename {
-				workinginode = workingdirectory.Files[i]
-				found = true
-				break
-			}
-		}
-		if found == true {
-			var info string
-			fmt.Println("Please enter a string to append to disk")
-			fmt.Scanln(&info)
-			inode = inodes[workinginode]
-			workingfile = DecodeDirectoryEntryFromDisk(inode)
-			workingfile.Fileinfo = workingfile.Fileinfo + info
-			inode = EncodeDirectoryEntryToDisk(workingfile, inode)
-			inode.Filemodified = time.Now()
-			inodes[inode.Inodenumber] = inode
-		} else {
-			fmt.Println("Could not find file")
-		}
-		WriteInodesToDisk(inodes)
+		return fsys.writeInput(path, cwd, cred, true)
 	}
+	return &fs.PathError{Op: mode, Path: path, Err: ErrInvalid}
 }
 
-// this function takes a filename and the inode number of a parent directory and
-func Unlink(filename string, searchnode int) {
-	//read inodes and search for correct inode
-	inodes := ReadInodesFromDisk()
-	superblock := ReadSuperblock()
-	var disknode Inode
-	for i := range inodes {
-		if inodes[i].Inodenumber == searchnode {
-			disknode = Inodes[i]
-			break
-		}
-	}
-	//get the datablocks for the inode
-	var datablocks [4]int
-	for i := range disknode.Datablocks {
-		datablocks[i] = disknode.Datablocks[i]
-	}
-	if datablocks[0] == 0 {
-		log.Fatal("No directory present at inode ", searchnode)
-	}
-
-	//get the workingdirectory from the inodes
-	var workinginode int
-	var found bool
-	blockbitmap := bytesToBools(VirtualDisk[superblock.Blockbitmapoffset][:EndBlockBitmap])
-	inodebitmap := bytesToBools(VirtualDisk[superblock.Inodebitmapoffset][:EndInodeBitmap])
-	workingdirectory := ReadFolder(datablocks[0], datablocks[1], datablocks[2], datablocks[3])
-	for i := range workingdirectory.Filenames {
-		if workingdirectory.Filenames[i] == filename {
-			found = true
-			break
-		}
+// this function creates the file at path if it doesn't exist yet
+func (fsys *FileSystem) open(path string, cwd int, cred Cred) (err error) {
+	fsys.beginTransaction()
+	defer fsys.endTransaction(&err)
+	//find the directory that holds the file
+	searchnode, filename, err := fsys.resolveParent(path, cwd, cred)
+	if err != nil {
+		return err
 	}
-	//if found start unlinking and deleting data
-	if found == true {
-		fmt.Println("unlinking file: ", filename)
-		for i := range workingdirectory.Filenames {
-			if workingdirectory.Filenames[i] == filename {
-				workingdirectory.Filenames[i] = ""
-				workinginode = workingdirectory.Files[i]
-				workingdirectory.Files[i] = 0
-			}
-		}
-		var emptyarray [1024]byte
-		//adjust the blockbitmap
-		for i := range inodes[workinginode].Datablocks {
-			if inodes[workinginode].Datablocks[i] != 0 {
-				blockbitmap[inodes[workinginode].Datablocks[i]-superblock.Datablocksoffset] = false
-				copy(VirtualDisk[inodes[workinginode].Datablocks[i]][:], emptyarray[:])
-			}
-		}
-		//adjust the inodes
-		inodebitmap[workinginode] = false
-		inodes[workinginode].Datablocks = [4]int{0, 0, 0, 0}
-		inodes[workinginode].IsDirectory = false
-		inodes[workinginode].IsValid = false
-		AddBlockBitmapToDisk(blockbitmap)
-		AddInodeBitmapToDisk(inodebitmap)
-		WriteInodesToDisk(inodes)
-		AddWorkingDirectoryToDisk(workingdirectory, datablocks)
-	} else {
-		//file not found
-		fmt.Println("Could not find file")
+	//if the file isn't found, create it
+	if _, _, err := fsys.findOrCreateFile(filename, searchnode, cred); err != nil {
+		return &fs.PathError{Op: "open", Path: path, Err: err}
 	}
+	return nil
 }
-func Read(filename string, searchnode int) {
-	//read inodes and search for correct inode
-	inodes := ReadInodesFromDisk()
-	var disknode Inode
-	var inode Inode
-	for i := range inodes {
-		if inodes[i].Inodenumber == searchnode {
-			disknode = Inodes[i]
-			break
-		}
+
+// this function takes a path, the inode number of the working directory and the caller and removes
+// the file, its content is only freed when no other link to it is left
+func (fsys *FileSystem) Unlink(path string, cwd int, cred Cred) (err error) {
+	fsys.beginTransaction()
+	defer fsys.endTransaction(&err)
+	//find the directory that holds the file
+	searchnode, filename, err := fsys.resolveParent(path, cwd, cred)
+	if err != nil {
+		return err
 	}
-	//get the datablocks for the inode
-	var datablocks [4]int
-	for i := range disknode.Datablocks {
-		datablocks[i] = disknode.Datablocks[i]
+	fsys.inodelocks[searchnode].Lock()
+	defer fsys.inodelocks[searchnode].Unlock()
+	disknode := fsys.ReadInode(searchnode)
+	if !disknode.IsValid {
+		return &fs.PathError{Op: "unlink", Path: path, Err: ErrNotExist}
 	}
-	if datablocks[0] == 0 {
-		fmt.Println("No directory present at inode ", searchnode)
+	if err := checkPermission(disknode, cred, permWrite|permExec); err != nil {
+		return &fs.PathError{Op: "unlink", Path: path, Err: err}
 	}
 
-	//get the workingdirectory from the inodes
-	var workingfile DirectoryEntry
+	//get the workingdirectory from the inode
 	var workinginode int
 	var found bool
-	workingdirectory := ReadFolder(datablocks[0], datablocks[1], datablocks[2], datablocks[3])
+	workingdirectory, err := fsys.ReadDirectoryFromInode(disknode)
+	if err != nil {
+		return &fs.PathError{Op: "unlink", Path: path, Err: err}
+	}
 	for i := range workingdirectory.Filenames {
 		if workingdirectory.Filenames[i] == filename {
 			workinginode = workingdirectory.Files[i]
@@ -710,62 +502,114 @@ func Read(filename string, searchnode int) {
 			break
 		}
 	}
-	if found == true {
-		inode = inodes[workinginode]
-		workingfile = DecodeDirectoryEntryFromDisk(inode)
-		fmt.Println("File ", workingfile.Filename, " contains info: ", workingfile.Fileinfo)
-		inode = EncodeDirectoryEntryToDisk(workingfile, inode)
-		inodes[inode.Inodenumber] = inode
-	} else {
-		fmt.Println("Could not find file")
+	if !found {
+		return &fs.PathError{Op: "unlink", Path: path, Err: ErrNotExist}
+	}
+	fsys.inodelocks[workinginode].Lock()
+	defer fsys.inodelocks[workinginode].Unlock()
+	if fsys.ReadInode(workinginode).IsDirectory {
+		return &fs.PathError{Op: "unlink", Path: path, Err: ErrIsDir}
 	}
-	WriteInodesToDisk(inodes)
+
+	//the entry is taken out and the datablocks, the indirect blocks and the inode are freed
+	if err := fsys.removeEntry(filename, searchnode); err != nil {
+		return &fs.PathError{Op: "unlink", Path: path, Err: err}
+	}
+	return nil
 }
-func Write(filename string, searchnode int) {
-	//read inodes and search for correct inode
-	inodes := ReadInodesFromDisk()
-	var disknode Inode
-	var inode Inode
-	for i := range inodes {
-		if inodes[i].Inodenumber == searchnode {
-			disknode = Inodes[i]
-			break
+
+// this function prints the content of the file at path, relative paths start at the directory at cwd
+func (fsys *FileSystem) Read(path string, cwd int, cred Cred) (err error) {
+	fsys.disklock.RLock()
+	defer fsys.disklock.RUnlock()
+	workinginode, err := fsys.resolve(path, cwd, cred)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err == nil {
+			fsys.accessed(workinginode)
 		}
+	}()
+	fsys.inodelocks[workinginode].RLock()
+	defer fsys.inodelocks[workinginode].RUnlock()
+	inode := fsys.ReadInode(workinginode)
+	if inode.IsDirectory {
+		return &fs.PathError{Op: "read", Path: path, Err: ErrIsDir}
 	}
-	//get the datablocks for the inode
-	var datablocks [4]int
-	for i := range disknode.Datablocks {
-		datablocks[i] = disknode.Datablocks[i]
+	if err := checkPermission(inode, cred, permRead); err != nil {
+		return &fs.PathError{Op: "read", Path: path, Err: err}
 	}
-	if datablocks[0] == 0 {
-		fmt.Println("No directory present at inode ", searchnode)
+	workingfile, err := fsys.DecodeDirectoryEntryFromDisk(inode)
+	if err != nil {
+		return &fs.PathError{Op: "read", Path: path, Err: err}
 	}
+	fmt.Println("File ", path, " contains info: ", workingfile.Fileinfo)
+	return nil
+}
 
-	//get the workingdirectory from the inodes
-	var workingfile DirectoryEntry
-	var workinginode int
-	var found bool
-	workingdirectory := ReadFolder(datablocks[0], datablocks[1], datablocks[2], datablocks[3])
-	for i := range workingdirectory.Filenames {
-		if workingdirectory.Filenames[i] == filename {
-			workinginode = workingdirectory.Files[i]
-			found = true
-			break
-		}
+// this function asks for a string and writes it to the file at path, relative paths start at the directory at cwd
+func (fsys *FileSystem) Write(path string, cwd int, cred Cred) error {
+	return fsys.writeInput(path, cwd, cred, false)
+}
+
+// this function asks for a string and writes or appends it to the file at path
+func (fsys *FileSystem) writeInput(path string, cwd int, cred Cred, appending bool) (err error) {
+	op := "write"
+	if appending {
+		op = "append"
 	}
-	if found == true {
-		fmt.Println("Writing to file: ", filename)
-		var info string
-		fmt.Println("Please enter a string to write to disk")
-		fmt.Scanln(&info)
-		inode = inodes[workinginode]
-		workingfile = DecodeDirectoryEntryFromDisk(inode)
-		workingfile.Fileinfo = info
-		inode = EncodeDirectoryEntryToDisk(workingfile, inode)
-		inode.Filemodified = time.Now()
-		inodes[inode.Inodenumber] = inode
+	workinginode, err := fsys.ResolvePath(path, cwd, cred)
+	if err != nil {
+		return err
+	}
+	inode := fsys.readLocked(workinginode)
+	if inode.IsDirectory {
+		return &fs.PathError{Op: op, Path: path, Err: ErrIsDir}
+	}
+	//appending reads the old content back
+	want := uint32(permWrite)
+	if appending {
+		want |= permRead
+	}
+	if err := checkPermission(inode, cred, want); err != nil {
+		return &fs.PathError{Op: op, Path: path, Err: err}
+	}
+	generation := inode.Generation
+
+	//ask before locking anything so a slow answer doesn't hold up the disk
+	var info string
+	fmt.Println("Please enter a string to " + op + " to disk")
+	fmt.Scanln(&info)
+
+	fsys.beginTransaction()
+	defer fsys.endTransaction(&err)
+	fsys.inodelocks[workinginode].Lock()
+	defer fsys.inodelocks[workinginode].Unlock()
+	inode = fsys.ReadInode(workinginode)
+	//the file may have been removed while waiting for the answer, its inode may even hold
+	//another file by now
+	if !inode.IsValid || inode.Generation != generation {
+		return &fs.PathError{Op: op, Path: path, Err: ErrNotExist}
+	}
+	//its permissions may have changed as well
+	if err := checkPermission(inode, cred, want); err != nil {
+		return &fs.PathError{Op: op, Path: path, Err: err}
+	}
+	workingfile, err := fsys.DecodeDirectoryEntryFromDisk(inode)
+	if err != nil {
+		return &fs.PathError{Op: op, Path: path, Err: err}
+	}
+	if appending {
+		workingfile.Fileinfo = workingfile.Fileinfo + info
 	} else {
-		fmt.Println("Could not find file")
+		workingfile.Fileinfo = info
+	}
+	inode, err = fsys.EncodeDirectoryEntryToDisk(workingfile, inode)
+	if err != nil {
+		return &fs.PathError{Op: op, Path: path, Err: err}
 	}
-	WriteInodesToDisk(inodes)
+	inode.modified()
+	fsys.WriteInode(inode)
+	return nil
 }
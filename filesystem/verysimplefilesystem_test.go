@@ -0,0 +1,162 @@
+package filesystem
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// this function makes a new disk with o or fails the test
+func newDisk(t *testing.T, o Options) *FileSystem {
+	t.Helper()
+	fsys, err := New(o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fsys
+}
+
+// this function saves fsys to a new disk image and mounts it, it returns the mounted disk and
+// the path of its image
+func remount(t *testing.T, fsys *FileSystem) (*FileSystem, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "disk.img")
+	if err := fsys.Save(path); err != nil {
+		t.Fatal(err)
+	}
+	return mountPath(t, path), path
+}
+
+// this function mounts the disk image at path or fails the test
+func mountPath(t *testing.T, path string) *FileSystem {
+	t.Helper()
+	fsys, err := Mount(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fsys
+}
+
+// this function creates the file at path with data as its content
+func writeFile(t *testing.T, fsys *FileSystem, path string, data []byte) {
+	t.Helper()
+	f, err := fsys.Create(path, RootInode, RootCred)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write(data); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// this function returns the content of the file at path
+func readFile(t *testing.T, fsys *FileSystem, path string) []byte {
+	t.Helper()
+	f, err := fsys.OpenFile(path, RootInode, RootCred, os.O_RDWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// this function fails the test if Fsck finds anything wrong with fsys
+func checkClean(t *testing.T, fsys *FileSystem) {
+	t.Helper()
+	findings, err := fsys.Fsck(false)
+	if err != nil || len(findings) > 0 {
+		t.Fatal(findings, err)
+	}
+}
+
+// this function counts the free blocks of fsys
+func freeCount(fsys *FileSystem) int {
+	fsys.allocator.Lock()
+	defer fsys.allocator.Unlock()
+	return fsys.freeBlocks()
+}
+
+func TestWriteAndMount(t *testing.T) {
+	for _, o := range []Options{{}, {BlockSize: 512, Blocks: 100000, Inodes: 5000}, {BlockSize: 4096, Blocks: 300, Inodes: 30}} {
+		fsys := newDisk(t, o)
+		if err := fsys.Mkdir("/a", RootInode, RootCred); err != nil {
+			t.Fatal(err)
+		}
+		//big enough for the double indirect block of 512 byte blocks
+		data := bytes.Repeat([]byte("0123456789abcdef"), 1<<14)
+		writeFile(t, fsys, "/a/big", data)
+		if !bytes.Equal(readFile(t, fsys, "/a/big"), data) {
+			t.Fatal("content doesn't match")
+		}
+		mounted, _ := remount(t, fsys)
+		if !bytes.Equal(readFile(t, mounted, "/a/big"), data) {
+			t.Fatal("content doesn't match after mount")
+		}
+		entries, err := mounted.ReadDir("/a", RootInode, RootCred)
+		if err != nil || len(entries) != 1 || entries[0].Name != "big" {
+			t.Fatal(entries, err)
+		}
+		checkClean(t, mounted)
+		mounted.Unmount()
+	}
+}
+
+func TestInodesRunOut(t *testing.T) {
+	fsys := newDisk(t, Options{Inodes: 10})
+	var err error
+	created := 0
+	for err == nil {
+		if _, err = fsys.Create(fmt.Sprintf("/f%d", created), RootInode, RootCred); err == nil {
+			created++
+		}
+	}
+	//inode 0 is reserved and inode 1 is the root directory
+	if !errors.Is(err, ErrNoInodes) || created != 8 {
+		t.Fatal(created, err)
+	}
+	if err := fsys.Unlink("/f3", RootInode, RootCred); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fsys.Create("/again", RootInode, RootCred); err != nil {
+		t.Fatal(err)
+	}
+	checkClean(t, fsys)
+}
+
+func TestUnlinkFreesBlocks(t *testing.T) {
+	fsys := newDisk(t, Options{})
+	free := freeCount(fsys)
+	//300 blocks reach the double indirect block
+	writeFile(t, fsys, "/f", make([]byte, 300*1024))
+	if len(readFile(t, fsys, "/f")) != 300*1024 {
+		t.Fatal("content lost")
+	}
+	if err := fsys.Unlink("/f", RootInode, RootCred); err != nil {
+		t.Fatal(err)
+	}
+	if freeCount(fsys) != free {
+		t.Fatal("blocks leaked", free, freeCount(fsys))
+	}
+	if err := fsys.Unlink("/f", RootInode, RootCred); !errors.Is(err, ErrNotExist) {
+		t.Fatal(err)
+	}
+	fsys.Mkdir("/d", RootInode, RootCred)
+	if err := fsys.Unlink("/d", RootInode, RootCred); !errors.Is(err, ErrIsDir) {
+		t.Fatal(err)
+	}
+}
+
+func TestNewRejectsBadOptions(t *testing.T) {
+	for _, o := range []Options{{BlockSize: 1000}, {Blocks: 10}, {Inodes: 1}, {JournalBlocks: 1}} {
+		if _, err := New(o); !errors.Is(err, ErrInvalid) {
+			t.Errorf("%+v: %v", o, err)
+		}
+	}
+}
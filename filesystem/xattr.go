@@ -0,0 +1,184 @@
+package filesystem
+
+import (
+	"io/fs"
+	"sort"
+)
+
+// this is the longest name an extended attribute can have, all the attributes of an inode
+// together have to fit in its one xattr block
+const XattrNameLength = 255
+
+// this function sets the extended attribute name of the file or directory at path to value,
+// replacing the value it had. Relative paths start at the directory at cwd and cred needs
+// write permission on the file
+func (fsys *FileSystem) SetXattr(path string, cwd int, cred Cred, name string, value []byte) (err error) {
+	if err := checkXattrName(name); err != nil {
+		return &fs.PathError{Op: "setxattr", Path: path, Err: err}
+	}
+	return fsys.changeXattrs("setxattr", path, cwd, cred, func(attrs map[string][]byte) error {
+		attrs[name] = append([]byte{}, value...)
+		return nil
+	})
+}
+
+// this function removes the extended attribute name from the file or directory at path
+func (fsys *FileSystem) RemoveXattr(path string, cwd int, cred Cred, name string) (err error) {
+	return fsys.changeXattrs("removexattr", path, cwd, cred, func(attrs map[string][]byte) error {
+		if _, ok := attrs[name]; !ok {
+			return ErrNoAttr
+		}
+		delete(attrs, name)
+		return nil
+	})
+}
+
+// this function returns the value of the extended attribute name of the file or directory at
+// path, cred needs read permission on the file
+func (fsys *FileSystem) GetXattr(path string, cwd int, cred Cred, name string) ([]byte, error) {
+	attrs, err := fsys.readXattrsAt("getxattr", path, cwd, cred)
+	if err != nil {
+		return nil, err
+	}
+	value, ok := attrs[name]
+	if !ok {
+		return nil, &fs.PathError{Op: "getxattr", Path: path, Err: ErrNoAttr}
+	}
+	return value, nil
+}
+
+// this function returns the names of the extended attributes of the file or directory at path
+// in sorted order
+func (fsys *FileSystem) ListXattr(path string, cwd int, cred Cred) ([]string, error) {
+	attrs, err := fsys.readXattrsAt("listxattr", path, cwd, cred)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(attrs))
+	for name := range attrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// this function checks that name can be the name of an extended attribute
+func checkXattrName(name string) error {
+	if name == "" {
+		return ErrInvalid
+	}
+	if len(name) > XattrNameLength {
+		return ErrNameTooLong
+	}
+	return nil
+}
+
+// this function reads the extended attributes of the file at path after checking cred may read it
+func (fsys *FileSystem) readXattrsAt(op string, path string, cwd int, cred Cred) (map[string][]byte, error) {
+	fsys.disklock.RLock()
+	defer fsys.disklock.RUnlock()
+	workinginode, err := fsys.resolve(path, cwd, cred)
+	if err != nil {
+		return nil, err
+	}
+	fsys.inodelocks[workinginode].RLock()
+	defer fsys.inodelocks[workinginode].RUnlock()
+	inode := fsys.ReadInode(workinginode)
+	if err := checkPermission(inode, cred, permRead); err != nil {
+		return nil, &fs.PathError{Op: op, Path: path, Err: err}
+	}
+	attrs, err := fsys.readXattrs(inode)
+	if err != nil {
+		return nil, &fs.PathError{Op: op, Path: path, Err: err}
+	}
+	return attrs, nil
+}
+
+// this function runs change on the extended attributes of the file at path under its lock and
+// writes them back, after checking cred may write the file
+func (fsys *FileSystem) changeXattrs(op string, path string, cwd int, cred Cred, change func(map[string][]byte) error) (err error) {
+	fsys.beginTransaction()
+	defer fsys.endTransaction(&err)
+	workinginode, err := fsys.resolve(path, cwd, cred)
+	if err != nil {
+		return err
+	}
+	fsys.inodelocks[workinginode].Lock()
+	defer fsys.inodelocks[workinginode].Unlock()
+	inode := fsys.ReadInode(workinginode)
+	if !inode.IsValid {
+		return &fs.PathError{Op: op, Path: path, Err: ErrNotExist}
+	}
+	if err := checkPermission(inode, cred, permWrite); err != nil {
+		return &fs.PathError{Op: op, Path: path, Err: err}
+	}
+	attrs, err := fsys.readXattrs(inode)
+	if err != nil {
+		return &fs.PathError{Op: op, Path: path, Err: err}
+	}
+	if err := change(attrs); err != nil {
+		return &fs.PathError{Op: op, Path: path, Err: err}
+	}
+	inode, err = fsys.writeXattrs(inode, attrs)
+	if err != nil {
+		return &fs.PathError{Op: op, Path: path, Err: err}
+	}
+	inode.changed()
+	fsys.WriteInode(inode)
+	return nil
+}
+
+// this function decodes the extended attributes of an inode, the caller holds its lock
+func (fsys *FileSystem) readXattrs(inode Inode) (map[string][]byte, error) {
+	if inode.Xattr == 0 {
+		return map[string][]byte{}, nil
+	}
+	if !fsys.inRange(inode.Xattr) {
+		block, _ := fsys.inodeLocation(inode.Inodenumber)
+		return nil, &CorruptError{Block: block, Inode: inode.Inodenumber}
+	}
+	if fsys.isCorrupt(inode.Xattr) {
+		return nil, &CorruptError{Block: inode.Xattr, Inode: inode.Inodenumber}
+	}
+	return decodeXattrs(fsys.VirtualDisk[inode.Xattr])
+}
+
+// this function stores attrs in the xattr block of the inode, allocating the block for the
+// first attribute and freeing it with the last. The returned inode has to be written to the
+// inode table
+func (fsys *FileSystem) writeXattrs(inode Inode, attrs map[string][]byte) (Inode, error) {
+	if len(attrs) == 0 {
+		return fsys.freeXattrs(inode), nil
+	}
+	data, err := encodeXattrs(attrs, fsys.ReadSuperblock().Blocksize)
+	if err != nil {
+		return inode, err
+	}
+	//a block shared with a snapshot is copied before it changes
+	fsys.allocator.Lock()
+	if inode.Xattr == 0 {
+		inode.Xattr, err = fsys.allocateBlock()
+	} else {
+		inode.Xattr, err = fsys.ownBlock(inode.Xattr, 0)
+	}
+	fsys.allocator.Unlock()
+	if err != nil {
+		return inode, err
+	}
+	copy(fsys.VirtualDisk[inode.Xattr], data)
+	fsys.markDirty(inode.Xattr)
+	return inode, nil
+}
+
+// this function drops the reference the inode holds to its xattr block, the returned inode
+// has to be written to the inode table
+func (fsys *FileSystem) freeXattrs(inode Inode) Inode {
+	if inode.Xattr == 0 {
+		return inode
+	}
+	fsys.allocator.Lock()
+	defer fsys.allocator.Unlock()
+	fsys.freeBlock(inode.Xattr, 0)
+	inode.Xattr = 0
+	return inode
+}
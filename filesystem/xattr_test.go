@@ -0,0 +1,109 @@
+package filesystem
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestXattrs(t *testing.T) {
+	fsys := newDisk(t, Options{})
+	free := freeCount(fsys)
+	writeFile(t, fsys, "/f", []byte("x"))
+	if err := fsys.SetXattr("/f", RootInode, RootCred, "user.build", []byte("abc123")); err != nil {
+		t.Fatal(err)
+	}
+	if err := fsys.SetXattr("/f", RootInode, RootCred, "user.type", []byte("text/plain")); err != nil {
+		t.Fatal(err)
+	}
+	//the content and the xattr block
+	if used := free - freeCount(fsys); used != 2 {
+		t.Fatal(used)
+	}
+	if v, err := fsys.GetXattr("/f", RootInode, RootCred, "user.build"); err != nil || string(v) != "abc123" {
+		t.Fatal(string(v), err)
+	}
+	if _, err := fsys.GetXattr("/f", RootInode, RootCred, "nope"); !errors.Is(err, ErrNoAttr) {
+		t.Fatal(err)
+	}
+	fsys.SetXattr("/f", RootInode, RootCred, "user.build", []byte("zz"))
+	if v, _ := fsys.GetXattr("/f", RootInode, RootCred, "user.build"); string(v) != "zz" {
+		t.Fatal(string(v))
+	}
+	for _, c := range []struct {
+		name  string
+		value []byte
+		want  error
+	}{
+		{"big", make([]byte, 2000), ErrAttrTooLarge},
+		{strings.Repeat("n", 256), nil, ErrNameTooLong},
+		{"", nil, ErrInvalid},
+		{"flag", nil, nil},
+	} {
+		if err := fsys.SetXattr("/f", RootInode, RootCred, c.name, c.value); !errors.Is(err, c.want) {
+			t.Errorf("%.10s: %v, want %v", c.name, err, c.want)
+		}
+	}
+	if err := fsys.SetXattr("/f", RootInode, Cred{Uid: 9, Gid: 9}, "a", nil); !errors.Is(err, ErrPermission) {
+		t.Fatal(err)
+	}
+	if _, err := fsys.GetXattr("/f", RootInode, Cred{Uid: 9, Gid: 9}, "flag"); err != nil {
+		t.Fatal(err)
+	}
+	fsys.Mkdir("/d", RootInode, RootCred)
+	if err := fsys.SetXattr("/d", RootInode, RootCred, "k", []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+
+	fsys, _ = remount(t, fsys)
+	names, err := fsys.ListXattr("/f", RootInode, RootCred)
+	if err != nil || !reflect.DeepEqual(names, []string{"flag", "user.build", "user.type"}) {
+		t.Fatal(names, err)
+	}
+	if v, _ := fsys.GetXattr("/d", RootInode, RootCred, "k"); string(v) != "v" {
+		t.Fatal(string(v))
+	}
+	checkClean(t, fsys)
+	if err := fsys.RemoveXattr("/f", RootInode, RootCred, "user.build"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fsys.RemoveXattr("/f", RootInode, RootCred, "user.build"); !errors.Is(err, ErrNoAttr) {
+		t.Fatal(err)
+	}
+	fsys.RemoveXattr("/f", RootInode, RootCred, "user.type")
+	fsys.RemoveXattr("/f", RootInode, RootCred, "flag")
+	if fi, _ := fsys.Stat("/f", RootInode, RootCred); fi.Sys().(*FileStat).Blocks != 1 {
+		t.Fatal("xattr block kept after the last attribute")
+	}
+
+	//the attributes belong to the inode, not to one of its names
+	fsys.SetXattr("/f", RootInode, RootCred, "again", []byte("1"))
+	fsys.Link("/f", "/g", RootInode, RootCred)
+	fsys.Unlink("/f", RootInode, RootCred)
+	if v, _ := fsys.GetXattr("/g", RootInode, RootCred, "again"); string(v) != "1" {
+		t.Fatal(string(v))
+	}
+	fsys.Unlink("/g", RootInode, RootCred)
+	fsys.Rmdir("/d", RootInode, RootCred, false)
+	if freeCount(fsys) != free {
+		t.Fatal("blocks leaked", free, freeCount(fsys))
+	}
+	checkClean(t, fsys)
+}
+
+func TestFsckRepairsXattrBlock(t *testing.T) {
+	fsys := newDisk(t, Options{})
+	fsys.SetXattr("/", RootInode, RootCred, "k", []byte("v"))
+	inode := fsys.ReadInode(RootInode)
+	fsys.VirtualDisk[inode.Xattr][2] = 0xff
+	fsys.VirtualDisk[inode.Xattr][3] = 0xff
+	findings, err := fsys.Fsck(true)
+	if err != nil || len(findings) == 0 || findings[0].Problem != BadXattr || !findings[0].Repaired {
+		t.Fatal(findings, err)
+	}
+	checkClean(t, fsys)
+	if names, err := fsys.ListXattr("/", RootInode, RootCred); err != nil || len(names) != 0 {
+		t.Fatal(names, err)
+	}
+}
@@ -10,25 +10,49 @@ package main
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
+	"io/fs"
+	"net"
 	"os"
 	"os/exec"
 	"project1/filesystem"
+	"project1/ninep"
 	"strings"
+	"time"
 )
 
+// this is the host file the virtual disk is saved to and mounted from
+const diskimage = "virtualdisk.img"
+
+// this environment variable holds the passphrase of an encrypted disk image, the disk image
+// isn't encrypted if it is empty
+const passphraseEnv = "VSFS_PASSPHRASE"
+
 func main() {
-	filesystem.InitializeDisk()
-	filesystem.Open("open", "hello.txt", 1)
-	filesystem.Open("write", "hello.txt", 1)
-	filesystem.Open("read", "hello.txt", 1)
-	filesystem.Open("open", "hellur.txt", 1)
-	filesystem.Open("write", "hellur.txt", 1)
-	inodes := filesystem.ReadInodesFromDisk()
+	//everything the shell does is done as the user running it
+	cred := filesystem.Cred{Uid: os.Getuid(), Gid: os.Getgid()}
+
+	//mount the saved disk image, only initialize a new disk if there isn't one yet
+	passphrase := os.Getenv(passphraseEnv)
+	disk, err := filesystem.MountEncrypted(diskimage, passphrase)
+	if errors.Is(err, fs.ErrNotExist) {
+		disk, err = filesystem.New(filesystem.Options{Owner: cred, Passphrase: passphrase})
+	}
+	if err != nil {
+		fmt.Println("Could not mount disk image:", err)
+		os.Exit(1)
+	}
+	report(disk.Open("open", "hello.txt", filesystem.RootInode, cred))
+	report(disk.Open("write", "hello.txt", filesystem.RootInode, cred))
+	report(disk.Open("read", "hello.txt", filesystem.RootInode, cred))
+	report(disk.Open("open", "hellur.txt", filesystem.RootInode, cred))
+	report(disk.Open("write", "hellur.txt", filesystem.RootInode, cred))
+	inodes := disk.ReadInodesFromDisk()
 	fmt.Println(inodes)
-	filesystem.Unlink("hellur.txt", 1)
-	filesystem.Unlink("hello.txt", 1)
-	inodes = filesystem.ReadInodesFromDisk()
+	report(disk.Unlink("hellur.txt", filesystem.RootInode, cred))
+	report(disk.Unlink("hello.txt", filesystem.RootInode, cred))
+	inodes = disk.ReadInodesFromDisk()
 	fmt.Println(inodes)
 	//got info about bufio and strings from here https://tutorialedge.net/golang/reading-console-input-golang/
 	//create scanner
@@ -42,7 +66,76 @@ func main() {
 		switch list[0] {
 		//first case exit, exits the shell
 		case "exit":
+			//save the virtual disk so it survives a restart
+			if err := disk.Save(diskimage); err != nil {
+				fmt.Println("Could not save disk image:", err)
+			}
 			os.Exit(0)
+		//case fsck checks the virtual disk, fsck -y repairs what it finds
+		case "fsck":
+			repair := len(list) > 1 && list[1] == "-y"
+			findings, err := disk.Fsck(repair)
+			report(err)
+			for _, finding := range findings {
+				fmt.Println(finding)
+			}
+			if err == nil && len(findings) == 0 {
+				fmt.Println("no problems found")
+			}
+		//case snapshot lists the snapshots, snapshot <name> takes one and snapshot -d <name> deletes one
+		case "snapshot":
+			switch {
+			case len(list) == 1:
+				snapshots, err := disk.ListSnapshots()
+				report(err)
+				for _, snapshot := range snapshots {
+					fmt.Println(snapshot.Name, snapshot.Taken.Format(time.RFC3339))
+				}
+			case list[1] == "-d" && len(list) > 2:
+				report(disk.DeleteSnapshot(list[2]))
+			default:
+				report(disk.Snapshot(list[1]))
+			}
+		//case rollback puts the virtual disk back the way it was when a snapshot was taken
+		case "rollback":
+			if len(list) < 2 {
+				fmt.Println("Need a snapshot name")
+				break
+			}
+			report(disk.Rollback(list[1]))
+		//case compress compresses a file on the virtual disk, compress -d <path> stores it as is again
+		case "compress":
+			switch {
+			case len(list) < 2:
+				fmt.Println("Need a path")
+			case list[1] == "-d" && len(list) > 2:
+				report(disk.SetCompression(list[2], filesystem.RootInode, cred, false))
+			default:
+				report(disk.SetCompression(list[1], filesystem.RootInode, cred, true))
+			}
+		//case serve shares the virtual disk over 9P, serve tcp localhost:5640 or serve unix <socket>.
+		//Clients act as the user running the shell, serve -root lets them act as root too
+		case "serve":
+			options := ninep.Options{Identify: ninep.As(cred)}
+			if len(list) > 1 && list[1] == "-root" {
+				options.AllowRoot = true
+				list = list[1:]
+			}
+			if len(list) < 3 {
+				fmt.Println("Need a network and an address")
+				break
+			}
+			if cred.Uid == 0 && !options.AllowRoot {
+				fmt.Println("Clients act as nobody, serve -root lets them act as root")
+				options.Identify = ninep.As(ninep.Nobody)
+			}
+			l, err := net.Listen(list[1], list[2])
+			if err != nil {
+				fmt.Println(err)
+				break
+			}
+			fmt.Println("Serving the virtual disk over 9P on", l.Addr())
+			go ninep.NewServer(disk, options).Serve(l)
 		//case cd,
 		case "cd":
 			//only cd was typed
@@ -114,3 +207,10 @@ func main() {
 	}
 
 }
+
+// this function prints an error returned by the filesystem, if there is one
+func report(err error) {
+	if err != nil {
+		fmt.Println(err)
+	}
+}
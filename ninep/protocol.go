@@ -0,0 +1,436 @@
+package ninep
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// these are the 9P2000 message types, every T message is answered by the R message after it
+// or by Rerror
+const (
+	Tversion = 100 + iota
+	Rversion
+	Tauth
+	Rauth
+	Tattach
+	Rattach
+	Terror //never sent, Rerror is the only error message
+	Rerror
+	Tflush
+	Rflush
+	Twalk
+	Rwalk
+	Topen
+	Ropen
+	Tcreate
+	Rcreate
+	Tread
+	Rread
+	Twrite
+	Rwrite
+	Tclunk
+	Rclunk
+	Tremove
+	Rremove
+	Tstat
+	Rstat
+	Twstat
+	Rwstat
+)
+
+// these are the open modes of Topen and Tcreate
+const (
+	OREAD   = 0
+	OWRITE  = 1
+	ORDWR   = 2
+	OEXEC   = 3
+	OTRUNC  = 0x10
+	ORCLOSE = 0x40
+)
+
+// these are the bits of the qid type and of the mode in a stat
+const (
+	QTDIR  = 0x80
+	QTFILE = 0x00
+	DMDIR  = 0x80000000
+)
+
+const (
+	//NOTAG is the tag of Tversion and NOFID is the afid of an attach without authentication
+	NOTAG = 0xFFFF
+	NOFID = 0xFFFFFFFF
+
+	//Version is the only protocol version the server speaks
+	Version = "9P2000"
+
+	//headerSize is size[4] type[1] tag[2], and iohdrsize is the header of Rread and Twrite
+	headerSize   = 7
+	ioHeaderSize = 24
+
+	//maxWalk is the most names one Twalk can hold
+	maxWalk = 16
+)
+
+// this is the unique id the server gives every file, Path is the inode number of the file
+type Qid struct {
+	Type    uint8
+	Version uint32
+	Path    uint64
+}
+
+// this is the machine independent directory entry of 9P, it is what Tstat returns and what
+// reading a directory returns one after the other
+type Dir struct {
+	Type   uint16
+	Dev    uint32
+	Qid    Qid
+	Mode   uint32
+	Atime  uint32
+	Mtime  uint32
+	Length uint64
+	Name   string
+	Uid    string
+	Gid    string
+	Muid   string
+}
+
+// this is one message, only the fields its type uses are set
+type Fcall struct {
+	Type    uint8
+	Tag     uint16
+	Fid     uint32
+	Afid    uint32
+	Newfid  uint32
+	Msize   uint32
+	Version string
+	Oldtag  uint16
+	Ename   string
+	Qid     Qid
+	Iounit  uint32
+	Uname   string
+	Aname   string
+	Perm    uint32
+	Name    string
+	Mode    uint8
+	Wname   []string
+	Wqid    []Qid
+	Offset  uint64
+	Count   uint32
+	Data    []byte
+	Stat    []byte
+}
+
+// this error is returned for a message that is cut short or doesn't fit its size
+var errBadMessage = errors.New("malformed 9P message")
+
+// this function reads one message from r, messages bigger than msize are refused
+func ReadFcall(r io.Reader, msize uint32) (*Fcall, error) {
+	var size [4]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return nil, err
+	}
+	n := binary.LittleEndian.Uint32(size[:])
+	if n < headerSize || n > msize {
+		return nil, errBadMessage
+	}
+	message := make([]byte, n-4)
+	if _, err := io.ReadFull(r, message); err != nil {
+		return nil, err
+	}
+	return UnmarshalFcall(message)
+}
+
+// this function writes one message to w
+func WriteFcall(w io.Writer, f *Fcall) error {
+	_, err := w.Write(MarshalFcall(f))
+	return err
+}
+
+// this function decodes a message without its size field
+func UnmarshalFcall(message []byte) (*Fcall, error) {
+	d := &decoder{data: message}
+	f := &Fcall{Type: d.u8(), Tag: d.u16()}
+	switch f.Type {
+	case Tversion, Rversion:
+		f.Msize = d.u32()
+		f.Version = d.string()
+	case Tauth:
+		f.Afid = d.u32()
+		f.Uname = d.string()
+		f.Aname = d.string()
+	case Rauth, Rattach:
+		f.Qid = d.qid()
+	case Tattach:
+		f.Fid = d.u32()
+		f.Afid = d.u32()
+		f.Uname = d.string()
+		f.Aname = d.string()
+	case Rerror:
+		f.Ename = d.string()
+	case Tflush:
+		f.Oldtag = d.u16()
+	case Twalk:
+		f.Fid = d.u32()
+		f.Newfid = d.u32()
+		n := int(d.u16())
+		if n > maxWalk {
+			return nil, errBadMessage
+		}
+		for i := 0; i < n; i++ {
+			f.Wname = append(f.Wname, d.string())
+		}
+	case Rwalk:
+		n := int(d.u16())
+		if n > maxWalk {
+			return nil, errBadMessage
+		}
+		for i := 0; i < n; i++ {
+			f.Wqid = append(f.Wqid, d.qid())
+		}
+	case Topen:
+		f.Fid = d.u32()
+		f.Mode = d.u8()
+	case Ropen, Rcreate:
+		f.Qid = d.qid()
+		f.Iounit = d.u32()
+	case Tcreate:
+		f.Fid = d.u32()
+		f.Name = d.string()
+		f.Perm = d.u32()
+		f.Mode = d.u8()
+	case Tread:
+		f.Fid = d.u32()
+		f.Offset = d.u64()
+		f.Count = d.u32()
+	case Rread:
+		f.Count = d.u32()
+		f.Data = d.bytes(int(f.Count))
+	case Twrite:
+		f.Fid = d.u32()
+		f.Offset = d.u64()
+		f.Count = d.u32()
+		f.Data = d.bytes(int(f.Count))
+	case Rwrite:
+		f.Count = d.u32()
+	case Tclunk, Tremove, Tstat:
+		f.Fid = d.u32()
+	case Rstat:
+		f.Stat = d.bytes(int(d.u16()))
+	case Twstat:
+		f.Fid = d.u32()
+		f.Stat = d.bytes(int(d.u16()))
+	case Rflush, Rclunk, Rremove, Rwstat:
+	default:
+		return nil, errBadMessage
+	}
+	if d.bad || len(d.data) != 0 {
+		return nil, errBadMessage
+	}
+	return f, nil
+}
+
+// this function encodes a message along with its size field
+func MarshalFcall(f *Fcall) []byte {
+	e := &encoder{data: make([]byte, 4, 64)}
+	e.u8(f.Type)
+	e.u16(f.Tag)
+	switch f.Type {
+	case Tversion, Rversion:
+		e.u32(f.Msize)
+		e.string(f.Version)
+	case Tauth:
+		e.u32(f.Afid)
+		e.string(f.Uname)
+		e.string(f.Aname)
+	case Rauth, Rattach:
+		e.qid(f.Qid)
+	case Tattach:
+		e.u32(f.Fid)
+		e.u32(f.Afid)
+		e.string(f.Uname)
+		e.string(f.Aname)
+	case Rerror:
+		e.string(f.Ename)
+	case Tflush:
+		e.u16(f.Oldtag)
+	case Twalk:
+		e.u32(f.Fid)
+		e.u32(f.Newfid)
+		e.u16(uint16(len(f.Wname)))
+		for _, name := range f.Wname {
+			e.string(name)
+		}
+	case Rwalk:
+		e.u16(uint16(len(f.Wqid)))
+		for _, qid := range f.Wqid {
+			e.qid(qid)
+		}
+	case Topen:
+		e.u32(f.Fid)
+		e.u8(f.Mode)
+	case Ropen, Rcreate:
+		e.qid(f.Qid)
+		e.u32(f.Iounit)
+	case Tcreate:
+		e.u32(f.Fid)
+		e.string(f.Name)
+		e.u32(f.Perm)
+		e.u8(f.Mode)
+	case Tread:
+		e.u32(f.Fid)
+		e.u64(f.Offset)
+		e.u32(f.Count)
+	case Rread:
+		e.u32(uint32(len(f.Data)))
+		e.data = append(e.data, f.Data...)
+	case Twrite:
+		e.u32(f.Fid)
+		e.u64(f.Offset)
+		e.u32(uint32(len(f.Data)))
+		e.data = append(e.data, f.Data...)
+	case Rwrite:
+		e.u32(f.Count)
+	case Tclunk, Tremove, Tstat:
+		e.u32(f.Fid)
+	case Rstat:
+		e.u16(uint16(len(f.Stat)))
+		e.data = append(e.data, f.Stat...)
+	case Twstat:
+		e.u32(f.Fid)
+		e.u16(uint16(len(f.Stat)))
+		e.data = append(e.data, f.Stat...)
+	}
+	binary.LittleEndian.PutUint32(e.data, uint32(len(e.data)))
+	return e.data
+}
+
+// this function encodes a directory entry, it starts with its own size
+func MarshalDir(d Dir) []byte {
+	e := &encoder{data: make([]byte, 2, 64)}
+	e.u16(d.Type)
+	e.u32(d.Dev)
+	e.qid(d.Qid)
+	e.u32(d.Mode)
+	e.u32(d.Atime)
+	e.u32(d.Mtime)
+	e.u64(d.Length)
+	e.string(d.Name)
+	e.string(d.Uid)
+	e.string(d.Gid)
+	e.string(d.Muid)
+	binary.LittleEndian.PutUint16(e.data, uint16(len(e.data)-2))
+	return e.data
+}
+
+// this function decodes one directory entry and returns what follows it
+func UnmarshalDir(b []byte) (Dir, []byte, error) {
+	d := &decoder{data: b}
+	size := int(d.u16())
+	if d.bad || size > len(d.data) {
+		return Dir{}, nil, errBadMessage
+	}
+	rest := d.data[size:]
+	d.data = d.data[:size]
+	var dir Dir
+	dir.Type = d.u16()
+	dir.Dev = d.u32()
+	dir.Qid = d.qid()
+	dir.Mode = d.u32()
+	dir.Atime = d.u32()
+	dir.Mtime = d.u32()
+	dir.Length = d.u64()
+	dir.Name = d.string()
+	dir.Uid = d.string()
+	dir.Gid = d.string()
+	dir.Muid = d.string()
+	if d.bad || len(d.data) != 0 {
+		return Dir{}, nil, errBadMessage
+	}
+	return dir, rest, nil
+}
+
+// this appends the little-endian fields of a message
+type encoder struct {
+	data []byte
+}
+
+func (e *encoder) u8(v uint8) {
+	e.data = append(e.data, v)
+}
+
+func (e *encoder) u16(v uint16) {
+	e.data = binary.LittleEndian.AppendUint16(e.data, v)
+}
+
+func (e *encoder) u32(v uint32) {
+	e.data = binary.LittleEndian.AppendUint32(e.data, v)
+}
+
+func (e *encoder) u64(v uint64) {
+	e.data = binary.LittleEndian.AppendUint64(e.data, v)
+}
+
+func (e *encoder) string(s string) {
+	e.u16(uint16(len(s)))
+	e.data = append(e.data, s...)
+}
+
+func (e *encoder) qid(q Qid) {
+	e.u8(q.Type)
+	e.u32(q.Version)
+	e.u64(q.Path)
+}
+
+// this takes the little-endian fields of a message off the front, bad is set when a field
+// runs past the end and every field after that reads as zero
+type decoder struct {
+	data []byte
+	bad  bool
+}
+
+func (d *decoder) bytes(n int) []byte {
+	if d.bad || n > len(d.data) {
+		d.bad = true
+		return nil
+	}
+	b := d.data[:n]
+	d.data = d.data[n:]
+	return b
+}
+
+func (d *decoder) u8() uint8 {
+	if b := d.bytes(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (d *decoder) u16() uint16 {
+	if b := d.bytes(2); b != nil {
+		return binary.LittleEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (d *decoder) u32() uint32 {
+	if b := d.bytes(4); b != nil {
+		return binary.LittleEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (d *decoder) u64() uint64 {
+	if b := d.bytes(8); b != nil {
+		return binary.LittleEndian.Uint64(b)
+	}
+	return 0
+}
+
+func (d *decoder) string() string {
+	return string(d.bytes(int(d.u16())))
+}
+
+func (d *decoder) qid() Qid {
+	return Qid{Type: d.u8(), Version: d.u32(), Path: d.u64()}
+}
@@ -0,0 +1,670 @@
+// Package ninep serves a virtual disk from package filesystem over the 9P2000 protocol, so
+// any 9P client can browse and edit it. Every connection gets its own fids and its messages
+// are answered in order, connections run side by side.
+package ninep
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"project1/filesystem"
+)
+
+// this is the biggest message the server agrees to
+const maxMsize = 64 * 1024
+
+// these are the errors sent back in Rerror besides the ones from package filesystem
+var (
+	errNoVersion  = errors.New("version has not been negotiated")
+	errNoAuth     = errors.New("authentication not required")
+	errUnknownFid = errors.New("unknown fid")
+	errFidInUse   = errors.New("fid already in use")
+	errOpen       = errors.New("fid is already open")
+	errNotOpen    = errors.New("fid is not open")
+	errMode       = errors.New("bad open mode")
+	errDirOffset  = errors.New("bad offset in directory read")
+	errWstat      = errors.New("wstat can only change the name, length, mode, owner and group")
+	errUser       = errors.New("unknown user, attach with a numeric uid")
+	errRoot       = errors.New("attaching as root is not allowed")
+)
+
+// this is the user a connection acts as unless the server is told otherwise, it owns nothing
+// so it only gets what the permission bits give everyone
+var Nobody = filesystem.Cred{Uid: 65534, Gid: 65534}
+
+// these are the settings of a Server
+type Options struct {
+	//Identify picks the user a connection acts as from the user name it attaches with, an error
+	//refuses the attach. 9P2000 has no authentication so the name is whatever the client claims,
+	//nil makes every connection Nobody
+	Identify func(uname string) (filesystem.Cred, error)
+	//AllowRoot lets a connection act as uid 0, which can read and change everything on the disk
+	AllowRoot bool
+}
+
+// this is a 9P2000 server for one disk, make one with NewServer
+type Server struct {
+	fsys    *filesystem.FileSystem
+	options Options
+}
+
+// this function makes a server for the disk fsys
+func NewServer(fsys *filesystem.FileSystem, options Options) *Server {
+	if options.Identify == nil {
+		options.Identify = As(Nobody)
+	}
+	return &Server{fsys: fsys, options: options}
+}
+
+// this function returns an Identify that makes every connection act as cred, whatever user
+// name it attaches with
+func As(cred filesystem.Cred) func(string) (filesystem.Cred, error) {
+	return func(string) (filesystem.Cred, error) {
+		return cred, nil
+	}
+}
+
+// this function is an Identify that takes the user name as a numeric uid, its group is the gid
+// of the same number. Only use it where every client can be trusted to say who it is
+func NumericUser(uname string) (filesystem.Cred, error) {
+	uid, err := strconv.Atoi(uname)
+	if err != nil || uid < 0 {
+		return filesystem.Cred{}, errUser
+	}
+	return filesystem.Cred{Uid: uid, Gid: uid}, nil
+}
+
+// this function listens on network and addr, like "tcp" and "localhost:5640" or "unix" and a
+// socket path, and serves every connection until listening fails
+func (srv *Server) ListenAndServe(network string, addr string) error {
+	l, err := net.Listen(network, addr)
+	if err != nil {
+		return err
+	}
+	return srv.Serve(l)
+}
+
+// this function serves every connection accepted on l, it returns when Accept fails
+func (srv *Server) Serve(l net.Listener) error {
+	defer l.Close()
+	for {
+		rw, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go srv.ServeConn(rw)
+	}
+}
+
+// this function answers the messages on rw until the client hangs up, then closes rw and
+// every file the client left open
+func (srv *Server) ServeConn(rw io.ReadWriteCloser) error {
+	c := &conn{srv: srv, rw: rw, fids: map[uint32]*fid{}}
+	defer rw.Close()
+	defer c.clunkAll()
+	for {
+		msize := c.msize
+		if msize == 0 {
+			msize = maxMsize
+		}
+		t, err := ReadFcall(rw, msize)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		r, err := c.handle(t)
+		if err != nil {
+			r = &Fcall{Type: Rerror, Ename: err.Error()}
+		}
+		r.Tag = t.Tag
+		if err := WriteFcall(rw, r); err != nil {
+			return err
+		}
+	}
+}
+
+// this is the state of one client connection
+type conn struct {
+	srv   *Server
+	rw    io.ReadWriteCloser
+	msize uint32
+	cred  filesystem.Cred
+	fids  map[uint32]*fid
+}
+
+// this is a file the client refers to by number, path is absolute on the disk
+type fid struct {
+	path   string
+	qid    Qid
+	open   bool
+	mode   uint8
+	file   *filesystem.File
+	rclose bool
+
+	//a directory is read as its entries one after the other, dirdata is what is left of them
+	//and diroffset the offset the next read has to ask for
+	dirdata   []byte
+	diroffset uint64
+}
+
+// this function answers one T message with its R message
+func (c *conn) handle(t *Fcall) (*Fcall, error) {
+	if t.Type != Tversion && c.msize == 0 {
+		return nil, errNoVersion
+	}
+	switch t.Type {
+	case Tversion:
+		return c.version(t)
+	case Tauth:
+		return nil, errNoAuth
+	case Tattach:
+		return c.attach(t)
+	case Tflush:
+		//messages are answered in order, so the one to flush has already been answered
+		return &Fcall{Type: Rflush}, nil
+	case Twalk:
+		return c.walk(t)
+	case Topen:
+		return c.open(t)
+	case Tcreate:
+		return c.create(t)
+	case Tread:
+		return c.read(t)
+	case Twrite:
+		return c.write(t)
+	case Tclunk:
+		return c.clunk(t)
+	case Tremove:
+		return c.remove(t)
+	case Tstat:
+		return c.stat(t)
+	case Twstat:
+		return c.wstat(t)
+	}
+	return nil, errBadMessage
+}
+
+// this function agrees on the message size and protocol version, it starts a new session
+func (c *conn) version(t *Fcall) (*Fcall, error) {
+	if t.Msize < headerSize+ioHeaderSize {
+		return nil, errBadMessage
+	}
+	c.clunkAll()
+	c.msize = t.Msize
+	if c.msize > maxMsize {
+		c.msize = maxMsize
+	}
+	version := Version
+	if !strings.HasPrefix(t.Version, Version) {
+		version = "unknown"
+	}
+	return &Fcall{Type: Rversion, Msize: c.msize, Version: version}, nil
+}
+
+// this function gives the client the root directory of the disk, everything on the connection
+// is done as the user the Identify of the server picks for the user name
+func (c *conn) attach(t *Fcall) (*Fcall, error) {
+	if t.Afid != NOFID {
+		return nil, errNoAuth
+	}
+	cred, err := c.srv.options.Identify(t.Uname)
+	if err != nil {
+		return nil, err
+	}
+	if cred.Uid == 0 && !c.srv.options.AllowRoot {
+		return nil, errRoot
+	}
+	if _, ok := c.fids[t.Fid]; ok {
+		return nil, errFidInUse
+	}
+	c.cred = cred
+	dir, err := c.dir("/")
+	if err != nil {
+		return nil, err
+	}
+	c.fids[t.Fid] = &fid{path: "/", qid: dir.Qid}
+	return &Fcall{Type: Rattach, Qid: dir.Qid}, nil
+}
+
+// this function walks newfid down the names from fid, a walk that stops early returns the
+// qids it got through and leaves newfid unused
+func (c *conn) walk(t *Fcall) (*Fcall, error) {
+	f, err := c.lookup(t.Fid)
+	if err != nil {
+		return nil, err
+	}
+	if f.open {
+		return nil, errOpen
+	}
+	if _, ok := c.fids[t.Newfid]; ok && t.Newfid != t.Fid {
+		return nil, errFidInUse
+	}
+	current, qid := f.path, f.qid
+	var qids []Qid
+	for i, name := range t.Wname {
+		if qid.Type&QTDIR == 0 {
+			err = filesystem.ErrNotDir
+		} else if name == "" || name == "." || strings.Contains(name, "/") {
+			err = filesystem.ErrInvalid
+		} else {
+			//the disk resolves symbolic links on its own, so this keeps .. lexical like
+			//a client expects
+			var dir Dir
+			dir, err = c.dir(path.Join(current, name))
+			if err == nil {
+				current, qid = path.Join(current, name), dir.Qid
+			}
+		}
+		if err != nil {
+			if i == 0 {
+				return nil, err
+			}
+			return &Fcall{Type: Rwalk, Wqid: qids}, nil
+		}
+		qids = append(qids, qid)
+	}
+	c.fids[t.Newfid] = &fid{path: current, qid: qid}
+	return &Fcall{Type: Rwalk, Wqid: qids}, nil
+}
+
+// this function opens fid for reading or writing, directories can only be read
+func (c *conn) open(t *Fcall) (*Fcall, error) {
+	f, err := c.lookup(t.Fid)
+	if err != nil {
+		return nil, err
+	}
+	if f.open {
+		return nil, errOpen
+	}
+	if t.Mode&^(3|OTRUNC|ORCLOSE) != 0 {
+		return nil, errMode
+	}
+	if f.qid.Type&QTDIR != 0 {
+		if t.Mode&^ORCLOSE != OREAD {
+			return nil, filesystem.ErrIsDir
+		}
+	} else {
+		flag := os.O_RDONLY
+		switch t.Mode & 3 {
+		case OWRITE:
+			flag = os.O_WRONLY
+		case ORDWR:
+			flag = os.O_RDWR
+		}
+		file, err := c.srv.fsys.OpenFile(f.path, filesystem.RootInode, c.cred, flag)
+		if err != nil {
+			return nil, err
+		}
+		if t.Mode&OTRUNC != 0 {
+			if err := file.Truncate(0); err != nil {
+				file.Close()
+				return nil, err
+			}
+		}
+		f.file = file
+	}
+	f.open, f.mode, f.rclose = true, t.Mode&3, t.Mode&ORCLOSE != 0
+	return &Fcall{Type: Ropen, Qid: f.qid, Iounit: c.iounit()}, nil
+}
+
+// this function creates name in the directory fid and opens fid on it, DMDIR in the
+// permissions makes a directory
+func (c *conn) create(t *Fcall) (*Fcall, error) {
+	f, err := c.lookup(t.Fid)
+	if err != nil {
+		return nil, err
+	}
+	if f.open {
+		return nil, errOpen
+	}
+	if f.qid.Type&QTDIR == 0 {
+		return nil, filesystem.ErrNotDir
+	}
+	if t.Name == "" || t.Name == "." || t.Name == ".." || strings.Contains(t.Name, "/") {
+		return nil, filesystem.ErrInvalid
+	}
+	if t.Mode&^(3|OTRUNC|ORCLOSE) != 0 {
+		return nil, errMode
+	}
+	name := path.Join(f.path, t.Name)
+	if _, err := c.dir(name); err == nil {
+		return nil, filesystem.ErrExist
+	}
+	parent, err := c.dir(f.path)
+	if err != nil {
+		return nil, err
+	}
+	//the new file gets the permissions asked for limited by those of the directory
+	var file *filesystem.File
+	perm := t.Perm & (^uint32(0666) | parent.Mode&0666)
+	if t.Perm&DMDIR != 0 {
+		if t.Mode&3 != OREAD {
+			return nil, filesystem.ErrIsDir
+		}
+		perm = t.Perm & (^uint32(0777) | parent.Mode&0777)
+		err = c.srv.fsys.Mkdir(name, filesystem.RootInode, c.cred)
+	} else {
+		file, err = c.srv.fsys.Create(name, filesystem.RootInode, c.cred)
+	}
+	if err == nil {
+		err = c.srv.fsys.Chmod(name, filesystem.RootInode, c.cred, fs.FileMode(perm&0777))
+	}
+	if err != nil {
+		if file != nil {
+			file.Close()
+		}
+		return nil, err
+	}
+	dir, err := c.dir(name)
+	if err != nil {
+		if file != nil {
+			file.Close()
+		}
+		return nil, err
+	}
+	*f = fid{path: name, qid: dir.Qid, open: true, mode: t.Mode & 3, file: file, rclose: t.Mode&ORCLOSE != 0}
+	return &Fcall{Type: Rcreate, Qid: dir.Qid, Iounit: c.iounit()}, nil
+}
+
+// this function reads from an open fid, a directory returns whole entries
+func (c *conn) read(t *Fcall) (*Fcall, error) {
+	f, err := c.lookup(t.Fid)
+	if err != nil {
+		return nil, err
+	}
+	if !f.open {
+		return nil, errNotOpen
+	}
+	if f.mode == OWRITE {
+		return nil, errMode
+	}
+	count := t.Count
+	if count > c.iounit() {
+		count = c.iounit()
+	}
+	if f.qid.Type&QTDIR != 0 {
+		return c.readDir(f, t.Offset, count)
+	}
+	if _, err := f.file.Seek(int64(t.Offset), io.SeekStart); err != nil {
+		return nil, err
+	}
+	data := make([]byte, count)
+	n, err := io.ReadFull(f.file, data)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	return &Fcall{Type: Rread, Data: data[:n]}, nil
+}
+
+// this function returns the directory entries of f that fit in count bytes, reading from
+// offset 0 starts over with the entries as they are now
+func (c *conn) readDir(f *fid, offset uint64, count uint32) (*Fcall, error) {
+	if offset == 0 {
+		entries, err := c.srv.fsys.FS(c.cred).ReadDir(fsName(f.path))
+		if err != nil {
+			return nil, err
+		}
+		f.dirdata, f.diroffset = nil, 0
+		for _, entry := range entries {
+			//9P2000 has no symbolic links, an entry shows what it points at like a walk to it
+			dir, err := c.dir(path.Join(f.path, entry.Name()))
+			if err != nil {
+				continue
+			}
+			f.dirdata = append(f.dirdata, MarshalDir(dir)...)
+		}
+	}
+	if offset != f.diroffset {
+		return nil, errDirOffset
+	}
+	n := 0
+	for n < len(f.dirdata) {
+		size := 2 + int(binary.LittleEndian.Uint16(f.dirdata[n:]))
+		if n+size > int(count) {
+			break
+		}
+		n += size
+	}
+	data := f.dirdata[:n]
+	f.dirdata = f.dirdata[n:]
+	f.diroffset += uint64(n)
+	return &Fcall{Type: Rread, Data: data}, nil
+}
+
+// this function writes to an open file
+func (c *conn) write(t *Fcall) (*Fcall, error) {
+	f, err := c.lookup(t.Fid)
+	if err != nil {
+		return nil, err
+	}
+	if !f.open {
+		return nil, errNotOpen
+	}
+	if f.qid.Type&QTDIR != 0 {
+		return nil, filesystem.ErrIsDir
+	}
+	if f.mode != OWRITE && f.mode != ORDWR {
+		return nil, errMode
+	}
+	if _, err := f.file.Seek(int64(t.Offset), io.SeekStart); err != nil {
+		return nil, err
+	}
+	n, err := f.file.Write(t.Data)
+	if err != nil {
+		return nil, err
+	}
+	return &Fcall{Type: Rwrite, Count: uint32(n)}, nil
+}
+
+// this function forgets fid, removing its file if it was opened with ORCLOSE
+func (c *conn) clunk(t *Fcall) (*Fcall, error) {
+	f, err := c.lookup(t.Fid)
+	if err != nil {
+		return nil, err
+	}
+	delete(c.fids, t.Fid)
+	if err := c.release(f); err != nil {
+		return nil, err
+	}
+	return &Fcall{Type: Rclunk}, nil
+}
+
+// this function removes the file or empty directory of fid, fid is forgotten even if that fails
+func (c *conn) remove(t *Fcall) (*Fcall, error) {
+	f, err := c.lookup(t.Fid)
+	if err != nil {
+		return nil, err
+	}
+	delete(c.fids, t.Fid)
+	f.rclose = false
+	c.release(f)
+	if err := c.removePath(f); err != nil {
+		return nil, err
+	}
+	return &Fcall{Type: Rremove}, nil
+}
+
+// this function returns the directory entry of fid
+func (c *conn) stat(t *Fcall) (*Fcall, error) {
+	f, err := c.lookup(t.Fid)
+	if err != nil {
+		return nil, err
+	}
+	dir, err := c.dir(f.path)
+	if err != nil {
+		return nil, err
+	}
+	return &Fcall{Type: Rstat, Stat: MarshalDir(dir)}, nil
+}
+
+// this function changes the name, length, permission bits, owner or group of a file, a new name
+// stays in the same directory. A wstat that changes nothing asks for the disk to be committed
+func (c *conn) wstat(t *Fcall) (*Fcall, error) {
+	f, err := c.lookup(t.Fid)
+	if err != nil {
+		return nil, err
+	}
+	dir, rest, err := UnmarshalDir(t.Stat)
+	if err != nil || len(rest) != 0 {
+		return nil, errBadMessage
+	}
+	//every field that stays the same is all ones or an empty string
+	if dir.Type != ^uint16(0) || dir.Dev != ^uint32(0) || dir.Qid.Type != ^uint8(0) ||
+		dir.Qid.Version != ^uint32(0) || dir.Qid.Path != ^uint64(0) ||
+		dir.Atime != ^uint32(0) || dir.Mtime != ^uint32(0) || dir.Muid != "" {
+		return nil, errWstat
+	}
+	if dir.Mode != ^uint32(0) && dir.Mode&DMDIR != uint32(f.qid.Type&QTDIR)<<24 {
+		return nil, errWstat
+	}
+	uid, gid := -1, -1
+	if dir.Uid != "" {
+		if uid, err = strconv.Atoi(dir.Uid); err != nil || uid < 0 {
+			return nil, errUser
+		}
+	}
+	if dir.Gid != "" {
+		if gid, err = strconv.Atoi(dir.Gid); err != nil || gid < 0 {
+			return nil, errUser
+		}
+	}
+	if dir.Length != ^uint64(0) && f.qid.Type&QTDIR != 0 {
+		return nil, filesystem.ErrIsDir
+	}
+	if dir.Name != "" && (f.path == "/" || strings.Contains(dir.Name, "/") || dir.Name == "." || dir.Name == "..") {
+		return nil, errWstat
+	}
+
+	if dir.Name == "" && dir.Mode == ^uint32(0) && uid < 0 && gid < 0 && dir.Length == ^uint64(0) {
+		if err := c.srv.fsys.Sync(); err != nil {
+			return nil, err
+		}
+		return &Fcall{Type: Rwstat}, nil
+	}
+	if dir.Length != ^uint64(0) {
+		file, err := c.srv.fsys.OpenFile(f.path, filesystem.RootInode, c.cred, os.O_WRONLY)
+		if err != nil {
+			return nil, err
+		}
+		err = file.Truncate(int64(dir.Length))
+		file.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if dir.Mode != ^uint32(0) {
+		if err := c.srv.fsys.Chmod(f.path, filesystem.RootInode, c.cred, fs.FileMode(dir.Mode&0777)); err != nil {
+			return nil, err
+		}
+	}
+	if uid >= 0 || gid >= 0 {
+		if err := c.srv.fsys.Chown(f.path, filesystem.RootInode, c.cred, uid, gid); err != nil {
+			return nil, err
+		}
+	}
+	if dir.Name != "" {
+		newpath := path.Join(path.Dir(f.path), dir.Name)
+		if err := c.srv.fsys.Rename(f.path, newpath, filesystem.RootInode, c.cred, false); err != nil {
+			return nil, err
+		}
+		f.path = newpath
+	}
+	return &Fcall{Type: Rwstat}, nil
+}
+
+// this function finds the state of fid
+func (c *conn) lookup(number uint32) (*fid, error) {
+	f, ok := c.fids[number]
+	if !ok {
+		return nil, errUnknownFid
+	}
+	return f, nil
+}
+
+// this function closes what fid holds open and removes its file if it asked for that
+func (c *conn) release(f *fid) error {
+	if f.file != nil {
+		f.file.Close()
+	}
+	if f.rclose {
+		return c.removePath(f)
+	}
+	return nil
+}
+
+// this function removes the file or empty directory of f
+func (c *conn) removePath(f *fid) error {
+	if f.path == "/" {
+		return filesystem.ErrInvalid
+	}
+	if f.qid.Type&QTDIR != 0 {
+		return c.srv.fsys.Rmdir(f.path, filesystem.RootInode, c.cred, false)
+	}
+	return c.srv.fsys.Unlink(f.path, filesystem.RootInode, c.cred)
+}
+
+// this function forgets every fid of the connection
+func (c *conn) clunkAll() {
+	for number, f := range c.fids {
+		delete(c.fids, number)
+		c.release(f)
+	}
+}
+
+// this is the most data one Rread or Twrite can carry
+func (c *conn) iounit() uint32 {
+	return c.msize - ioHeaderSize
+}
+
+// this function returns the directory entry of the file at the absolute path p
+func (c *conn) dir(p string) (Dir, error) {
+	info, err := c.srv.fsys.FS(c.cred).Stat(fsName(p))
+	if err != nil {
+		return Dir{}, err
+	}
+	dir := c.dirInfo(info)
+	if p == "/" {
+		dir.Name = "/"
+	}
+	return dir, nil
+}
+
+// this function turns what the disk knows about a file into a directory entry, owners are the
+// numeric uid and gid and the disk doesn't track who modified a file last
+func (c *conn) dirInfo(info fs.FileInfo) Dir {
+	stat := info.Sys().(*filesystem.FileStat)
+	dir := Dir{
+		Qid:   Qid{Type: QTFILE, Version: uint32(stat.Modified.UnixNano()), Path: uint64(stat.Inode)},
+		Mode:  uint32(info.Mode().Perm()),
+		Atime: uint32(stat.Accessed.Unix()),
+		Mtime: uint32(stat.Modified.Unix()),
+		Name:  info.Name(),
+		Uid:   strconv.Itoa(stat.Uid),
+		Gid:   strconv.Itoa(stat.Gid),
+		Muid:  strconv.Itoa(stat.Uid),
+	}
+	if info.IsDir() {
+		dir.Qid.Type = QTDIR
+		dir.Mode |= DMDIR
+	} else {
+		dir.Length = uint64(info.Size())
+	}
+	return dir
+}
+
+// this function turns an absolute path into a name for the io/fs view of the disk
+func fsName(p string) string {
+	if p = strings.TrimPrefix(p, "/"); p == "" {
+		return "."
+	}
+	return p
+}
@@ -0,0 +1,289 @@
+package ninep
+
+import (
+	"bytes"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+
+	"project1/filesystem"
+)
+
+// this is the client end of a connection to a server, it sends one message at a time
+type testClient struct {
+	t    *testing.T
+	conn net.Conn
+	tag  uint16
+}
+
+// this function starts a server for fsys on one end of a pipe and returns a client for the
+// other end, the connection is closed when the test ends
+func dial(t *testing.T, srv *Server) *testClient {
+	server, client := net.Pipe()
+	done := make(chan error, 1)
+	go func() { done <- srv.ServeConn(server) }()
+	t.Cleanup(func() {
+		client.Close()
+		if err := <-done; err != nil {
+			t.Error("serving:", err)
+		}
+	})
+	return &testClient{t: t, conn: client}
+}
+
+// this function sends t and returns the reply
+func (c *testClient) rpc(t *Fcall) *Fcall {
+	c.t.Helper()
+	c.tag++
+	t.Tag = c.tag
+	if err := WriteFcall(c.conn, t); err != nil {
+		c.t.Fatal(err)
+	}
+	r, err := ReadFcall(c.conn, maxMsize)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	if r.Tag != t.Tag {
+		c.t.Fatalf("reply tag %d, sent %d", r.Tag, t.Tag)
+	}
+	return r
+}
+
+// this function sends t and fails the test unless the reply has type want
+func (c *testClient) ok(t *Fcall, want uint8) *Fcall {
+	c.t.Helper()
+	r := c.rpc(t)
+	if r.Type != want {
+		c.t.Fatalf("message %d: reply %d %q, want %d", t.Type, r.Type, r.Ename, want)
+	}
+	return r
+}
+
+// this function sends t and fails the test unless the reply is an Rerror that ends in ename,
+// errors from the disk start with the operation and the path
+func (c *testClient) fails(t *Fcall, ename string) {
+	c.t.Helper()
+	r := c.rpc(t)
+	if r.Type != Rerror || !strings.HasSuffix(r.Ename, ename) {
+		c.t.Fatalf("message %d: reply %d %q, want error %q", t.Type, r.Type, r.Ename, ename)
+	}
+}
+
+// this function returns a stat for Twstat that changes nothing
+func unchanged() Dir {
+	return Dir{Type: ^uint16(0), Dev: ^uint32(0), Qid: Qid{^uint8(0), ^uint32(0), ^uint64(0)},
+		Mode: ^uint32(0), Atime: ^uint32(0), Mtime: ^uint32(0), Length: ^uint64(0)}
+}
+
+// this function returns a disk owned by alice with /docs/a.txt on it
+func testDisk(t *testing.T) *filesystem.FileSystem {
+	alice := filesystem.Cred{Uid: 1000, Gid: 1000}
+	fsys, err := filesystem.New(filesystem.Options{Owner: alice})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fsys.Mkdir("/docs", filesystem.RootInode, alice)
+	f, err := fsys.Create("/docs/a.txt", filesystem.RootInode, alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("hello 9p"))
+	return fsys
+}
+
+func TestServer(t *testing.T) {
+	fsys := testDisk(t)
+	c := dial(t, NewServer(fsys, Options{Identify: NumericUser}))
+	c.fails(&Fcall{Type: Tattach, Fid: 0, Afid: NOFID, Uname: "1000"}, errNoVersion.Error())
+	r := c.ok(&Fcall{Type: Tversion, Tag: NOTAG, Msize: 1 << 20, Version: "9P2000.u"}, Rversion)
+	if r.Msize != maxMsize || r.Version != Version {
+		t.Fatal(r.Msize, r.Version)
+	}
+	c.fails(&Fcall{Type: Tauth, Afid: 9, Uname: "1000"}, errNoAuth.Error())
+	c.fails(&Fcall{Type: Tattach, Fid: 0, Afid: NOFID, Uname: "alice"}, errUser.Error())
+	r = c.ok(&Fcall{Type: Tattach, Fid: 0, Afid: NOFID, Uname: "1000"}, Rattach)
+	if r.Qid.Type != QTDIR || r.Qid.Path != filesystem.RootInode {
+		t.Fatal(r.Qid)
+	}
+	c.fails(&Fcall{Type: Tattach, Fid: 0, Afid: NOFID, Uname: "1000"}, errFidInUse.Error())
+
+	//walks
+	r = c.ok(&Fcall{Type: Twalk, Fid: 0, Newfid: 1, Wname: []string{"docs", "a.txt"}}, Rwalk)
+	if len(r.Wqid) != 2 || r.Wqid[0].Type != QTDIR || r.Wqid[1].Type != QTFILE {
+		t.Fatal(r.Wqid)
+	}
+	r = c.ok(&Fcall{Type: Twalk, Fid: 0, Newfid: 2, Wname: []string{"docs", "nope"}}, Rwalk)
+	if len(r.Wqid) != 1 {
+		t.Fatal("partial walk", r.Wqid)
+	}
+	c.fails(&Fcall{Type: Twalk, Fid: 2, Newfid: 3}, errUnknownFid.Error())
+	c.fails(&Fcall{Type: Twalk, Fid: 0, Newfid: 2, Wname: []string{"nope"}}, "file does not exist")
+	c.fails(&Fcall{Type: Twalk, Fid: 1, Newfid: 2, Wname: []string{"x"}}, "not a directory")
+	r = c.ok(&Fcall{Type: Twalk, Fid: 0, Newfid: 2, Wname: []string{"docs", "..", "docs"}}, Rwalk)
+	if len(r.Wqid) != 3 || r.Wqid[1].Path != filesystem.RootInode {
+		t.Fatal("walk through ..", r.Wqid)
+	}
+	c.ok(&Fcall{Type: Tclunk, Fid: 2}, Rclunk)
+	c.fails(&Fcall{Type: Tclunk, Fid: 2}, errUnknownFid.Error())
+
+	//reading and writing an open file
+	c.fails(&Fcall{Type: Tread, Fid: 1, Count: 100}, errNotOpen.Error())
+	c.fails(&Fcall{Type: Topen, Fid: 1, Mode: 0x80}, errMode.Error())
+	c.ok(&Fcall{Type: Topen, Fid: 1, Mode: ORDWR}, Ropen)
+	c.fails(&Fcall{Type: Topen, Fid: 1, Mode: OREAD}, errOpen.Error())
+	if r = c.ok(&Fcall{Type: Tread, Fid: 1, Offset: 6, Count: 100}, Rread); string(r.Data) != "9p" {
+		t.Fatal(string(r.Data))
+	}
+	if r = c.ok(&Fcall{Type: Twrite, Fid: 1, Offset: 8, Data: []byte(" and more")}, Rwrite); r.Count != 9 {
+		t.Fatal(r.Count)
+	}
+	if r = c.ok(&Fcall{Type: Tread, Fid: 1, Count: 100}, Rread); string(r.Data) != "hello 9p and more" {
+		t.Fatal(string(r.Data))
+	}
+	r = c.ok(&Fcall{Type: Tstat, Fid: 1}, Rstat)
+	dir, _, err := UnmarshalDir(r.Stat)
+	if err != nil || dir.Name != "a.txt" || dir.Length != 17 || dir.Uid != "1000" || dir.Mode != 0644 {
+		t.Fatal(dir, err)
+	}
+	c.ok(&Fcall{Type: Tclunk, Fid: 1}, Rclunk)
+
+	//creating a file and a directory
+	c.ok(&Fcall{Type: Twalk, Fid: 0, Newfid: 3, Wname: []string{"docs"}}, Rwalk)
+	c.fails(&Fcall{Type: Tcreate, Fid: 3, Name: "a.txt", Perm: 0644, Mode: OWRITE}, "file already exists")
+	c.fails(&Fcall{Type: Tcreate, Fid: 3, Name: "..", Perm: 0644, Mode: OWRITE}, "invalid argument")
+	r = c.ok(&Fcall{Type: Tcreate, Fid: 3, Name: "new", Perm: 0600, Mode: OWRITE}, Rcreate)
+	if r.Qid.Type != QTFILE {
+		t.Fatal(r.Qid)
+	}
+	c.ok(&Fcall{Type: Twrite, Fid: 3, Data: []byte("xyz")}, Rwrite)
+	c.fails(&Fcall{Type: Tread, Fid: 3, Count: 10}, errMode.Error())
+	c.ok(&Fcall{Type: Tclunk, Fid: 3}, Rclunk)
+	c.ok(&Fcall{Type: Twalk, Fid: 0, Newfid: 4, Wname: []string{"docs"}}, Rwalk)
+	if r = c.ok(&Fcall{Type: Tcreate, Fid: 4, Name: "sub", Perm: DMDIR | 0755, Mode: OREAD}, Rcreate); r.Qid.Type != QTDIR {
+		t.Fatal(r.Qid)
+	}
+	c.fails(&Fcall{Type: Twrite, Fid: 4, Data: []byte("x")}, "is a directory")
+	c.ok(&Fcall{Type: Tclunk, Fid: 4}, Rclunk)
+	if fi, err := fsys.Stat("/docs/new", filesystem.RootInode, filesystem.RootCred); err != nil || fi.Mode() != 0600 {
+		t.Fatal(fi, err)
+	}
+
+	//a directory is read as whole entries, in as many reads as it takes
+	c.ok(&Fcall{Type: Twalk, Fid: 0, Newfid: 5, Wname: []string{"docs"}}, Rwalk)
+	c.ok(&Fcall{Type: Topen, Fid: 5, Mode: OREAD}, Ropen)
+	var names []string
+	var offset uint64
+	for {
+		r = c.ok(&Fcall{Type: Tread, Fid: 5, Offset: offset, Count: 80}, Rread)
+		if len(r.Data) == 0 {
+			break
+		}
+		offset += uint64(len(r.Data))
+		for b := r.Data; len(b) > 0; {
+			if dir, b, err = UnmarshalDir(b); err != nil {
+				t.Fatal(err)
+			}
+			names = append(names, dir.Name)
+		}
+	}
+	if !reflect.DeepEqual(names, []string{"a.txt", "new", "sub"}) {
+		t.Fatal(names)
+	}
+	c.fails(&Fcall{Type: Tread, Fid: 5, Offset: 3, Count: 80}, errDirOffset.Error())
+	c.ok(&Fcall{Type: Tclunk, Fid: 5}, Rclunk)
+
+	//removing
+	c.ok(&Fcall{Type: Twalk, Fid: 0, Newfid: 6, Wname: []string{"docs"}}, Rwalk)
+	c.fails(&Fcall{Type: Tremove, Fid: 6}, "directory not empty")
+	c.fails(&Fcall{Type: Tclunk, Fid: 6}, errUnknownFid.Error())
+	c.ok(&Fcall{Type: Twalk, Fid: 0, Newfid: 6, Wname: []string{"docs", "sub"}}, Rwalk)
+	c.ok(&Fcall{Type: Tremove, Fid: 6}, Rremove)
+
+	//wstat
+	c.ok(&Fcall{Type: Twalk, Fid: 0, Newfid: 7, Wname: []string{"docs", "a.txt"}}, Rwalk)
+	stat := unchanged()
+	stat.Length = 5
+	c.ok(&Fcall{Type: Twstat, Fid: 7, Stat: MarshalDir(stat)}, Rwstat)
+	stat = unchanged()
+	stat.Name = "renamed.txt"
+	stat.Mode = 0640
+	c.ok(&Fcall{Type: Twstat, Fid: 7, Stat: MarshalDir(stat)}, Rwstat)
+	r = c.ok(&Fcall{Type: Tstat, Fid: 7}, Rstat)
+	if dir, _, _ = UnmarshalDir(r.Stat); dir.Name != "renamed.txt" || dir.Length != 5 || dir.Mode != 0640 {
+		t.Fatal(dir)
+	}
+	stat = unchanged()
+	stat.Mtime = 0
+	c.fails(&Fcall{Type: Twstat, Fid: 7, Stat: MarshalDir(stat)}, errWstat.Error())
+	stat = unchanged()
+	stat.Uid = "0"
+	c.fails(&Fcall{Type: Twstat, Fid: 7, Stat: MarshalDir(stat)}, "permission denied")
+	c.ok(&Fcall{Type: Twstat, Fid: 7, Stat: MarshalDir(unchanged())}, Rwstat)
+
+	b, err := fsys.FS(filesystem.RootCred).ReadFile("docs/renamed.txt")
+	if err != nil || string(b) != "hello" {
+		t.Fatal(string(b), err)
+	}
+	if b, _ = fsys.FS(filesystem.RootCred).ReadFile("docs/new"); !bytes.Equal(b, []byte("xyz")) {
+		t.Fatal(string(b))
+	}
+	if findings, err := fsys.Fsck(false); err != nil || len(findings) > 0 {
+		t.Fatal(findings, err)
+	}
+}
+
+func TestServerRemoveOnClunk(t *testing.T) {
+	fsys := testDisk(t)
+	c := dial(t, NewServer(fsys, Options{Identify: NumericUser}))
+	c.ok(&Fcall{Type: Tversion, Tag: NOTAG, Msize: 8192, Version: Version}, Rversion)
+	c.ok(&Fcall{Type: Tattach, Fid: 0, Afid: NOFID, Uname: "1000"}, Rattach)
+	c.ok(&Fcall{Type: Twalk, Fid: 0, Newfid: 1, Wname: []string{"docs"}}, Rwalk)
+	c.ok(&Fcall{Type: Tcreate, Fid: 1, Name: "tmp", Perm: 0644, Mode: OWRITE | ORCLOSE}, Rcreate)
+	if _, err := fsys.Stat("/docs/tmp", filesystem.RootInode, filesystem.RootCred); err != nil {
+		t.Fatal(err)
+	}
+	c.ok(&Fcall{Type: Tclunk, Fid: 1}, Rclunk)
+	if _, err := fsys.Stat("/docs/tmp", filesystem.RootInode, filesystem.RootCred); err == nil {
+		t.Fatal("ORCLOSE file left behind")
+	}
+	//a new Tversion forgets every fid
+	c.ok(&Fcall{Type: Tversion, Tag: NOTAG, Msize: 8192, Version: Version}, Rversion)
+	c.fails(&Fcall{Type: Tstat, Fid: 0}, errUnknownFid.Error())
+}
+
+func TestServerIdentity(t *testing.T) {
+	fsys := testDisk(t)
+	alice := filesystem.Cred{Uid: 1000, Gid: 1000}
+	connect := func(options Options) *testClient {
+		c := dial(t, NewServer(fsys, options))
+		c.ok(&Fcall{Type: Tversion, Tag: NOTAG, Msize: 8192, Version: Version}, Rversion)
+		return c
+	}
+
+	//by default the user name counts for nothing, the connection is nobody
+	c := connect(Options{})
+	c.ok(&Fcall{Type: Tattach, Fid: 0, Afid: NOFID, Uname: "0"}, Rattach)
+	c.ok(&Fcall{Type: Twalk, Fid: 0, Newfid: 1, Wname: []string{"docs"}}, Rwalk)
+	c.fails(&Fcall{Type: Tcreate, Fid: 1, Name: "x", Perm: 0644, Mode: OWRITE}, "permission denied")
+	c.ok(&Fcall{Type: Twalk, Fid: 0, Newfid: 2, Wname: []string{"docs", "a.txt"}}, Rwalk)
+	c.ok(&Fcall{Type: Topen, Fid: 2, Mode: OREAD}, Ropen)
+
+	//root is refused unless it is allowed
+	c = connect(Options{Identify: NumericUser})
+	c.fails(&Fcall{Type: Tattach, Fid: 0, Afid: NOFID, Uname: "0"}, errRoot.Error())
+	c = connect(Options{Identify: As(filesystem.RootCred)})
+	c.fails(&Fcall{Type: Tattach, Fid: 0, Afid: NOFID, Uname: "1000"}, errRoot.Error())
+	c = connect(Options{Identify: NumericUser, AllowRoot: true})
+	c.ok(&Fcall{Type: Tattach, Fid: 0, Afid: NOFID, Uname: "0"}, Rattach)
+
+	//As picks the user on the server side
+	c = connect(Options{Identify: As(alice)})
+	c.ok(&Fcall{Type: Tattach, Fid: 0, Afid: NOFID, Uname: "0"}, Rattach)
+	c.ok(&Fcall{Type: Twalk, Fid: 0, Newfid: 1, Wname: []string{"docs"}}, Rwalk)
+	c.ok(&Fcall{Type: Tcreate, Fid: 1, Name: "x", Perm: 0644, Mode: OWRITE}, Rcreate)
+	info, err := fsys.Stat("/docs/x", filesystem.RootInode, filesystem.RootCred)
+	if err != nil || info.Sys().(*filesystem.FileStat).Uid != alice.Uid {
+		t.Fatal(info, err)
+	}
+}